@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAuditLogPath    = "/var/log/jobsub-pnfs-dropbox-cleanup/audit.jsonl"
+	defaultAuditLogMaxMB   = 100
+	defaultAuditLogBackups = 10
+)
+
+// Audit record statuses.  An attempt is recorded as started, and synced to disk, before it is made, so that there is a
+// record of it even if the process dies during the attempt.
+const (
+	AuditStarted   = "started"
+	AuditSucceeded = "succeeded"
+	AuditFailed    = "failed"
+	// AuditRefused is for candidates that were never attempted because they failed the dropbox root check
+	AuditRefused = "refused"
+)
+
+// AuditRecord is one line of the audit log
+type AuditRecord struct {
+	Time         time.Time `json:"time"`
+	RunID        string    `json:"run_id"`
+	Experiment   string    `json:"experiment"`
+	TokenSubject string    `json:"token_subject"`
+	// Action is "delete", "quarantine", or "restore"
+	Action   string     `json:"action"`
+	URL      string     `json:"url"`
+	MovedTo  string     `json:"moved_to,omitempty"`
+	Entry    AuditEntry `json:"entry"`
+	Decision Decision   `json:"decision"`
+	Reason   string     `json:"reason"`
+	Attempt  int        `json:"attempt"`
+	Status   string     `json:"status"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// AuditEntry is the dropbox listing's metadata for an audited entry
+type AuditEntry struct {
+	Name        string    `json:"name"`
+	Created     time.Time `json:"created"`
+	IsDirectory bool      `json:"is_directory"`
+	Size        int64     `json:"size"`
+}
+
+// AuditLog is an append-only JSON Lines log of every deletion and restore attempt.  Each record is synced to disk before Write
+// returns.  Once the log reaches maxSize, it is rotated:  the current file is renamed with a ".1" suffix, older files
+// are shifted up one, and anything past maxBackups is removed.  An AuditLog is safe for concurrent use.  A nil AuditLog
+// doesn't record anything.
+type AuditLog struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+	// err is the first error writing the log, so that it can still be reported once the run is over
+	err error
+}
+
+// OpenAuditLog opens the audit log at path for appending, creating it if needed.  A maxSize of zero or less disables
+// rotation.  Otherwise, at least one backup must be kept, since the log is append-only and rotating it without a backup
+// would delete it.
+func OpenAuditLog(path string, maxSize int64, maxBackups int) (*AuditLog, error) {
+	if maxSize > 0 && maxBackups < 1 {
+		return nil, errors.New("could not open audit log: rotation must keep at least one backup")
+	}
+	a := &AuditLog{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return fmt.Errorf("could not open audit log: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("could not open audit log: %w", err)
+	}
+	a.file, a.size = f, info.Size()
+	return nil
+}
+
+// Write appends r to the log and syncs it to disk
+func (a *AuditLog) Write(r AuditRecord) error {
+	if a == nil {
+		return nil
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	err = a.write(line)
+	if err != nil && a.err == nil {
+		a.err = err
+	}
+	return err
+}
+
+func (a *AuditLog) write(line []byte) error {
+	if a.file == nil {
+		return errors.New("audit log is closed")
+	}
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("could not write audit log: %w", err)
+	}
+	if err := a.file.Sync(); err != nil {
+		return fmt.Errorf("could not sync audit log: %w", err)
+	}
+	return nil
+}
+
+// rotate moves the current log out of the way and starts a new one.  a.mu must be held.
+func (a *AuditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return fmt.Errorf("could not rotate audit log: %w", err)
+	}
+	a.file = nil
+	os.Remove(a.backupPath(a.maxBackups))
+	for i := a.maxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(a.backupPath(i), a.backupPath(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("could not rotate audit log: %w", err)
+		}
+	}
+	if err := os.Rename(a.path, a.backupPath(1)); err != nil {
+		return fmt.Errorf("could not rotate audit log: %w", err)
+	}
+	if err := a.open(); err != nil {
+		return err
+	}
+	// The renames and the new file aren't durable until the directory is synced
+	if err := syncDir(filepath.Dir(a.path)); err != nil {
+		return fmt.Errorf("could not rotate audit log: %w", err)
+	}
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (a *AuditLog) backupPath(i int) string {
+	return fmt.Sprintf("%s.%d", a.path, i)
+}
+
+// Close closes the log.  The error includes the first error that happened writing the log, if any, since those can't
+// always be reported when they happen.
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var closeErr error
+	if a.file != nil {
+		closeErr = a.file.Close()
+		a.file = nil
+	}
+	return errors.Join(a.err, closeErr)
+}
+
+// Auditor writes the audit records for one experiment's deletions.  A nil Auditor doesn't record anything.
+type Auditor struct {
+	log          *AuditLog
+	runID        string
+	experiment   string
+	tokenSubject string
+	now          func() time.Time
+}
+
+// ForExperiment returns an Auditor that records the deletions made for experiment during the run with runID, using a
+// token whose subject is tokenSubject
+func (a *AuditLog) ForExperiment(runID, experiment, tokenSubject string) *Auditor {
+	if a == nil {
+		return nil
+	}
+	return &Auditor{log: a, runID: runID, experiment: experiment, tokenSubject: tokenSubject, now: time.Now}
+}
+
+// record writes the audit record for an attempt to delete or move outcome's candidate
+func (a *Auditor) record(outcome DeletionOutcome, attempt int, status string) error {
+	action := "delete"
+	if outcome.MovedTo != "" {
+		action = "quarantine"
+	}
+	return a.write(action, outcome, attempt, status)
+}
+
+// recordRestore writes the audit record for moving outcome's entry from outcome.URL in the quarantine area back to
+// outcome.MovedTo in the dropbox
+func (a *Auditor) recordRestore(outcome DeletionOutcome, status string) error {
+	return a.write("restore", outcome, 1, status)
+}
+
+func (a *Auditor) write(action string, outcome DeletionOutcome, attempt int, status string) error {
+	if a == nil {
+		return nil
+	}
+	r := AuditRecord{
+		Time:         a.now(),
+		RunID:        a.runID,
+		Experiment:   a.experiment,
+		TokenSubject: a.tokenSubject,
+		Action:       action,
+		URL:          outcome.URL,
+		MovedTo:      outcome.MovedTo,
+		Entry: AuditEntry{
+			Name:        outcome.Entry.Entry.filename,
+			Created:     outcome.Entry.Entry.created,
+			IsDirectory: outcome.Entry.Entry.isDirectory,
+			Size:        outcome.Entry.Entry.size,
+		},
+		Decision: outcome.Entry.Decision,
+		Reason:   outcome.Entry.Reason,
+		Attempt:  attempt,
+		Status:   status,
+	}
+	if outcome.Err != nil {
+		r.Error = outcome.Err.Error()
+	}
+	return a.log.Write(r)
+}
+
+// NewRunID returns a unique ID for a run, so that all of its audit records can be found together
+func NewRunID(now time.Time) string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return now.UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(b)
+}
+
+// auditLogOptions are the audit log flags
+type auditLogOptions struct {
+	path    string
+	maxMB   int
+	backups int
+}
+
+// auditLogFlags adds the audit log flags to flags
+func auditLogFlags(flags *flag.FlagSet) *auditLogOptions {
+	o := new(auditLogOptions)
+	flags.StringVar(&o.path, "audit-log", defaultAuditLogPath, "Where every deletion and restore attempt is recorded.  Empty disables the audit log.")
+	flags.IntVar(&o.maxMB, "audit-log-max-mb", defaultAuditLogMaxMB, "Size in MB at which the audit log is rotated.  0 disables rotation.")
+	flags.IntVar(&o.backups, "audit-log-backups", defaultAuditLogBackups, "How many rotated audit logs are kept.  Must be at least 1.")
+	return o
+}
+
+func (o *auditLogOptions) validate() error {
+	// Rotating without a backup would delete the audit trail
+	if o.backups < 1 {
+		return errors.New("-audit-log-backups must be at least 1")
+	}
+	return nil
+}
+
+// open opens the audit log the options describe, or returns a nil AuditLog if audit logging is disabled
+func (o *auditLogOptions) open() (*AuditLog, error) {
+	if o.path == "" {
+		return nil, nil
+	}
+	return OpenAuditLog(o.path, int64(o.maxMB)<<20, o.backups)
+}
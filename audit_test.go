@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readAuditLog reads back every record in the audit log at path
+func readAuditLog(t *testing.T, path string) []AuditRecord {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records := make([]AuditRecord, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("invalid audit record %q: %s", scanner.Text(), err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestAuditLogWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	a, err := OpenAuditLog(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := AuditRecord{Time: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), RunID: "run1", URL: "/dropbox/a", Status: AuditStarted}
+	assert.NoError(t, a.Write(first))
+	assert.NoError(t, a.Close())
+
+	// Reopening appends
+	a, err = OpenAuditLog(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := AuditRecord{Time: time.Date(2024, 1, 1, 0, 0, 1, 0, time.UTC), RunID: "run1", URL: "/dropbox/a", Status: AuditSucceeded}
+	assert.NoError(t, a.Write(second))
+	assert.NoError(t, a.Close())
+	assert.Equal(t, []AuditRecord{first, second}, readAuditLog(t, path))
+
+	// Writes after closing fail, and the failure is reported again by Close
+	assert.Error(t, a.Write(second))
+	assert.Error(t, a.Close())
+
+	// A nil AuditLog records nothing
+	var none *AuditLog
+	assert.NoError(t, none.Write(first))
+	assert.Nil(t, none.ForExperiment("run1", "gm2", ""))
+	assert.NoError(t, none.Close())
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	line, _ := json.Marshal(AuditRecord{URL: "/dropbox/0"})
+	// Room for exactly one record per file
+	a, err := OpenAuditLog(path, int64(len(line)+1), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, a.Write(AuditRecord{URL: fmt.Sprintf("/dropbox/%d", i)}))
+	}
+	assert.NoError(t, a.Close())
+
+	assert.Equal(t, []AuditRecord{{URL: "/dropbox/3"}}, readAuditLog(t, path))
+	assert.Equal(t, []AuditRecord{{URL: "/dropbox/2"}}, readAuditLog(t, path+".1"))
+	assert.Equal(t, []AuditRecord{{URL: "/dropbox/1"}}, readAuditLog(t, path+".2"))
+	assert.NoFileExists(t, path+".3")
+
+	// Rotating the append-only log with nowhere to put it would delete it
+	_, err = OpenAuditLog(filepath.Join(t.TempDir(), "audit.jsonl"), 100, 0)
+	assert.Error(t, err)
+}
+
+func TestAuditLogFlags(t *testing.T) {
+	type testCase struct {
+		description     string
+		args            []string
+		expectedErr     bool
+		expectedMaxSize int64
+		expectedBackups int
+	}
+
+	testCases := []testCase{
+		{"Defaults", []string{}, false, defaultAuditLogMaxMB << 20, defaultAuditLogBackups},
+		{"One backup", []string{"-audit-log-max-mb", "1", "-audit-log-backups", "1"}, false, 1 << 20, 1},
+		{"No rotation", []string{"-audit-log-max-mb", "0"}, false, 0, defaultAuditLogBackups},
+		{"No backups", []string{"-audit-log-backups", "0"}, true, 0, 0},
+		{"Negative backups", []string{"-audit-log-backups", "-1"}, true, 0, 0},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.jsonl")
+			flags := flag.NewFlagSet("test", flag.ContinueOnError)
+			o := auditLogFlags(flags)
+			assert.NoError(t, flags.Parse(append([]string{"-audit-log", path}, test.args...)))
+			if test.expectedErr {
+				assert.Error(t, o.validate())
+				return
+			}
+			assert.NoError(t, o.validate())
+
+			a, err := o.open()
+			if assert.NoError(t, err) {
+				assert.Equal(t, test.expectedMaxSize, a.maxSize)
+				assert.Equal(t, test.expectedBackups, a.maxBackups)
+				assert.NoError(t, a.Close())
+			}
+		})
+	}
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	o := auditLogFlags(flags)
+	assert.NoError(t, flags.Parse([]string{"-audit-log", ""}))
+	a, err := o.open()
+	assert.NoError(t, err)
+	assert.Nil(t, a, "an empty path disables the audit log")
+}
+
+func TestDeletionExecutorAudit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	a, err := OpenAuditLog(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	auditor := a.ForExperiment("run1", "gm2", "gm2pro@fnal.gov")
+	auditor.now = func() time.Time { return now }
+
+	errTimeout := fmt.Errorf("%w: gfal-rm failed: Connection timed out", ErrTransient)
+	f := newFlakyFileAccessor(map[string][]error{"/dropbox/dir": {errTimeout}})
+	d := NewDeletionExecutor(f, DeletionOptions{Workers: 1, Audit: auditor})
+	d.sleep = func(context.Context, time.Duration) error { return nil }
+	candidates := testCandidates("dir", "..")
+	candidates[0].Reason = "older than 720h0m0s and not referenced by any job"
+	d.Delete(context.Background(), "/dropbox", candidates)
+	assert.NoError(t, a.Close())
+
+	entry := AuditEntry{"dir", time.Time{}, true, 0}
+	record := func(attempt int, status, err string) AuditRecord {
+		return AuditRecord{now, "run1", "gm2", "gm2pro@fnal.gov", "delete", "/dropbox/dir", "", entry, DecisionDelete, candidates[0].Reason, attempt, status, err}
+	}
+	records := readAuditLog(t, path)
+	if assert.Len(t, records, 5) {
+		assert.Equal(t, record(1, AuditStarted, ""), records[0])
+		assert.Equal(t, record(1, AuditFailed, errTimeout.Error()), records[1])
+		assert.Equal(t, record(2, AuditStarted, ""), records[2])
+		assert.Equal(t, record(2, AuditSucceeded, ""), records[3])
+		assert.Equal(t, "/dropbox/..", records[4].URL)
+		assert.Equal(t, AuditRefused, records[4].Status)
+		assert.Contains(t, records[4].Error, ErrOutsideDropbox.Error())
+	}
+}
+
+func TestDeletionExecutorAuditFailure(t *testing.T) {
+	a, err := OpenAuditLog(filepath.Join(t.TempDir(), "audit.jsonl"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+
+	// Nothing is deleted without a record of it
+	f := newFlakyFileAccessor(nil)
+	outcomes := NewDeletionExecutor(f, DeletionOptions{Audit: a.ForExperiment("run1", "gm2", "")}).Delete(context.Background(), "/dropbox", testCandidates("dir"))
+	if assert.Len(t, outcomes, 1) {
+		assert.Error(t, outcomes[0].Err)
+		assert.Equal(t, 0, outcomes[0].Attempts)
+	}
+	assert.Empty(t, f.removed)
+	assert.Error(t, a.Close())
+}
+
+func TestRunExperimentAudit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	a, err := OpenAuditLog(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().AddDate(0, -2, 0)
+	f := newTestFileAccessor([]FileEntry{{"stale", old, true, 0}}, false, []bool{false})
+
+	opts := RunOptions{Audit: a, RunID: "run1", TokenSubject: "gm2pro@fnal.gov"}
+	result := RunExperiment(context.Background(), testRunExperimentConfig(t), f, testRunJobListers(), nil, nil, opts)
+	assert.NoError(t, result.Err)
+	assert.NoError(t, a.Close())
+
+	records := readAuditLog(t, path)
+	if assert.Len(t, records, 2) {
+		for _, r := range records {
+			assert.Equal(t, "run1", r.RunID)
+			assert.Equal(t, "gm2", r.Experiment)
+			assert.Equal(t, "gm2pro@fnal.gov", r.TokenSubject)
+			assert.Equal(t, "https://fndcadoor.fnal.gov:2880/GM2/resilient/jobsub_stage/stale", r.URL)
+		}
+		assert.Equal(t, AuditStarted, records[0].Status)
+		assert.Equal(t, AuditSucceeded, records[1].Status)
+	}
+}
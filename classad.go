@@ -0,0 +1,159 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ClassAdExpr is a ClassAd expression, such as a constraint for condor_q.  Expressions are built up with Attr, Str, Int,
+// the comparison functions, And, Or, and Not, and String renders them with correct quoting and parenthesization, so
+// values like experiment names can never change the structure of the expression.
+type ClassAdExpr interface {
+	String() string
+}
+
+// attributeNameRegex matches attribute names that can be written bare in an expression
+var attributeNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+type attrExpr string
+
+// Attr is a reference to the named attribute
+func Attr(name string) ClassAdExpr { return attrExpr(name) }
+
+func (a attrExpr) String() string {
+	if attributeNameRegex.MatchString(string(a)) {
+		return string(a)
+	}
+	// Anything else has to be written as a quoted attribute name
+	return "'" + escapeClassAdString(string(a), '\'') + "'"
+}
+
+type literalExpr string
+
+// Str is a string literal
+func Str(s string) ClassAdExpr { return literalExpr(`"` + escapeClassAdString(s, '"') + `"`) }
+
+// Int is an integer literal
+func Int(i int64) ClassAdExpr { return literalExpr(strconv.FormatInt(i, 10)) }
+
+func (l literalExpr) String() string { return string(l) }
+
+func escapeClassAdString(s string, quote rune) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '\\', quote:
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+type compareExpr struct {
+	op          string
+	left, right ClassAdExpr
+}
+
+func (c compareExpr) String() string {
+	return operand(c.left, true) + " " + c.op + " " + operand(c.right, true)
+}
+
+// Eq is a == b.  Note that ClassAd == compares strings case-insensitively;  use Is for a case-sensitive comparison.
+func Eq(a, b ClassAdExpr) ClassAdExpr { return compareExpr{"==", a, b} }
+
+// Ne is a != b
+func Ne(a, b ClassAdExpr) ClassAdExpr { return compareExpr{"!=", a, b} }
+
+// Is is a =?= b, which is never undefined and compares strings case-sensitively
+func Is(a, b ClassAdExpr) ClassAdExpr { return compareExpr{"=?=", a, b} }
+
+// Isnt is a =!= b, the negation of Is
+func Isnt(a, b ClassAdExpr) ClassAdExpr { return compareExpr{"=!=", a, b} }
+
+// Ge is a >= b
+func Ge(a, b ClassAdExpr) ClassAdExpr { return compareExpr{">=", a, b} }
+
+// Lt is a < b
+func Lt(a, b ClassAdExpr) ClassAdExpr { return compareExpr{"<", a, b} }
+
+type logicalExpr struct {
+	op       string
+	identity string
+	operands []ClassAdExpr
+}
+
+func (l logicalExpr) String() string {
+	switch len(l.operands) {
+	case 0:
+		return l.identity
+	case 1:
+		return l.operands[0].String()
+	}
+	rendered := make([]string, 0, len(l.operands))
+	for _, o := range l.operands {
+		rendered = append(rendered, operand(o, false))
+	}
+	return strings.Join(rendered, " "+l.op+" ")
+}
+
+// And is true if all of exprs are.  With no exprs, it is true.
+func And(exprs ...ClassAdExpr) ClassAdExpr { return logicalExpr{"&&", "true", exprs} }
+
+// Or is true if any of exprs are.  With no exprs, it is false.
+func Or(exprs ...ClassAdExpr) ClassAdExpr { return logicalExpr{"||", "false", exprs} }
+
+// In is true if attr is equal to any of values
+func In(attr ClassAdExpr, values ...ClassAdExpr) ClassAdExpr {
+	exprs := make([]ClassAdExpr, 0, len(values))
+	for _, v := range values {
+		exprs = append(exprs, Eq(attr, v))
+	}
+	return Or(exprs...)
+}
+
+type notExpr struct {
+	expr ClassAdExpr
+}
+
+// Not negates expr
+func Not(expr ClassAdExpr) ClassAdExpr { return notExpr{expr} }
+
+func (n notExpr) String() string {
+	switch n.expr.(type) {
+	case attrExpr, literalExpr:
+		return "!" + n.expr.String()
+	}
+	return "!(" + n.expr.String() + ")"
+}
+
+// operand renders expr for use as an operand of another expression, wrapping it in parentheses if it contains operators
+// that could bind differently there.  Comparisons bind more tightly than && and ||, so they only need parentheses when
+// they are themselves compared.
+func operand(expr ClassAdExpr, inComparison bool) string {
+	switch e := expr.(type) {
+	case compareExpr:
+		if !inComparison {
+			return e.String()
+		}
+	case logicalExpr:
+		if len(e.operands) == 1 {
+			return operand(e.operands[0], inComparison)
+		}
+		if len(e.operands) == 0 {
+			return e.String()
+		}
+	default:
+		return e.String()
+	}
+	return "(" + expr.String() + ")"
+}
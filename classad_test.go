@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassAdExprString(t *testing.T) {
+	type testCase struct {
+		description string
+		expr        ClassAdExpr
+		expected    string
+	}
+
+	testCases := []testCase{
+		{
+			"Attribute equals string",
+			Eq(Attr("Jobsub_Group"), Str("gm2")),
+			`Jobsub_Group == "gm2"`,
+		},
+		{
+			"Quotes and backslashes in strings are escaped",
+			Eq(Attr("Jobsub_Group"), Str(`gm2" || true || "`)),
+			`Jobsub_Group == "gm2\" || true || \""`,
+		},
+		{
+			"Trailing backslash cannot escape the closing quote",
+			Eq(Attr("Jobsub_Group"), Str(`gm2\`)),
+			`Jobsub_Group == "gm2\\"`,
+		},
+		{
+			"Newlines in strings are escaped",
+			Eq(Attr("Jobsub_Group"), Str("gm2\nJobStatus")),
+			`Jobsub_Group == "gm2\nJobStatus"`,
+		},
+		{
+			"Attribute names that aren't identifiers are quoted",
+			Eq(Attr("Weird Attr's"), Int(1)),
+			`'Weird Attr\'s' == 1`,
+		},
+		{
+			"And of comparisons",
+			And(Eq(Attr("A"), Int(1)), Ge(Attr("B"), Int(-2))),
+			`A == 1 && B >= -2`,
+		},
+		{
+			"Or nested in And is parenthesized",
+			And(Eq(Attr("A"), Int(1)), Or(Eq(Attr("B"), Int(2)), Lt(Attr("C"), Int(3)))),
+			`A == 1 && (B == 2 || C < 3)`,
+		},
+		{
+			"And nested in Or is parenthesized",
+			Or(And(Ne(Attr("A"), Int(1)), Is(Attr("B"), Str("x"))), Isnt(Attr("C"), Int(3))),
+			`(A != 1 && B =?= "x") || C =!= 3`,
+		},
+		{
+			"Single-element And and Or are transparent",
+			And(Or(Eq(Attr("A"), Int(1)))),
+			`A == 1`,
+		},
+		{
+			"Empty And is true",
+			And(),
+			`true`,
+		},
+		{
+			"Empty Or is false",
+			Or(),
+			`false`,
+		},
+		{
+			"In",
+			In(Attr("JobStatus"), Int(1), Int(2), Int(5)),
+			`JobStatus == 1 || JobStatus == 2 || JobStatus == 5`,
+		},
+		{
+			"Empty In matches nothing",
+			And(Eq(Attr("A"), Int(1)), In(Attr("JobStatus"))),
+			`A == 1 && false`,
+		},
+		{
+			"Not of an attribute",
+			Not(Attr("IsHeld")),
+			`!IsHeld`,
+		},
+		{
+			"Not of a compound expression",
+			Not(In(Attr("JobStatus"), Int(3), Int(4))),
+			`!(JobStatus == 3 || JobStatus == 4)`,
+		},
+		{
+			"Comparison of comparisons is parenthesized",
+			Eq(Eq(Attr("A"), Int(1)), Attr("B")),
+			`(A == 1) == B`,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(
+			test.description,
+			func(t *testing.T) {
+				assert.Equal(t, test.expected, test.expr.String())
+			},
+		)
+	}
+}
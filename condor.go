@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats that a job attribute referencing dropbox files can have
+const (
+	// attributeFormatCommaList is a comma-separated list of paths or URLs, like PNFS_INPUT_FILES or TransferInput
+	attributeFormatCommaList = "comma"
+	// attributeFormatClassAdList is a ClassAd list of strings, like {"/path/to/a", "/path/to/b"}
+	attributeFormatClassAdList = "classad-list"
+	// attributeFormatURL is a single path or URL
+	attributeFormatURL = "url"
+	// attributeFormatTarball is a comma-separated list of tarball paths, which may carry a jobsub dropbox:// or tardir://
+	// prefix, like Jobsub_Tarballs
+	attributeFormatTarball = "tarball"
+)
+
+var validAttributeFormats = []string{attributeFormatCommaList, attributeFormatClassAdList, attributeFormatURL, attributeFormatTarball}
+
+// JobFileAttribute is a job ClassAd attribute that can reference dropbox files, along with the format of its value
+type JobFileAttribute struct {
+	Name   string `yaml:"name"`
+	Format string `yaml:"format"`
+}
+
+// defaultJobFileAttributes are used when a CondorSchedd is not given any JobFileAttributes
+var defaultJobFileAttributes = []JobFileAttribute{{Name: "PNFS_INPUT_FILES", Format: attributeFormatCommaList}}
+
+// CondorSchedd is a JobLister for the jobs in an HTCondor schedd's queue
+type CondorSchedd struct {
+	name           string
+	pool           string
+	fileAttributes []JobFileAttribute
+}
+
+// NewCondorSchedd returns a CondorSchedd for the schedd name in pool that finds dropbox files in jobs using
+// fileAttributes.  If fileAttributes is empty, defaultJobFileAttributes is used.  If name or pool are empty, condor_q's
+// defaults are used.
+func NewCondorSchedd(name, pool string, fileAttributes []JobFileAttribute) *CondorSchedd {
+	return &CondorSchedd{name: name, pool: pool, fileAttributes: fileAttributes}
+}
+
+// queryJobsList runs condor_q for all users' jobs matching the constraint, and returns the requested attributes of each
+// job.  A nil constraint matches all jobs.
+func (c *CondorSchedd) queryJobsList(ctx context.Context, attributes []string, constraint ClassAdExpr) ([]map[string][]byte, error) {
+	args := append(c.locationArgs(), "-allusers")
+	return runCondorJobQuery(ctx, "condor_q", args, attributes, constraint)
+}
+
+func (c *CondorSchedd) locationArgs() []string {
+	args := make([]string, 0, 4)
+	if c.name != "" {
+		args = append(args, "-name", c.name)
+	}
+	if c.pool != "" {
+		args = append(args, "-pool", c.pool)
+	}
+	return args
+}
+
+// CondorScheddWithHistory is a JobLister that returns both the jobs in a schedd's queue, and the jobs that left the
+// queue within the look-back window, so that files used by recently completed jobs are protected as well
+type CondorScheddWithHistory struct {
+	*CondorSchedd
+	lookback   time.Duration
+	matchLimit int
+	now        func() time.Time
+}
+
+// NewCondorScheddWithHistory returns a CondorScheddWithHistory for schedd that also returns jobs that left its queue in
+// the last lookback period.  At most matchLimit jobs are read from the history;  0 means no limit.
+func NewCondorScheddWithHistory(schedd *CondorSchedd, lookback time.Duration, matchLimit int) *CondorScheddWithHistory {
+	return &CondorScheddWithHistory{CondorSchedd: schedd, lookback: lookback, matchLimit: matchLimit}
+}
+
+// queryJobsList returns the matching jobs from both condor_q and condor_history
+func (c *CondorScheddWithHistory) queryJobsList(ctx context.Context, attributes []string, constraint ClassAdExpr) ([]map[string][]byte, error) {
+	jobs, err := c.CondorSchedd.queryJobsList(ctx, attributes, constraint)
+	if err != nil {
+		return nil, err
+	}
+
+	since := currentTimeOrNow(c.now).Add(-c.lookback).Unix()
+	historyConstraint := Ge(Attr("EnteredCurrentStatus"), Int(since))
+	if constraint != nil {
+		historyConstraint = And(constraint, historyConstraint)
+	}
+	args := c.locationArgs()
+	if c.matchLimit > 0 {
+		args = append(args, "-match", strconv.Itoa(c.matchLimit))
+	}
+	historyJobs, err := runCondorJobQuery(ctx, "condor_history", args, attributes, historyConstraint)
+	if err != nil {
+		return nil, err
+	}
+	return append(jobs, historyJobs...), nil
+}
+
+// runCondorJobQuery runs a condor_q-like command with the given arguments, and the constraint and attributes added on,
+// and parses its JSON output into jobs.  The command is killed if ctx is cancelled.
+func runCondorJobQuery(ctx context.Context, command string, args []string, attributes []string, constraint ClassAdExpr) ([]map[string][]byte, error) {
+	if constraint != nil {
+		args = append(args, "-constraint", constraint.String())
+	}
+	args = append(args, "-json")
+	if len(attributes) != 0 {
+		args = append(args, "-attributes", strings.Join(attributes, ","))
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("%s was stopped: %w", command, ctx.Err())
+		}
+		return nil, fmt.Errorf("%s failed: %w: %s", command, err, strings.TrimSpace(stderr.String()))
+	}
+	jobs, err := parseCondorJSONJobs(stdout.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s output: %w", command, err)
+	}
+	return jobs, nil
+}
+
+// parseCondorJSONJobs turns the output of condor_q -json into jobs.  String values are unquoted, lists are rendered as
+// ClassAd lists, and other values are left as they are.
+func parseCondorJSONJobs(output []byte) ([]map[string][]byte, error) {
+	jobs := make([]map[string][]byte, 0)
+	// condor_q prints nothing at all when no jobs match
+	if len(bytes.TrimSpace(output)) == 0 {
+		return jobs, nil
+	}
+
+	var rawJobs []map[string]json.RawMessage
+	if err := json.Unmarshal(output, &rawJobs); err != nil {
+		return nil, err
+	}
+	for _, rawJob := range rawJobs {
+		job := make(map[string][]byte, len(rawJob))
+		for attr, rawValue := range rawJob {
+			job[attr] = condorJSONValueToBytes(rawValue)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+func condorJSONValueToBytes(rawValue json.RawMessage) []byte {
+	var s string
+	if err := json.Unmarshal(rawValue, &s); err == nil {
+		return []byte(s)
+	}
+	var list []json.RawMessage
+	if err := json.Unmarshal(rawValue, &list); err == nil {
+		elts := make([]string, 0, len(list))
+		for _, elt := range list {
+			elts = append(elts, string(elt))
+		}
+		return []byte("{" + strings.Join(elts, ",") + "}")
+	}
+	return []byte(rawValue)
+}
+
+func (c *CondorSchedd) jobFileAttributes() []JobFileAttribute {
+	if len(c.fileAttributes) == 0 {
+		return defaultJobFileAttributes
+	}
+	return c.fileAttributes
+}
+
+// fileAttributeNames returns the names of the job attributes that need to be queried for getDropboxFilesFromJob with
+// attrs, followed by the jobIDAttributes that aren't among them
+func fileAttributeNames(attrs []JobFileAttribute) []string {
+	names := make([]string, 0, len(attrs)+len(jobIDAttributes))
+	for _, attr := range attrs {
+		names = append(names, attr.Name)
+	}
+	for _, name := range jobIDAttributes {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// getDropboxFilesFromJob returns the union of the files referenced by each of the CondorSchedd's file attributes in the
+// job.  It is only an error if the job has none of those attributes.
+func (c *CondorSchedd) getDropboxFilesFromJob(j map[string]io.Reader) ([]string, error) {
+	var found bool
+	files := make([]string, 0)
+	for _, attr := range c.jobFileAttributes() {
+		val, ok := j[attr.Name]
+		if !ok {
+			continue
+		}
+		found = true
+
+		b := new(strings.Builder)
+		if _, err := io.Copy(b, val); err != nil {
+			return nil, err
+		}
+		attrFiles, err := parseJobFileAttributeValue(attr.Format, b.String())
+		if err != nil {
+			return nil, fmt.Errorf("could not parse job attribute %s: %w", attr.Name, err)
+		}
+		for _, f := range attrFiles {
+			if !slices.Contains(files, f) {
+				files = append(files, f)
+			}
+		}
+	}
+
+	if !found {
+		return nil, ErrMissingJobDropboxFiles
+	}
+	return files, nil
+}
+
+// parseJobFileAttributeValue splits a job attribute's value into the files it references according to format
+func parseJobFileAttributeValue(format, value string) ([]string, error) {
+	value = strings.TrimSpace(value)
+	switch format {
+	case "", attributeFormatCommaList:
+		return splitAttributeList(value), nil
+	case attributeFormatClassAdList:
+		if !strings.HasPrefix(value, "{") || !strings.HasSuffix(value, "}") {
+			return nil, fmt.Errorf("%q is not a ClassAd list", value)
+		}
+		return splitAttributeList(strings.TrimSuffix(strings.TrimPrefix(value, "{"), "}")), nil
+	case attributeFormatURL:
+		if value = strings.Trim(value, `"`); value == "" {
+			return []string{}, nil
+		}
+		return []string{value}, nil
+	case attributeFormatTarball:
+		files := splitAttributeList(value)
+		for i := range files {
+			for _, prefix := range []string{"dropbox://", "tardir://"} {
+				files[i] = strings.TrimPrefix(files[i], prefix)
+			}
+		}
+		return files, nil
+	default:
+		return nil, fmt.Errorf("unknown attribute format %q", format)
+	}
+}
+
+// splitAttributeList splits a comma-separated attribute value, trimming whitespace and quotes from each element and
+// dropping empty ones
+func splitAttributeList(value string) []string {
+	raw := strings.Split(value, ",")
+	files := make([]string, 0, len(raw))
+	for _, elt := range raw {
+		if elt = strings.Trim(strings.TrimSpace(elt), `"`); elt != "" {
+			files = append(files, elt)
+		}
+	}
+	return files
+}
+
+// HTCondor JobStatus values
+const (
+	jobStatusIdle               = 1
+	jobStatusRunning            = 2
+	jobStatusRemoved            = 3
+	jobStatusCompleted          = 4
+	jobStatusHeld               = 5
+	jobStatusTransferringOutput = 6
+	jobStatusSuspended          = 7
+)
+
+// Job statuses that a JobStatusPolicy can protect files for
+const (
+	jobStatusNameIdle      = "idle"
+	jobStatusNameRunning   = "running"
+	jobStatusNameHeld      = "held"
+	jobStatusNameSuspended = "suspended"
+)
+
+var validProtectedJobStatuses = []string{jobStatusNameIdle, jobStatusNameRunning, jobStatusNameHeld, jobStatusNameSuspended}
+
+// JobStatusPolicy decides which jobs protect their dropbox files, based on their JobStatus and, for held jobs, how long
+// they have been held and why
+type JobStatusPolicy struct {
+	// Protect lists the job statuses whose jobs protect their files:  idle, running, held, and/or suspended.  Running
+	// includes jobs that are transferring output.
+	Protect []string
+	// HeldMaxAge is how long a job can be held and still protect its files.  0 means held jobs protect their files forever.
+	HeldMaxAge time.Duration
+	// IgnoreHoldReasonCodes are HoldReasonCodes for which held jobs never protect their files
+	IgnoreHoldReasonCodes []int
+}
+
+// defaultJobStatusPolicy protects the files of every job that could still run
+var defaultJobStatusPolicy = JobStatusPolicy{Protect: validProtectedJobStatuses}
+
+// constraint renders the policy as a ClassAd expression to pass to queryJobsList.  Removed and completed jobs always
+// match, so that jobs found in condor_history by CondorScheddWithHistory protect their files for its look-back window.
+func (p JobStatusPolicy) constraint(now time.Time) ClassAdExpr {
+	jobStatus := Attr("JobStatus")
+	statusIs := func(status int64) ClassAdExpr { return Eq(jobStatus, Int(status)) }
+
+	clauses := make([]ClassAdExpr, 0, 7)
+	if slices.Contains(p.Protect, jobStatusNameIdle) {
+		clauses = append(clauses, statusIs(jobStatusIdle))
+	}
+	if slices.Contains(p.Protect, jobStatusNameRunning) {
+		clauses = append(clauses, statusIs(jobStatusRunning), statusIs(jobStatusTransferringOutput))
+	}
+	if slices.Contains(p.Protect, jobStatusNameHeld) {
+		held := []ClassAdExpr{statusIs(jobStatusHeld)}
+		if p.HeldMaxAge > 0 {
+			held = append(held, Ge(Attr("EnteredCurrentStatus"), Int(now.Add(-p.HeldMaxAge).Unix())))
+		}
+		for _, code := range p.IgnoreHoldReasonCodes {
+			held = append(held, Isnt(Attr("HoldReasonCode"), Int(int64(code))))
+		}
+		clauses = append(clauses, And(held...))
+	}
+	if slices.Contains(p.Protect, jobStatusNameSuspended) {
+		clauses = append(clauses, statusIs(jobStatusSuspended))
+	}
+	clauses = append(clauses, statusIs(jobStatusRemoved), statusIs(jobStatusCompleted))
+	return Or(clauses...)
+}
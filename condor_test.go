@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseJobFileAttributeValue(t *testing.T) {
+	type testCase struct {
+		description   string
+		format        string
+		value         string
+		expectedFiles []string
+		shouldError   bool
+	}
+
+	testCases := []testCase{
+		{
+			"Comma list",
+			attributeFormatCommaList,
+			"/path/to/a, /path/to/b,,",
+			[]string{"/path/to/a", "/path/to/b"},
+			false,
+		},
+		{
+			"Empty format means comma list",
+			"",
+			`"/path/to/a,/path/to/b"`,
+			[]string{"/path/to/a", "/path/to/b"},
+			false,
+		},
+		{
+			"ClassAd list",
+			attributeFormatClassAdList,
+			`{ "/path/to/a", "/path/to/b" }`,
+			[]string{"/path/to/a", "/path/to/b"},
+			false,
+		},
+		{
+			"Empty ClassAd list",
+			attributeFormatClassAdList,
+			`{}`,
+			[]string{},
+			false,
+		},
+		{
+			"Not a ClassAd list",
+			attributeFormatClassAdList,
+			`"/path/to/a"`,
+			nil,
+			true,
+		},
+		{
+			"URL",
+			attributeFormatURL,
+			`"https://fndcadoor.fnal.gov:2880/GM2/resilient/jobsub_stage/abc/file.tar"`,
+			[]string{"https://fndcadoor.fnal.gov:2880/GM2/resilient/jobsub_stage/abc/file.tar"},
+			false,
+		},
+		{
+			"Empty URL",
+			attributeFormatURL,
+			`""`,
+			[]string{},
+			false,
+		},
+		{
+			"Tarballs with jobsub prefixes",
+			attributeFormatTarball,
+			"dropbox:///pnfs/gm2/resilient/jobsub_stage/abc/code.tar, tardir:///pnfs/gm2/resilient/jobsub_stage/def/dir.tar,/plain/path.tar",
+			[]string{"/pnfs/gm2/resilient/jobsub_stage/abc/code.tar", "/pnfs/gm2/resilient/jobsub_stage/def/dir.tar", "/plain/path.tar"},
+			false,
+		},
+		{
+			"Unknown format",
+			"xml",
+			"<files/>",
+			nil,
+			true,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(
+			test.description,
+			func(t *testing.T) {
+				files, err := parseJobFileAttributeValue(test.format, test.value)
+				if test.shouldError {
+					assert.Error(t, err)
+				} else {
+					assert.NoError(t, err)
+				}
+				assert.Equal(t, test.expectedFiles, files)
+			},
+		)
+	}
+}
+
+func TestCondorScheddGetDropboxFilesFromJobAttributes(t *testing.T) {
+	type testCase struct {
+		description   string
+		job           map[string]string
+		expectedFiles []string
+		expectedErr   error
+	}
+
+	schedd := NewCondorSchedd("", "", []JobFileAttribute{
+		{"PNFS_INPUT_FILES", attributeFormatCommaList},
+		{"TransferInput", attributeFormatCommaList},
+		{"Jobsub_Tarballs", attributeFormatTarball},
+		{"MY_DROPBOX_LIST", attributeFormatClassAdList},
+	})
+
+	testCases := []testCase{
+		{
+			"Union of all attributes, duplicates removed",
+			map[string]string{
+				"PNFS_INPUT_FILES": "/dropbox/a/file1,/dropbox/b/file2",
+				"TransferInput":    "/dropbox/b/file2,/dropbox/c/file3",
+				"Jobsub_Tarballs":  "dropbox:///dropbox/d/code.tar",
+				"MY_DROPBOX_LIST":  `{"/dropbox/e/file4"}`,
+			},
+			[]string{"/dropbox/a/file1", "/dropbox/b/file2", "/dropbox/c/file3", "/dropbox/d/code.tar", "/dropbox/e/file4"},
+			nil,
+		},
+		{
+			"Only some attributes present",
+			map[string]string{"Jobsub_Tarballs": "dropbox:///dropbox/d/code.tar"},
+			[]string{"/dropbox/d/code.tar"},
+			nil,
+		},
+		{
+			"No attributes present",
+			map[string]string{"Owner": "user1"},
+			nil,
+			ErrMissingJobDropboxFiles,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(
+			test.description,
+			func(t *testing.T) {
+				job := make(map[string]io.Reader, len(test.job))
+				for k, v := range test.job {
+					job[k] = strings.NewReader(v)
+				}
+				files, err := schedd.getDropboxFilesFromJob(job)
+				assert.ErrorIs(t, err, test.expectedErr)
+				assert.Equal(t, test.expectedFiles, files)
+			},
+		)
+	}
+
+	assert.Equal(
+		t,
+		[]string{"PNFS_INPUT_FILES", "TransferInput", "Jobsub_Tarballs", "MY_DROPBOX_LIST", "ClusterId", "ProcId"},
+		fileAttributeNames(schedd.jobFileAttributes()),
+	)
+	assert.Equal(t, []string{"PNFS_INPUT_FILES", "ClusterId", "ProcId"}, fileAttributeNames(new(CondorSchedd).jobFileAttributes()))
+	assert.Equal(t, []string{"ProcId", "ClusterId"}, fileAttributeNames([]JobFileAttribute{{Name: "ProcId"}, {Name: "ClusterId"}}))
+}
+
+func TestParseCondorJSONJobs(t *testing.T) {
+	type testCase struct {
+		description  string
+		output       string
+		expectedJobs []map[string][]byte
+		shouldError  bool
+	}
+
+	testCases := []testCase{
+		{
+			"No output means no jobs",
+			"\n",
+			[]map[string][]byte{},
+			false,
+		},
+		{
+			"Strings, numbers, and lists",
+			`[
+{"PNFS_INPUT_FILES": "/dropbox/a/file1,/dropbox/b/file2", "JobStatus": 2, "MY_LIST": ["/dropbox/c", "/dropbox/d"]},
+{"PNFS_INPUT_FILES": "/dropbox/e/file3"}
+]`,
+			[]map[string][]byte{
+				{"PNFS_INPUT_FILES": []byte("/dropbox/a/file1,/dropbox/b/file2"), "JobStatus": []byte("2"), "MY_LIST": []byte(`{"/dropbox/c","/dropbox/d"}`)},
+				{"PNFS_INPUT_FILES": []byte("/dropbox/e/file3")},
+			},
+			false,
+		},
+		{
+			"Garbage",
+			"-- Failed to fetch ads from: <127.0.0.1:9618>",
+			nil,
+			true,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(
+			test.description,
+			func(t *testing.T) {
+				jobs, err := parseCondorJSONJobs([]byte(test.output))
+				if test.shouldError {
+					assert.Error(t, err)
+				} else {
+					assert.NoError(t, err)
+				}
+				assert.Equal(t, test.expectedJobs, jobs)
+			},
+		)
+	}
+}
+
+// installFakeCondorCommand installs a fake condor command that logs its arguments and prints output.  The returned
+// function reads the logged arguments, one invocation per element.
+func installFakeCondorCommand(t *testing.T, name, output string, exitCode int) func() []string {
+	t.Helper()
+	argsLog := filepath.Join(t.TempDir(), name+".log")
+	outputFile := filepath.Join(t.TempDir(), name+".out")
+	os.WriteFile(outputFile, []byte(output), 0o644)
+	installFakeCommand(t, name, fmt.Sprintf("echo \"$@\" >> %s\ncat %s\nexit %d\n", argsLog, outputFile, exitCode))
+	return func() []string {
+		b, err := os.ReadFile(argsLog)
+		if err != nil {
+			return nil
+		}
+		return strings.Split(strings.TrimSpace(string(b)), "\n")
+	}
+}
+
+func TestCondorScheddQueryJobsList(t *testing.T) {
+	condorQ := installFakeCondorCommand(t, "condor_q", `[{"PNFS_INPUT_FILES": "/dropbox/a/file1"}]`, 0)
+	schedd := NewCondorSchedd("jobsub01.fnal.gov", "gpcollector03.fnal.gov", nil)
+
+	jobs, err := schedd.queryJobsList(
+		context.Background(),
+		[]string{"PNFS_INPUT_FILES", "JobStatus"},
+		And(Eq(Attr("Jobsub_Group"), Str("gm2")), Eq(Attr("JobStatus"), Int(2))),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, []map[string][]byte{{"PNFS_INPUT_FILES": []byte("/dropbox/a/file1")}}, jobs)
+	assert.Equal(
+		t,
+		[]string{`-name jobsub01.fnal.gov -pool gpcollector03.fnal.gov -allusers -constraint Jobsub_Group == "gm2" && JobStatus == 2 -json -attributes PNFS_INPUT_FILES,JobStatus`},
+		condorQ(),
+	)
+}
+
+func TestCondorScheddWithHistoryQueryJobsList(t *testing.T) {
+	type testCase struct {
+		description     string
+		condorQExitCode int
+		historyExitCode int
+		matchLimit      int
+		expectedJobs    []map[string][]byte
+		expectedHistory []string
+		shouldError     bool
+	}
+
+	now := time.Unix(1700000000, 0)
+
+	testCases := []testCase{
+		{
+			"Queue and history jobs are both returned",
+			0,
+			0,
+			100,
+			[]map[string][]byte{
+				{"PNFS_INPUT_FILES": []byte("/dropbox/queued/file")},
+				{"PNFS_INPUT_FILES": []byte("/dropbox/completed/file")},
+			},
+			[]string{`-name jobsub01.fnal.gov -match 100 -constraint Jobsub_Group == "gm2" && EnteredCurrentStatus >= 1699996400 -json -attributes PNFS_INPUT_FILES`},
+			false,
+		},
+		{
+			"No match limit",
+			0,
+			0,
+			0,
+			[]map[string][]byte{
+				{"PNFS_INPUT_FILES": []byte("/dropbox/queued/file")},
+				{"PNFS_INPUT_FILES": []byte("/dropbox/completed/file")},
+			},
+			[]string{`-name jobsub01.fnal.gov -constraint Jobsub_Group == "gm2" && EnteredCurrentStatus >= 1699996400 -json -attributes PNFS_INPUT_FILES`},
+			false,
+		},
+		{
+			"condor_q fails",
+			1,
+			0,
+			100,
+			nil,
+			nil,
+			true,
+		},
+		{
+			"condor_history fails",
+			0,
+			1,
+			100,
+			nil,
+			[]string{`-name jobsub01.fnal.gov -match 100 -constraint Jobsub_Group == "gm2" && EnteredCurrentStatus >= 1699996400 -json -attributes PNFS_INPUT_FILES`},
+			true,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(
+			test.description,
+			func(t *testing.T) {
+				installFakeCondorCommand(t, "condor_q", `[{"PNFS_INPUT_FILES": "/dropbox/queued/file"}]`, test.condorQExitCode)
+				history := installFakeCondorCommand(t, "condor_history", `[{"PNFS_INPUT_FILES": "/dropbox/completed/file"}]`, test.historyExitCode)
+
+				schedd := NewCondorScheddWithHistory(NewCondorSchedd("jobsub01.fnal.gov", "", nil), time.Hour, test.matchLimit)
+				schedd.now = func() time.Time { return now }
+				jobs, err := schedd.queryJobsList(context.Background(), []string{"PNFS_INPUT_FILES"}, Eq(Attr("Jobsub_Group"), Str("gm2")))
+				if test.shouldError {
+					assert.Error(t, err)
+				} else {
+					assert.NoError(t, err)
+				}
+				assert.Equal(t, test.expectedJobs, jobs)
+				assert.Equal(t, test.expectedHistory, history())
+			},
+		)
+	}
+}
+
+func TestGetActiveFilesWithHistory(t *testing.T) {
+	installFakeCondorCommand(t, "condor_q", `[{"PNFS_INPUT_FILES": "/dropbox/a/file1"}]`, 0)
+	installFakeCondorCommand(t, "condor_history", `[{"PNFS_INPUT_FILES": "/dropbox/b/file2,/dropbox/a/file1"}]`, 0)
+
+	schedd := NewCondorScheddWithHistory(NewCondorSchedd("jobsub01.fnal.gov", "", nil), time.Hour, 0)
+	files, err := GetActiveFiles(context.Background(), schedd, fileAttributeNames(defaultJobFileAttributes), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/dropbox/a/file1", "/dropbox/b/file2", "/dropbox/a/file1"}, files)
+}
+
+func TestJobStatusPolicyConstraint(t *testing.T) {
+	type testCase struct {
+		description        string
+		policy             JobStatusPolicy
+		expectedConstraint string
+	}
+
+	now := time.Unix(1700000000, 0)
+
+	testCases := []testCase{
+		{
+			"Default policy",
+			defaultJobStatusPolicy,
+			"JobStatus == 1 || JobStatus == 2 || JobStatus == 6 || JobStatus == 5 || JobStatus == 7 || JobStatus == 3 || JobStatus == 4",
+		},
+		{
+			"Held jobs stop protecting files after a while",
+			JobStatusPolicy{Protect: []string{"running", "held"}, HeldMaxAge: 24 * time.Hour},
+			"JobStatus == 2 || JobStatus == 6 || (JobStatus == 5 && EnteredCurrentStatus >= 1699913600) || JobStatus == 3 || JobStatus == 4",
+		},
+		{
+			"Held jobs with some hold reasons never protect files",
+			JobStatusPolicy{Protect: []string{"idle", "held"}, IgnoreHoldReasonCodes: []int{1, 13}},
+			"JobStatus == 1 || (JobStatus == 5 && HoldReasonCode =!= 1 && HoldReasonCode =!= 13) || JobStatus == 3 || JobStatus == 4",
+		},
+		{
+			"Held jobs not protected at all",
+			JobStatusPolicy{Protect: []string{"idle", "running"}, HeldMaxAge: 24 * time.Hour},
+			"JobStatus == 1 || JobStatus == 2 || JobStatus == 6 || JobStatus == 3 || JobStatus == 4",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(
+			test.description,
+			func(t *testing.T) {
+				assert.Equal(t, test.expectedConstraint, test.policy.constraint(now).String())
+			},
+		)
+	}
+}
@@ -0,0 +1,815 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration file for a cleanup run.  It describes each experiment whose dropbox should be cleaned up.
+//
+// Example:
+//
+//	experiments:
+//	  - name: gm2
+//	    dropbox: https://fndcadoor.fnal.gov:2880/GM2/resilient/jobsub_stage
+//	    pool: gpcollector03.fnal.gov
+//	    schedds:
+//	      - jobsubdevsch01.fnal.gov
+//	    job_attributes:
+//	      - name: PNFS_INPUT_FILES
+//	        format: comma
+//	      - name: Jobsub_Tarballs
+//	        format: tarball
+//	    token:
+//	      source: htgettoken
+//	      vault_server: htvaultprod.fnal.gov
+//	      issuer: fermilab
+//	      role: production
+//	      scope_path: /resilient/jobsub_stage
+//	    retention:
+//	      recent: 30d
+//	    deletion:
+//	      workers: 8
+//	    rules:
+//	      protect:
+//	        - name: shared tarballs
+//	          glob: "shared_*"
+//	      include:
+//	        - regex: "^shared_tmp_"
+//	rate_limits:
+//	  - host: fndcadoor.fnal.gov
+//	    rate: 20
+//	    latency_threshold: 10s
+type Config struct {
+	Experiments []ExperimentConfig `yaml:"experiments"`
+	// RateLimits limit how fast requests are sent to each dCache door.  Doors that aren't listed are not limited.
+	RateLimits []RateLimitConfig `yaml:"rate_limits"`
+}
+
+// RateLimitConfig is the rate limit for one dCache door host.  See RateLimitOptions.
+type RateLimitConfig struct {
+	Host             string   `yaml:"host"`
+	Rate             float64  `yaml:"rate"`
+	Burst            int      `yaml:"burst"`
+	LatencyThreshold Duration `yaml:"latency_threshold"`
+	MaxSlowdown      float64  `yaml:"max_slowdown"`
+}
+
+// Options returns the RateLimitOptions that the RateLimitConfig describes
+func (r RateLimitConfig) Options() RateLimitOptions {
+	return RateLimitOptions{
+		Rate:             r.Rate,
+		Burst:            r.Burst,
+		LatencyThreshold: time.Duration(r.LatencyThreshold),
+		MaxSlowdown:      r.MaxSlowdown,
+	}
+}
+
+// ExperimentConfig describes one experiment's dropbox, where its jobs run, and how to clean up after them
+type ExperimentConfig struct {
+	Name    string `yaml:"name"`
+	Dropbox string `yaml:"dropbox"`
+	// JobsubGroup is the Jobsub_Group job attribute value for this experiment's jobs.  Defaults to Name.
+	JobsubGroup string   `yaml:"jobsub_group"`
+	Pool        string   `yaml:"pool"`
+	Schedds     []string `yaml:"schedds"`
+	// JobAttributes are the job attributes that reference dropbox files.  Defaults to PNFS_INPUT_FILES.
+	JobAttributes []JobFileAttribute `yaml:"job_attributes"`
+	History       HistoryConfig      `yaml:"history"`
+	ScheddQuery   ScheddQueryConfig  `yaml:"schedd_query"`
+	JobStatus     JobStatusConfig    `yaml:"job_status"`
+	Token         TokenConfig        `yaml:"token"`
+	Retention     RetentionConfig    `yaml:"retention"`
+	Deletion      DeletionConfig     `yaml:"deletion"`
+	Safety        SafetyConfig       `yaml:"safety"`
+	Preflight     PreflightConfig    `yaml:"preflight"`
+	Quarantine    QuarantineConfig   `yaml:"quarantine"`
+	Rules         RulesConfig        `yaml:"rules"`
+}
+
+// HistoryConfig describes how far back to look in condor_history for recently completed jobs whose files should still be
+// protected
+type HistoryConfig struct {
+	// Lookback is how long after leaving the queue a job still protects its files.  Defaults to defaultHistoryLookback.
+	// 0 disables the condor_history query.
+	Lookback *Duration `yaml:"lookback"`
+	// MatchLimit is the most jobs to read from condor_history per schedd.  Defaults to defaultHistoryMatchLimit.  0 means
+	// no limit.
+	MatchLimit *int `yaml:"match_limit"`
+}
+
+// TokenConfig describes where an experiment's bearer token comes from
+type TokenConfig struct {
+	// Source is one of "wlcg" (the default), "file", or "htgettoken".  The wlcg token is the same for every experiment,
+	// so at most one experiment may use it, and no two experiments may use the same file.
+	Source      string `yaml:"source"`
+	Path        string `yaml:"path"`
+	VaultServer string `yaml:"vault_server"`
+	Issuer      string `yaml:"issuer"`
+	Role        string `yaml:"role"`
+	// OutFile is where htgettoken writes the token.  It must not be shared with another experiment.  Defaults to a file
+	// in the temporary directory named for the experiment.
+	OutFile string `yaml:"out_file"`
+	// ScopePath is the dropbox path as the token issuer sees it.  It is used to check that the token can delete files.
+	ScopePath string `yaml:"scope_path"`
+}
+
+// RetentionConfig describes what in an experiment's dropbox is kept
+type RetentionConfig struct {
+	// Recent is how old a dropbox entry must be before it is considered for deletion.  Defaults to 30 days.
+	Recent Duration `yaml:"recent"`
+	// MaxParseFailures is how many dropbox listing lines may fail to parse before the run is aborted.  -1 means no limit.
+	MaxParseFailures *int `yaml:"max_parse_failures"`
+}
+
+// ScheddQueryConfig controls how the experiment's schedds are queried.  See ScheddQueryOptions.
+type ScheddQueryConfig struct {
+	Concurrency int      `yaml:"concurrency"`
+	Timeout     Duration `yaml:"timeout"`
+}
+
+// Options returns the ScheddQueryOptions that the ScheddQueryConfig describes
+func (s ScheddQueryConfig) Options() ScheddQueryOptions {
+	return ScheddQueryOptions{Concurrency: s.Concurrency, Timeout: time.Duration(s.Timeout)}
+}
+
+// DeletionConfig controls how the experiment's dropbox entries are deleted.  See DeletionOptions.
+type DeletionConfig struct {
+	Workers        int      `yaml:"workers"`
+	MaxAttempts    int      `yaml:"max_attempts"`
+	InitialBackoff Duration `yaml:"initial_backoff"`
+	MaxBackoff     Duration `yaml:"max_backoff"`
+}
+
+// Options returns the DeletionOptions that the DeletionConfig describes
+func (d DeletionConfig) Options() DeletionOptions {
+	return DeletionOptions{
+		Workers:        d.Workers,
+		MaxAttempts:    d.MaxAttempts,
+		InitialBackoff: time.Duration(d.InitialBackoff),
+		MaxBackoff:     time.Duration(d.MaxBackoff),
+	}
+}
+
+// SafetyConfig limits how much of the experiment's dropbox a run may delete.  See SafetyLimits.
+type SafetyConfig struct {
+	// MinCount defaults to defaultSafetyMinCount
+	MinCount *int `yaml:"min_count"`
+	// MaxFraction defaults to defaultSafetyMaxFraction
+	MaxFraction float64 `yaml:"max_fraction"`
+	MaxCount    int     `yaml:"max_count"`
+	// MaxIncrease defaults to defaultSafetyMaxIncrease.  0 disables the comparison with the previous run.
+	MaxIncrease *float64 `yaml:"max_increase"`
+}
+
+// Limits returns the SafetyLimits that the SafetyConfig describes
+func (s SafetyConfig) Limits() SafetyLimits {
+	limits := SafetyLimits{MaxFraction: s.MaxFraction, MaxCount: s.MaxCount}
+	if s.MinCount != nil {
+		limits.MinCount = *s.MinCount
+	}
+	if s.MaxIncrease != nil {
+		limits.MaxIncrease = *s.MaxIncrease
+	}
+	return limits
+}
+
+// QuarantineConfig controls whether the experiment's candidates are moved into a quarantine area within the dropbox
+// instead of being deleted, and how long they stay there before they are purged
+type QuarantineConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Dir is the name of the quarantine area within the dropbox.  Defaults to defaultQuarantineDir.
+	Dir string `yaml:"dir"`
+	// PurgeAfter is how long entries stay quarantined before purging deletes them.  Defaults to
+	// defaultQuarantinePurgeAfter.
+	PurgeAfter Duration `yaml:"purge_after"`
+}
+
+// RulesConfig lists the patterns that decide which dropbox entries are considered for deletion at all.  Entries that
+// match a protect rule are always kept.  Entries that match an include rule are always considered, by the usual age and
+// in-use checks, even if they also match a protect rule.
+type RulesConfig struct {
+	Protect []PathRuleConfig `yaml:"protect"`
+	Include []PathRuleConfig `yaml:"include"`
+}
+
+// PathRuleConfig describes a PathRule.  Exactly one of Glob and Regex must be given.
+type PathRuleConfig struct {
+	// Name identifies the rule in plans and reports.  Defaults to the pattern.
+	Name  string `yaml:"name"`
+	Glob  string `yaml:"glob"`
+	Regex string `yaml:"regex"`
+}
+
+// Rule returns the PathRule that the PathRuleConfig describes
+func (p PathRuleConfig) Rule() (*PathRule, error) {
+	switch {
+	case (p.Glob == "") == (p.Regex == ""):
+		return nil, ErrAmbiguousPathRule
+	case p.Glob != "":
+		return NewGlobRule(p.Name, p.Glob)
+	default:
+		return NewRegexRule(p.Name, p.Regex)
+	}
+}
+
+// PathRules returns the protect and include PathRules that the RulesConfig describes
+func (r RulesConfig) PathRules() (protect, include []*PathRule, err error) {
+	for _, c := range r.Protect {
+		rule, err := c.Rule()
+		if err != nil {
+			return nil, nil, err
+		}
+		protect = append(protect, rule)
+	}
+	for _, c := range r.Include {
+		rule, err := c.Rule()
+		if err != nil {
+			return nil, nil, err
+		}
+		include = append(include, rule)
+	}
+	return protect, include, nil
+}
+
+// PreflightConfig controls how an empty result from the schedd queries is checked.  See checkEmptyJobQuery.
+type PreflightConfig struct {
+	// AccountingGroup is the experiment's accounting group in the collector's submitter ads.  Defaults to "group_"
+	// followed by the JobsubGroup.
+	AccountingGroup string `yaml:"accounting_group"`
+	// CheckCollector defaults to true
+	CheckCollector *bool `yaml:"check_collector"`
+	// RecentWindow defaults to defaultPreflightRecentWindow.  0 disables the check for recent dropbox entries.
+	RecentWindow *Duration `yaml:"recent_window"`
+}
+
+func (p PreflightConfig) recentWindow() time.Duration {
+	if p.RecentWindow == nil {
+		return defaultPreflightRecentWindow
+	}
+	return time.Duration(*p.RecentWindow)
+}
+
+// JobStatusConfig describes which jobs protect their dropbox files.  See JobStatusPolicy.
+type JobStatusConfig struct {
+	// Protect defaults to all of idle, running, held, and suspended
+	Protect               []string `yaml:"protect"`
+	HeldMaxAge            Duration `yaml:"held_max_age"`
+	IgnoreHoldReasonCodes []int    `yaml:"ignore_hold_reason_codes"`
+}
+
+// Policy returns the JobStatusPolicy that the JobStatusConfig describes
+func (j JobStatusConfig) Policy() JobStatusPolicy {
+	return JobStatusPolicy{
+		Protect:               j.Protect,
+		HeldMaxAge:            time.Duration(j.HeldMaxAge),
+		IgnoreHoldReasonCodes: j.IgnoreHoldReasonCodes,
+	}
+}
+
+const (
+	defaultHistoryLookback   = 24 * time.Hour
+	defaultHistoryMatchLimit = 10000
+)
+
+const (
+	tokenSourceWLCG       = "wlcg"
+	tokenSourceFile       = "file"
+	tokenSourceHTGetToken = "htgettoken"
+)
+
+var validTokenSources = []string{tokenSourceWLCG, tokenSourceFile, tokenSourceHTGetToken}
+
+// Duration is a time.Duration that can be given in the config file either in time.ParseDuration format, or as a whole
+// number of days like "30d"
+type Duration time.Duration
+
+var daysRegex = regexp.MustCompile(`^(\d+)d$`)
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	if err := value.Decode(&s); err != nil {
+		return err
+	}
+	parsed, err := parseDuration(s)
+	if err != nil {
+		// Returning a *yaml.TypeError lets the decoder carry on and report other problems too
+		return &yaml.TypeError{Errors: []string{fmt.Sprintf("line %d: %s", value.Line, err)}}
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	if parts := daysRegex.FindStringSubmatch(s); parts != nil {
+		days, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q: use a Go duration like \"36h\" or a number of days like \"30d\"", s)
+	}
+	return d, nil
+}
+
+// ConfigProblem is a single problem found in the config file
+type ConfigProblem struct {
+	Line    int
+	Message string
+}
+
+func (p ConfigProblem) String() string {
+	if p.Line == 0 {
+		return p.Message
+	}
+	return fmt.Sprintf("line %d: %s", p.Line, p.Message)
+}
+
+// ConfigError holds every problem found in a config file
+type ConfigError struct {
+	Problems []ConfigProblem
+}
+
+func (c *ConfigError) Error() string {
+	messages := make([]string, 0, len(c.Problems))
+	for _, p := range c.Problems {
+		messages = append(messages, p.String())
+	}
+	return "invalid config:\n" + strings.Join(messages, "\n")
+}
+
+var yamlLineRegex = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// LoadConfig reads, validates, and fills in defaults for the config file at path
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(data)
+}
+
+// ParseConfig parses and validates a config file.  Unknown keys are errors.  If there are any problems, the returned
+// error is a *ConfigError that lists all of them, along with the line they are on.
+func ParseConfig(data []byte) (*Config, error) {
+	problems := make([]ConfigProblem, 0)
+
+	cfg := new(Config)
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil {
+		var typeErr *yaml.TypeError
+		switch {
+		case errors.Is(err, io.EOF):
+			// Empty file.  Validation will complain that there are no experiments.
+		case errors.As(err, &typeErr):
+			for _, msg := range typeErr.Errors {
+				problems = append(problems, yamlMessageToProblem(msg))
+			}
+		default:
+			// Syntax errors mean we can't look any further
+			return nil, &ConfigError{Problems: []ConfigProblem{yamlMessageToProblem(strings.TrimPrefix(err.Error(), "yaml: "))}}
+		}
+	}
+
+	var root yaml.Node
+	yaml.Unmarshal(data, &root)
+	problems = append(problems, cfg.validate(func(path ...any) int { return nodeLine(&root, path...) })...)
+	if len(problems) != 0 {
+		slices.SortStableFunc(problems, func(a, b ConfigProblem) int { return a.Line - b.Line })
+		return nil, &ConfigError{Problems: problems}
+	}
+
+	cfg.setDefaults()
+	return cfg, nil
+}
+
+func yamlMessageToProblem(msg string) ConfigProblem {
+	if parts := yamlLineRegex.FindStringSubmatch(msg); parts != nil {
+		line, _ := strconv.Atoi(parts[1])
+		return ConfigProblem{Line: line, Message: parts[2]}
+	}
+	return ConfigProblem{Message: msg}
+}
+
+// validate checks the semantics of the config.  lineOf gives the line number of the config element at the given path of
+// mapping keys and sequence indices, so that problems can be reported with their location.
+func (c *Config) validate(lineOf func(path ...any) int) []ConfigProblem {
+	problems := make([]ConfigProblem, 0)
+	addProblem := func(msg string, path ...any) {
+		problems = append(problems, ConfigProblem{Line: lineOf(path...), Message: msg})
+	}
+
+	if len(c.Experiments) == 0 {
+		addProblem("no experiments are configured", "experiments")
+	}
+
+	seen := make(map[string]int)
+	// Experiments must not share a token, or one VO's token would be used on another's dropbox
+	var wlcgExperiment string
+	seenTokenFiles := make(map[string]string)
+	for i, e := range c.Experiments {
+		if e.Name == "" {
+			addProblem(fmt.Sprintf("experiment %d has no name", i+1), "experiments", i)
+		} else if first, ok := seen[e.Name]; ok {
+			addProblem(fmt.Sprintf("experiment %s is configured more than once (first on line %d)", e.Name, first), "experiments", i, "name")
+		} else {
+			seen[e.Name] = lineOf("experiments", i, "name")
+		}
+
+		if e.Dropbox == "" {
+			addProblem(fmt.Sprintf("experiment %s has no dropbox", e.Name), "experiments", i)
+		} else if u, err := url.Parse(e.Dropbox); err != nil || (u.Scheme == "" && !strings.HasPrefix(u.Path, "/")) {
+			addProblem(fmt.Sprintf("experiment %s dropbox %q must be a URL or an absolute path", e.Name, e.Dropbox), "experiments", i, "dropbox")
+		}
+
+		if len(e.Schedds) == 0 {
+			addProblem(fmt.Sprintf("experiment %s has no schedds", e.Name), "experiments", i)
+		}
+		for j, schedd := range e.Schedds {
+			if strings.TrimSpace(schedd) == "" {
+				addProblem(fmt.Sprintf("experiment %s has an empty schedd name", e.Name), "experiments", i, "schedds", j)
+			}
+		}
+
+		for j, attr := range e.JobAttributes {
+			if attr.Name == "" {
+				addProblem(fmt.Sprintf("experiment %s job attribute %d has no name", e.Name, j+1), "experiments", i, "job_attributes", j)
+			}
+			if attr.Format != "" && !slices.Contains(validAttributeFormats, attr.Format) {
+				addProblem(fmt.Sprintf("experiment %s job attribute %s format %q is not one of %s", e.Name, attr.Name, attr.Format, strings.Join(validAttributeFormats, ", ")), "experiments", i, "job_attributes", j, "format")
+			}
+		}
+
+		if e.History.Lookback != nil && *e.History.Lookback < 0 {
+			addProblem(fmt.Sprintf("experiment %s history lookback must not be negative", e.Name), "experiments", i, "history", "lookback")
+		}
+		if e.History.MatchLimit != nil && *e.History.MatchLimit < 0 {
+			addProblem(fmt.Sprintf("experiment %s history match_limit must not be negative", e.Name), "experiments", i, "history", "match_limit")
+		}
+
+		if e.ScheddQuery.Concurrency < 0 {
+			addProblem(fmt.Sprintf("experiment %s schedd_query concurrency must not be negative", e.Name), "experiments", i, "schedd_query", "concurrency")
+		}
+		if e.ScheddQuery.Timeout < 0 {
+			addProblem(fmt.Sprintf("experiment %s schedd_query timeout must not be negative", e.Name), "experiments", i, "schedd_query", "timeout")
+		}
+
+		if e.Deletion.Workers < 0 {
+			addProblem(fmt.Sprintf("experiment %s deletion workers must not be negative", e.Name), "experiments", i, "deletion", "workers")
+		}
+		if e.Deletion.MaxAttempts < 0 {
+			addProblem(fmt.Sprintf("experiment %s deletion max_attempts must not be negative", e.Name), "experiments", i, "deletion", "max_attempts")
+		}
+		if e.Deletion.InitialBackoff < 0 {
+			addProblem(fmt.Sprintf("experiment %s deletion initial_backoff must not be negative", e.Name), "experiments", i, "deletion", "initial_backoff")
+		}
+		if e.Deletion.MaxBackoff < 0 {
+			addProblem(fmt.Sprintf("experiment %s deletion max_backoff must not be negative", e.Name), "experiments", i, "deletion", "max_backoff")
+		}
+
+		if e.Safety.MinCount != nil && *e.Safety.MinCount < 0 {
+			addProblem(fmt.Sprintf("experiment %s safety min_count must not be negative", e.Name), "experiments", i, "safety", "min_count")
+		}
+		if e.Safety.MaxFraction < 0 || e.Safety.MaxFraction > 1 {
+			addProblem(fmt.Sprintf("experiment %s safety max_fraction must be between 0 and 1", e.Name), "experiments", i, "safety", "max_fraction")
+		}
+		if e.Safety.MaxCount < 0 {
+			addProblem(fmt.Sprintf("experiment %s safety max_count must not be negative", e.Name), "experiments", i, "safety", "max_count")
+		}
+		if e.Safety.MaxIncrease != nil && *e.Safety.MaxIncrease != 0 && *e.Safety.MaxIncrease < 1 {
+			addProblem(fmt.Sprintf("experiment %s safety max_increase must be 0 (disabled) or at least 1", e.Name), "experiments", i, "safety", "max_increase")
+		}
+
+		if e.Preflight.RecentWindow != nil && *e.Preflight.RecentWindow < 0 {
+			addProblem(fmt.Sprintf("experiment %s preflight recent_window must not be negative", e.Name), "experiments", i, "preflight", "recent_window")
+		}
+
+		if e.Quarantine.Dir != "" && !isPlainEntryName(e.Quarantine.Dir) {
+			addProblem(fmt.Sprintf("experiment %s quarantine dir %q must be the name of a directory within the dropbox", e.Name, e.Quarantine.Dir), "experiments", i, "quarantine", "dir")
+		}
+		if e.Quarantine.PurgeAfter < 0 {
+			addProblem(fmt.Sprintf("experiment %s quarantine purge_after must not be negative", e.Name), "experiments", i, "quarantine", "purge_after")
+		}
+
+		for j, r := range e.Rules.Protect {
+			if _, err := r.Rule(); err != nil {
+				addProblem(fmt.Sprintf("experiment %s protect rule %d: %s", e.Name, j+1, err), "experiments", i, "rules", "protect", j)
+			}
+		}
+		for j, r := range e.Rules.Include {
+			if _, err := r.Rule(); err != nil {
+				addProblem(fmt.Sprintf("experiment %s include rule %d: %s", e.Name, j+1, err), "experiments", i, "rules", "include", j)
+			}
+		}
+
+		if e.JobStatus.Protect != nil && len(e.JobStatus.Protect) == 0 {
+			addProblem(fmt.Sprintf("experiment %s job_status protect must list at least one status", e.Name), "experiments", i, "job_status", "protect")
+		}
+		for j, status := range e.JobStatus.Protect {
+			if !slices.Contains(validProtectedJobStatuses, status) {
+				addProblem(fmt.Sprintf("experiment %s job_status protect %q is not one of %s", e.Name, status, strings.Join(validProtectedJobStatuses, ", ")), "experiments", i, "job_status", "protect", j)
+			}
+		}
+		if e.JobStatus.HeldMaxAge < 0 {
+			addProblem(fmt.Sprintf("experiment %s job_status held_max_age must not be negative", e.Name), "experiments", i, "job_status", "held_max_age")
+		}
+
+		switch e.Token.Source {
+		case "", tokenSourceWLCG:
+			// The wlcg token is the same process-wide token for every experiment
+			if wlcgExperiment != "" {
+				addProblem(fmt.Sprintf("experiment %s token source %q is also used by experiment %s; configure a token for each experiment", e.Name, tokenSourceWLCG, wlcgExperiment), "experiments", i, "token")
+			} else {
+				wlcgExperiment = e.Name
+			}
+		case tokenSourceFile:
+			if e.Token.Path == "" {
+				addProblem(fmt.Sprintf("experiment %s token source %q requires path", e.Name, tokenSourceFile), "experiments", i, "token")
+			} else if other, ok := seenTokenFiles[e.Token.Path]; ok {
+				addProblem(fmt.Sprintf("experiment %s token path %s is also used by experiment %s", e.Name, e.Token.Path, other), "experiments", i, "token", "path")
+			} else {
+				seenTokenFiles[e.Token.Path] = e.Name
+			}
+		case tokenSourceHTGetToken:
+			if e.Token.VaultServer == "" || e.Token.Issuer == "" {
+				addProblem(fmt.Sprintf("experiment %s token source %q requires vault_server and issuer", e.Name, tokenSourceHTGetToken), "experiments", i, "token")
+			}
+			// Otherwise one experiment's token would be overwritten with, and used as, another's
+			outFile := e.Token.OutFile
+			if outFile == "" {
+				outFile = htgettokenOutFile(e.Name)
+			}
+			if other, ok := seenTokenFiles[outFile]; ok {
+				addProblem(fmt.Sprintf("experiment %s token out_file %s is also used by experiment %s", e.Name, outFile, other), "experiments", i, "token")
+			} else {
+				seenTokenFiles[outFile] = e.Name
+			}
+		default:
+			addProblem(fmt.Sprintf("experiment %s token source %q is not one of %s", e.Name, e.Token.Source, strings.Join(validTokenSources, ", ")), "experiments", i, "token", "source")
+		}
+
+		if e.Retention.Recent < 0 {
+			addProblem(fmt.Sprintf("experiment %s retention recent must not be negative", e.Name), "experiments", i, "retention", "recent")
+		}
+		if e.Retention.MaxParseFailures != nil && *e.Retention.MaxParseFailures < -1 {
+			addProblem(fmt.Sprintf("experiment %s retention max_parse_failures must be -1 (no limit) or more", e.Name), "experiments", i, "retention", "max_parse_failures")
+		}
+	}
+
+	seenHosts := make(map[string]int)
+	for i, r := range c.RateLimits {
+		if r.Host == "" || strings.ContainsAny(r.Host, "/:") {
+			addProblem(fmt.Sprintf("rate limit %d host %q must be a host name", i+1, r.Host), "rate_limits", i)
+		} else if first, ok := seenHosts[r.Host]; ok {
+			addProblem(fmt.Sprintf("rate limit for %s is configured more than once (first on line %d)", r.Host, first), "rate_limits", i, "host")
+		} else {
+			seenHosts[r.Host] = lineOf("rate_limits", i, "host")
+		}
+		if r.Rate <= 0 {
+			addProblem(fmt.Sprintf("rate limit %d rate must be more than 0", i+1), "rate_limits", i, "rate")
+		}
+		if r.Burst < 0 {
+			addProblem(fmt.Sprintf("rate limit %d burst must not be negative", i+1), "rate_limits", i, "burst")
+		}
+		if r.LatencyThreshold < 0 {
+			addProblem(fmt.Sprintf("rate limit %d latency_threshold must not be negative", i+1), "rate_limits", i, "latency_threshold")
+		}
+		if r.MaxSlowdown != 0 && r.MaxSlowdown < 1 {
+			addProblem(fmt.Sprintf("rate limit %d max_slowdown must be at least 1", i+1), "rate_limits", i, "max_slowdown")
+		}
+	}
+	return problems
+}
+
+func (c *Config) setDefaults() {
+	for i := range c.Experiments {
+		e := &c.Experiments[i]
+		if e.JobsubGroup == "" {
+			e.JobsubGroup = e.Name
+		}
+		if len(e.JobAttributes) == 0 {
+			e.JobAttributes = slices.Clone(defaultJobFileAttributes)
+		}
+		for j := range e.JobAttributes {
+			if e.JobAttributes[j].Format == "" {
+				e.JobAttributes[j].Format = attributeFormatCommaList
+			}
+		}
+		if e.History.Lookback == nil {
+			lookback := Duration(defaultHistoryLookback)
+			e.History.Lookback = &lookback
+		}
+		if e.History.MatchLimit == nil {
+			matchLimit := defaultHistoryMatchLimit
+			e.History.MatchLimit = &matchLimit
+		}
+		if e.ScheddQuery.Concurrency == 0 {
+			e.ScheddQuery.Concurrency = defaultScheddQueryConcurrency
+		}
+		if e.ScheddQuery.Timeout == 0 {
+			e.ScheddQuery.Timeout = Duration(defaultScheddQueryTimeout)
+		}
+		if e.Deletion.Workers == 0 {
+			e.Deletion.Workers = defaultDeletionWorkers
+		}
+		if e.Deletion.MaxAttempts == 0 {
+			e.Deletion.MaxAttempts = defaultDeletionMaxAttempts
+		}
+		if e.Deletion.InitialBackoff == 0 {
+			e.Deletion.InitialBackoff = Duration(defaultDeletionInitialBackoff)
+		}
+		if e.Deletion.MaxBackoff == 0 {
+			e.Deletion.MaxBackoff = Duration(defaultDeletionMaxBackoff)
+		}
+		if e.Safety.MinCount == nil {
+			minCount := defaultSafetyMinCount
+			e.Safety.MinCount = &minCount
+		}
+		if e.Safety.MaxFraction == 0 {
+			e.Safety.MaxFraction = defaultSafetyMaxFraction
+		}
+		if e.Safety.MaxIncrease == nil {
+			maxIncrease := float64(defaultSafetyMaxIncrease)
+			e.Safety.MaxIncrease = &maxIncrease
+		}
+		if e.Preflight.AccountingGroup == "" {
+			e.Preflight.AccountingGroup = "group_" + e.JobsubGroup
+		}
+		if e.Preflight.CheckCollector == nil {
+			checkCollector := true
+			e.Preflight.CheckCollector = &checkCollector
+		}
+		if e.Preflight.RecentWindow == nil {
+			recentWindow := Duration(defaultPreflightRecentWindow)
+			e.Preflight.RecentWindow = &recentWindow
+		}
+		if e.Quarantine.Dir == "" {
+			e.Quarantine.Dir = defaultQuarantineDir
+		}
+		if e.Quarantine.PurgeAfter == 0 {
+			e.Quarantine.PurgeAfter = Duration(defaultQuarantinePurgeAfter)
+		}
+		for _, rules := range [][]PathRuleConfig{e.Rules.Protect, e.Rules.Include} {
+			for j := range rules {
+				switch {
+				case rules[j].Name != "":
+				case rules[j].Glob != "":
+					rules[j].Name = fmt.Sprintf("glob %q", rules[j].Glob)
+				default:
+					rules[j].Name = fmt.Sprintf("regex %q", rules[j].Regex)
+				}
+			}
+		}
+		if e.JobStatus.Protect == nil {
+			e.JobStatus.Protect = slices.Clone(defaultJobStatusPolicy.Protect)
+		}
+		if e.Token.Source == "" {
+			e.Token.Source = tokenSourceWLCG
+		}
+		if e.Token.Source == tokenSourceHTGetToken && e.Token.OutFile == "" {
+			e.Token.OutFile = htgettokenOutFile(e.Name)
+		}
+		if e.Retention.Recent == 0 {
+			e.Retention.Recent = Duration(recentDuration)
+		}
+		if e.Retention.MaxParseFailures == nil {
+			e.Retention.MaxParseFailures = new(int)
+		}
+	}
+}
+
+// Collector returns the RunningJobsCounter used to check an empty result from the experiment's schedd queries, or nil if
+// the collector isn't to be checked
+func (e *ExperimentConfig) Collector() RunningJobsCounter {
+	if e.Preflight.CheckCollector != nil && !*e.Preflight.CheckCollector {
+		return nil
+	}
+	return NewCondorCollector(e.Pool, e.Preflight.AccountingGroup)
+}
+
+// DoorRateLimiters builds the RateLimiter for each configured door host
+func (c *Config) DoorRateLimiters() DoorRateLimiters {
+	limiters := make(DoorRateLimiters, len(c.RateLimits))
+	for _, r := range c.RateLimits {
+		limiters[r.Host] = NewRateLimiter(r.Options())
+	}
+	return limiters
+}
+
+// TokenSources builds the TokenSource for each configured experiment
+func (c *Config) TokenSources() TokenSources {
+	tokens := make(TokenSources, len(c.Experiments))
+	for _, e := range c.Experiments {
+		switch e.Token.Source {
+		case tokenSourceFile:
+			tokens[e.Name] = &FileTokenSource{Path: e.Token.Path}
+		case tokenSourceHTGetToken:
+			h := NewHTGetTokenSource(e.Name, e.Token.VaultServer, e.Token.Issuer)
+			h.Role = e.Token.Role
+			h.OutFile = e.Token.OutFile
+			tokens[e.Name] = h
+		default:
+			tokens[e.Name] = NewWLCGTokenSource()
+		}
+	}
+	return tokens
+}
+
+// JobListers returns a JobLister for each of the experiment's schedds.  Unless the history look-back is disabled, they
+// include recently completed jobs from condor_history.
+func (e *ExperimentConfig) JobListers() []NamedJobLister {
+	listers := make([]NamedJobLister, 0, len(e.Schedds))
+	for _, name := range e.Schedds {
+		schedd := NewCondorSchedd(name, e.Pool, e.JobAttributes)
+		if e.History.Lookback == nil || *e.History.Lookback == 0 {
+			listers = append(listers, NamedJobLister{name, schedd})
+			continue
+		}
+		matchLimit := 0
+		if e.History.MatchLimit != nil {
+			matchLimit = *e.History.MatchLimit
+		}
+		listers = append(listers, NamedJobLister{name, NewCondorScheddWithHistory(schedd, time.Duration(*e.History.Lookback), matchLimit)})
+	}
+	return listers
+}
+
+// nodeLine returns the line of the node at path within root, where each element of path is either a mapping key
+// (string) or a sequence index (int).  If the full path doesn't exist, the line of the deepest node found is returned.
+func nodeLine(root *yaml.Node, path ...any) int {
+	n := root
+	if n.Kind == yaml.DocumentNode && len(n.Content) > 0 {
+		n = n.Content[0]
+	}
+	line := n.Line
+	for _, p := range path {
+		var next *yaml.Node
+		switch key := p.(type) {
+		case string:
+			if n.Kind != yaml.MappingNode {
+				return line
+			}
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				if n.Content[i].Value == key {
+					line = n.Content[i].Line
+					next = n.Content[i+1]
+					break
+				}
+			}
+		case int:
+			if n.Kind != yaml.SequenceNode || key >= len(n.Content) {
+				return line
+			}
+			next = n.Content[key]
+			line = next.Line
+		}
+		if next == nil {
+			return line
+		}
+		n = next
+	}
+	return line
+}
+
+// runValidateConfig implements the validate-config command.  It reports every problem in the config file, and returns
+// the process exit code.
+func runValidateConfig(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("validate-config", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configPath := flags.String("config", defaultConfigPath, "Path to the config file")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	if _, err := LoadConfig(*configPath); err != nil {
+		var configErr *ConfigError
+		if errors.As(err, &configErr) {
+			fmt.Fprintf(stderr, "%s has %d problem(s):\n", *configPath, len(configErr.Problems))
+			for _, p := range configErr.Problems {
+				fmt.Fprintf(stderr, "  %s\n", p)
+			}
+		} else {
+			fmt.Fprintf(stderr, "Could not read %s: %s\n", *configPath, err)
+		}
+		return exitFailure
+	}
+	fmt.Fprintf(stdout, "%s is valid\n", *configPath)
+	return exitOK
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testGoodConfig = `experiments:
+  - name: gm2
+    dropbox: https://fndcadoor.fnal.gov:2880/GM2/resilient/jobsub_stage
+    pool: gpcollector03.fnal.gov
+    schedds:
+      - jobsub01.fnal.gov
+      - jobsub02.fnal.gov
+    job_attributes:
+      - name: PNFS_INPUT_FILES
+      - name: Jobsub_Tarballs
+        format: tarball
+    history:
+      lookback: 0s
+    schedd_query:
+      concurrency: 2
+      timeout: 30s
+    job_status:
+      protect: [idle, running, held]
+      held_max_age: 7d
+      ignore_hold_reason_codes: [1]
+    token:
+      source: htgettoken
+      vault_server: htvaultprod.fnal.gov
+      issuer: fermilab
+      role: production
+      scope_path: /resilient/jobsub_stage
+    retention:
+      recent: 14d
+      max_parse_failures: 5
+    deletion:
+      workers: 8
+      max_attempts: 5
+      initial_backoff: 1s
+    preflight:
+      check_collector: false
+      recent_window: 0s
+    safety:
+      min_count: 100
+      max_fraction: 0.2
+      max_increase: 0
+    rules:
+      protect:
+        - name: shared tarballs
+          glob: "shared_*"
+        - regex: ^ops-
+      include:
+        - glob: shared_tmp_*
+  - name: mu2e
+    dropbox: /pnfs/mu2e/resilient/jobsub_stage
+    jobsub_group: mu2e_pro
+    history:
+      match_limit: 500
+    schedds: [jobsub01.fnal.gov]
+    token:
+      source: file
+      path: /var/run/managed-tokens/mu2e
+rate_limits:
+  - host: fndcadoor.fnal.gov
+    rate: 20
+    latency_threshold: 10s
+`
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := ParseConfig([]byte(testGoodConfig))
+	assert.NoError(t, err)
+	assert.Len(t, cfg.Experiments, 2)
+
+	gm2 := cfg.Experiments[0]
+	assert.Equal(t, "gm2", gm2.JobsubGroup)
+	assert.Equal(t, []string{"jobsub01.fnal.gov", "jobsub02.fnal.gov"}, gm2.Schedds)
+	assert.Equal(t, Duration(14*24*time.Hour), gm2.Retention.Recent)
+	assert.Equal(t, 5, *gm2.Retention.MaxParseFailures)
+	assert.Equal(t, "production", gm2.Token.Role)
+	assert.Equal(
+		t,
+		[]JobFileAttribute{{"PNFS_INPUT_FILES", attributeFormatCommaList}, {"Jobsub_Tarballs", attributeFormatTarball}},
+		gm2.JobAttributes,
+	)
+
+	// Defaults
+	mu2e := cfg.Experiments[1]
+	assert.Equal(t, "mu2e_pro", mu2e.JobsubGroup)
+	assert.Equal(t, Duration(recentDuration), mu2e.Retention.Recent)
+	assert.Equal(t, 0, *mu2e.Retention.MaxParseFailures)
+	assert.Equal(t, defaultJobFileAttributes, mu2e.JobAttributes)
+	assert.Equal(t, Duration(defaultHistoryLookback), *mu2e.History.Lookback)
+	assert.Equal(t, ScheddQueryOptions{2, 30 * time.Second}, gm2.ScheddQuery.Options())
+	assert.Equal(t, ScheddQueryOptions{defaultScheddQueryConcurrency, defaultScheddQueryTimeout}, mu2e.ScheddQuery.Options())
+	assert.Equal(t, QuarantineConfig{false, defaultQuarantineDir, Duration(defaultQuarantinePurgeAfter)}, mu2e.Quarantine)
+	assert.Equal(
+		t,
+		RulesConfig{
+			Protect: []PathRuleConfig{{"shared tarballs", "shared_*", ""}, {`regex "^ops-"`, "", "^ops-"}},
+			Include: []PathRuleConfig{{`glob "shared_tmp_*"`, "shared_tmp_*", ""}},
+		},
+		gm2.Rules,
+	)
+	protect, include, err := gm2.Rules.PathRules()
+	assert.NoError(t, err)
+	assert.Len(t, protect, 2)
+	assert.Len(t, include, 1)
+	assert.Equal(t, RulesConfig{}, mu2e.Rules)
+	assert.Nil(t, gm2.Collector())
+	assert.Equal(t, time.Duration(0), gm2.Preflight.recentWindow())
+	assert.Equal(t, NewCondorCollector("", "group_mu2e_pro"), mu2e.Collector())
+	assert.Equal(t, defaultPreflightRecentWindow, mu2e.Preflight.recentWindow())
+	assert.Equal(t, SafetyLimits{MinCount: 100, MaxFraction: 0.2}, gm2.Safety.Limits())
+	assert.Equal(t, SafetyLimits{defaultSafetyMinCount, defaultSafetyMaxFraction, 0, defaultSafetyMaxIncrease}, mu2e.Safety.Limits())
+	assert.Equal(t, DeletionOptions{Workers: 8, MaxAttempts: 5, InitialBackoff: time.Second, MaxBackoff: defaultDeletionMaxBackoff}, gm2.Deletion.Options())
+	assert.Equal(
+		t,
+		DeletionOptions{defaultDeletionWorkers, defaultDeletionMaxAttempts, defaultDeletionInitialBackoff, defaultDeletionMaxBackoff, 0, "", "", nil, false},
+		mu2e.Deletion.Options(),
+	)
+
+	assert.Equal(
+		t,
+		JobStatusPolicy{Protect: []string{"idle", "running", "held"}, HeldMaxAge: 7 * 24 * time.Hour, IgnoreHoldReasonCodes: []int{1}},
+		gm2.JobStatus.Policy(),
+	)
+	assert.Equal(t, defaultJobStatusPolicy, mu2e.JobStatus.Policy())
+
+	// gm2 has condor_history disabled
+	assert.Equal(
+		t,
+		[]NamedJobLister{
+			{"jobsub01.fnal.gov", NewCondorSchedd("jobsub01.fnal.gov", "gpcollector03.fnal.gov", gm2.JobAttributes)},
+			{"jobsub02.fnal.gov", NewCondorSchedd("jobsub02.fnal.gov", "gpcollector03.fnal.gov", gm2.JobAttributes)},
+		},
+		gm2.JobListers(),
+	)
+	assert.Equal(
+		t,
+		[]NamedJobLister{
+			{"jobsub01.fnal.gov", NewCondorScheddWithHistory(NewCondorSchedd("jobsub01.fnal.gov", "", defaultJobFileAttributes), defaultHistoryLookback, 500)},
+		},
+		mu2e.JobListers(),
+	)
+
+	limiters := cfg.DoorRateLimiters()
+	if assert.Contains(t, limiters, "fndcadoor.fnal.gov") {
+		assert.Equal(
+			t,
+			RateLimitOptions{Rate: 20, Burst: 20, LatencyThreshold: 10 * time.Second, MaxSlowdown: defaultRateLimitMaxSlowdown},
+			limiters["fndcadoor.fnal.gov"].opts,
+		)
+	}
+
+	tokens := cfg.TokenSources()
+	assert.IsType(t, &HTGetTokenSource{}, tokens["gm2"])
+	assert.Equal(t, "production", tokens["gm2"].(*HTGetTokenSource).Role)
+	assert.Equal(t, "gm2", tokens["gm2"].(*HTGetTokenSource).Name)
+	assert.Equal(t, htgettokenOutFile("gm2"), tokens["gm2"].(*HTGetTokenSource).outFile())
+	assert.Equal(t, &FileTokenSource{Path: "/var/run/managed-tokens/mu2e"}, tokens["mu2e"])
+}
+
+func TestParseConfigProblems(t *testing.T) {
+	type testCase struct {
+		description      string
+		config           string
+		expectedProblems []ConfigProblem
+	}
+
+	testCases := []testCase{
+		{
+			"Empty config",
+			"",
+			[]ConfigProblem{{0, "no experiments are configured"}},
+		},
+		{
+			"Syntax error",
+			"experiments:\n  - name: gm2\n\tdropbox: foo\n",
+			[]ConfigProblem{{2, "found a tab character that violates indentation"}},
+		},
+		{
+			"Shared htgettoken out_file",
+			`experiments:
+  - name: gm2
+    dropbox: /pnfs/gm2/resilient/jobsub_stage
+    schedds: [jobsub01.fnal.gov]
+    token: {source: htgettoken, vault_server: htvaultprod.fnal.gov, issuer: fermilab, out_file: /tmp/bt_shared}
+  - name: mu2e
+    dropbox: /pnfs/mu2e/resilient/jobsub_stage
+    schedds: [jobsub01.fnal.gov]
+    token: {source: htgettoken, vault_server: htvaultprod.fnal.gov, issuer: fermilab, out_file: /tmp/bt_shared}
+  - name: nova
+    dropbox: /pnfs/nova/resilient/jobsub_stage
+    schedds: [jobsub01.fnal.gov]
+    token: {source: htgettoken, vault_server: htvaultprod.fnal.gov, issuer: fermilab}
+  - name: dune
+    dropbox: /pnfs/dune/resilient/jobsub_stage
+    schedds: [jobsub01.fnal.gov]
+    token: {source: htgettoken, vault_server: htvaultprod.fnal.gov, issuer: fermilab, out_file: ` + htgettokenOutFile("nova") + `}
+`,
+			[]ConfigProblem{
+				{9, "experiment mu2e token out_file /tmp/bt_shared is also used by experiment gm2"},
+				{17, "experiment dune token out_file " + htgettokenOutFile("nova") + " is also used by experiment nova"},
+			},
+		},
+		{
+			"Shared wlcg token",
+			`experiments:
+  - name: gm2
+    dropbox: /pnfs/gm2/resilient/jobsub_stage
+    schedds: [jobsub01.fnal.gov]
+  - name: mu2e
+    dropbox: /pnfs/mu2e/resilient/jobsub_stage
+    schedds: [jobsub01.fnal.gov]
+    token: {source: file, path: /var/run/managed-tokens/mu2e}
+  - name: nova
+    dropbox: /pnfs/nova/resilient/jobsub_stage
+    schedds: [jobsub01.fnal.gov]
+    token: {source: wlcg}
+`,
+			[]ConfigProblem{
+				{12, "experiment nova token source \"wlcg\" is also used by experiment gm2; configure a token for each experiment"},
+			},
+		},
+		{
+			"Shared token file",
+			`experiments:
+  - name: gm2
+    dropbox: /pnfs/gm2/resilient/jobsub_stage
+    schedds: [jobsub01.fnal.gov]
+    token: {source: file, path: /var/run/managed-tokens/shared}
+  - name: mu2e
+    dropbox: /pnfs/mu2e/resilient/jobsub_stage
+    schedds: [jobsub01.fnal.gov]
+    token: {source: file, path: /var/run/managed-tokens/shared}
+  - name: nova
+    dropbox: /pnfs/nova/resilient/jobsub_stage
+    schedds: [jobsub01.fnal.gov]
+    token: {source: htgettoken, vault_server: htvaultprod.fnal.gov, issuer: fermilab, out_file: /var/run/managed-tokens/shared}
+`,
+			[]ConfigProblem{
+				{9, "experiment mu2e token path /var/run/managed-tokens/shared is also used by experiment gm2"},
+				{13, "experiment nova token out_file /var/run/managed-tokens/shared is also used by experiment gm2"},
+			},
+		},
+		{
+			"Every problem is reported with its line",
+			`experiments:
+  - name: gm2
+    dropbox: https://fndcadoor.fnal.gov:2880/GM2/resilient/jobsub_stage
+    schedds: [jobsub01.fnal.gov]
+    tokn:
+      source: file
+    retention:
+      recent: a while
+  - name: gm2
+    dropbox: relative/path
+    schedds: [jobsub01.fnal.gov, ""]
+    job_attributes:
+      - format: comma
+      - name: TransferInput
+        format: xml
+    token:
+      source: kerberos
+  - dropbox: https://fndcadoor.fnal.gov:2880/nova/resilient/jobsub_stage
+    token:
+      source: htgettoken
+      issuer: fermilab
+    job_status:
+      protect: [running, zombie]
+    retention:
+      max_parse_failures: -2
+    deletion:
+      workers: -1
+    safety:
+      max_fraction: 1.5
+    quarantine:
+      dir: ../elsewhere
+    rules:
+      protect:
+        - glob: "[a"
+        - glob: a*
+          regex: ^a
+rate_limits:
+  - host: https://fndcadoor.fnal.gov
+    rate: 0
+  - host: door.fnal.gov
+    rate: 10
+  - host: door.fnal.gov
+    rate: 10
+    max_slowdown: 0.5
+`,
+			[]ConfigProblem{
+				{5, "field tokn not found in type main.ExperimentConfig"},
+				{8, `invalid duration "a while": use a Go duration like "36h" or a number of days like "30d"`},
+				{9, "experiment gm2 is configured more than once (first on line 2)"},
+				{10, `experiment gm2 dropbox "relative/path" must be a URL or an absolute path`},
+				{11, "experiment gm2 has an empty schedd name"},
+				{13, "experiment gm2 job attribute 1 has no name"},
+				{15, `experiment gm2 job attribute TransferInput format "xml" is not one of comma, classad-list, url, tarball`},
+				{17, `experiment gm2 token source "kerberos" is not one of wlcg, file, htgettoken`},
+				{18, "experiment 3 has no name"},
+				{18, "experiment  has no schedds"},
+				{19, `experiment  token source "htgettoken" requires vault_server and issuer`},
+				{23, `experiment  job_status protect "zombie" is not one of idle, running, held, suspended`},
+				{25, "experiment  retention max_parse_failures must be -1 (no limit) or more"},
+				{27, "experiment  deletion workers must not be negative"},
+				{29, "experiment  safety max_fraction must be between 0 and 1"},
+				{31, `experiment  quarantine dir "../elsewhere" must be the name of a directory within the dropbox`},
+				{34, `experiment  protect rule 1: invalid glob "[a": syntax error in pattern`},
+				{35, "experiment  protect rule 2: a rule must have exactly one of glob and regex"},
+				{38, `rate limit 1 host "https://fndcadoor.fnal.gov" must be a host name`},
+				{39, "rate limit 1 rate must be more than 0"},
+				{42, "rate limit for door.fnal.gov is configured more than once (first on line 40)"},
+				{44, "rate limit 3 max_slowdown must be at least 1"},
+			},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(
+			test.description,
+			func(t *testing.T) {
+				cfg, err := ParseConfig([]byte(test.config))
+				assert.Nil(t, cfg)
+				var configErr *ConfigError
+				if assert.ErrorAs(t, err, &configErr) {
+					assert.Equal(t, test.expectedProblems, configErr.Problems)
+				}
+			},
+		)
+	}
+}
+
+func TestRunValidateConfig(t *testing.T) {
+	type testCase struct {
+		description    string
+		config         string
+		expectedCode   int
+		expectedStdout string
+		expectedStderr string
+	}
+
+	testCases := []testCase{
+		{
+			"Valid config",
+			testGoodConfig,
+			exitOK,
+			"%s is valid\n",
+			"",
+		},
+		{
+			"Invalid config",
+			"experiments:\n  - name: gm2\n    schedds: [jobsub01.fnal.gov]\n",
+			exitFailure,
+			"",
+			"%s has 1 problem(s):\n  line 2: experiment gm2 has no dropbox\n",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(
+			test.description,
+			func(t *testing.T) {
+				path := filepath.Join(t.TempDir(), "config.yaml")
+				os.WriteFile(path, []byte(test.config), 0o644)
+				var stdout, stderr bytes.Buffer
+				code := runValidateConfig([]string{"-config", path}, &stdout, &stderr)
+				assert.Equal(t, test.expectedCode, code)
+				if test.expectedStdout != "" {
+					assert.Equal(t, fmt.Sprintf(test.expectedStdout, path), stdout.String())
+				}
+				if test.expectedStderr != "" {
+					assert.Equal(t, fmt.Sprintf(test.expectedStderr, path), stderr.String())
+				}
+			},
+		)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDeletionWorkers        = 4
+	defaultDeletionMaxAttempts    = 3
+	defaultDeletionInitialBackoff = 2 * time.Second
+	defaultDeletionMaxBackoff     = time.Minute
+)
+
+// DeletionOptions controls how a DeletionExecutor deletes candidates
+type DeletionOptions struct {
+	// Workers is the most deletions run at once.  If zero, defaultDeletionWorkers is used.
+	Workers int
+	// MaxAttempts is the most times a deletion that fails with a transient error is tried.  If zero,
+	// defaultDeletionMaxAttempts is used.
+	MaxAttempts int
+	// InitialBackoff is how long to wait before the first retry.  Each retry after that waits twice as long as the one
+	// before, up to MaxBackoff.  If zero, defaultDeletionInitialBackoff and defaultDeletionMaxBackoff are used.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// GracePeriod is how long deletions in progress when the executor is stopped are given to finish before they are
+	// killed
+	GracePeriod time.Duration
+	// MoveTo, if set, is a directory that candidates are moved into instead of being deleted
+	MoveTo string
+	// Root is the configured dropbox root.  Nothing is ever deleted or moved unless it, and where it is moved to, are
+	// strictly within Root.  If empty, the source passed to Delete is the root.
+	Root string
+	// Audit records each attempt before it is made, and how it went.  An attempt that can't be recorded isn't made.
+	Audit *Auditor
+	// MeasureDirectories lists each directory candidate before deleting it, so that its outcome's Size is the size of
+	// what is in it rather than the size the directory is listed with.  Listing is bounded by maxMeasureDepth and
+	// maxMeasureEntries.
+	MeasureDirectories bool
+}
+
+// DeletionExecutor deletes candidates from a dropbox with a pool of workers, retrying deletions that fail with transient
+// errors
+type DeletionExecutor struct {
+	f    FileAccessor
+	opts DeletionOptions
+	// sleep waits for d, or until ctx is cancelled
+	sleep func(ctx context.Context, d time.Duration) error
+	// randInt63n is used to add jitter to the backoff
+	randInt63n func(n int64) int64
+}
+
+// NewDeletionExecutor returns a DeletionExecutor that deletes with f
+func NewDeletionExecutor(f FileAccessor, opts DeletionOptions) *DeletionExecutor {
+	if opts.Workers <= 0 {
+		opts.Workers = defaultDeletionWorkers
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = defaultDeletionMaxAttempts
+	}
+	if opts.InitialBackoff <= 0 {
+		opts.InitialBackoff = defaultDeletionInitialBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = defaultDeletionMaxBackoff
+	}
+	return &DeletionExecutor{f: f, opts: opts, sleep: sleepContext, randInt63n: rand.Int63n}
+}
+
+// Delete deletes each of candidates from the dropbox at source, and returns an outcome for each one that was attempted,
+// in the order of candidates.  Candidates are started in order, so the ones without an outcome are always at the end.
+//
+// Once ctx is cancelled, no more deletions or retries are started, and the deletions in progress are given the grace
+// period to finish.
+func (d *DeletionExecutor) Delete(ctx context.Context, source string, candidates []PlannedEntry) []DeletionOutcome {
+	removeCtx, cancel := withGracePeriod(ctx, d.opts.GracePeriod)
+	defer cancel()
+
+	outcomes := make([]DeletionOutcome, len(candidates))
+	started := make([]bool, len(candidates))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(d.opts.Workers, len(candidates)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				// The select below picks at random when a worker is ready at the moment ctx is cancelled, so a
+				// candidate can still be handed over after cancellation
+				if ctx.Err() != nil {
+					continue
+				}
+				outcomes[i] = d.deleteWithRetries(ctx, removeCtx, source, candidates[i])
+				started[i] = true
+			}
+		}()
+	}
+
+feed:
+	for i := range candidates {
+		if ctx.Err() != nil {
+			break
+		}
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	result := outcomes[:0]
+	for i := range outcomes {
+		if started[i] {
+			result = append(result, outcomes[i])
+		}
+	}
+	return result
+}
+
+// deleteWithRetries deletes a single candidate, retrying transient errors with backoff until the attempts run out or
+// ctx is cancelled.  removeCtx is passed on to the removal itself.
+func (d *DeletionExecutor) deleteWithRetries(ctx, removeCtx context.Context, source string, candidate PlannedEntry) DeletionOutcome {
+	root := d.opts.Root
+	if root == "" {
+		root = source
+	}
+	target := DeletionOutcome{Entry: candidate, URL: entryURL(source, candidate.Entry.filename)}
+	if d.opts.MoveTo != "" {
+		target.MovedTo = entryURL(d.opts.MoveTo, candidate.Entry.filename)
+	}
+	logger := loggerFrom(ctx).With(logKeyPath, target.URL)
+	err := checkWithinRoot(root, target.URL)
+	if err == nil && target.MovedTo != "" {
+		err = checkWithinRoot(root, target.MovedTo)
+	}
+	if err != nil {
+		target.Err = err
+		logger.Error("refused to delete", "error", err)
+		d.opts.Audit.record(target, 0, AuditRefused)
+		return target
+	}
+
+	if d.opts.MoveTo == "" {
+		target.Size = candidate.Entry.size
+	}
+
+	outcome := target
+	for attempt := 1; ; attempt++ {
+		if err := d.opts.Audit.record(target, attempt, AuditStarted); err != nil {
+			outcome.Err = fmt.Errorf("not attempted because the audit log could not be written: %w", err)
+			logger.Error("could not delete", "attempt", attempt, "error", outcome.Err)
+			return outcome
+		}
+		// The size a directory is listed with says nothing about what is in it.  Measuring is left out once stopped so
+		// that the grace period goes to the deletion itself.
+		if attempt == 1 && d.opts.MeasureDirectories && d.opts.MoveTo == "" && candidate.Entry.isDirectory && ctx.Err() == nil {
+			if size, err := contentSize(withLogger(ctx, logger), d.f, target.URL); err != nil {
+				logger.Warn("could not measure directory before deleting it", "error", err)
+			} else {
+				target.Size = size
+			}
+		}
+		if d.opts.MoveTo != "" {
+			outcome = moveEntry(removeCtx, d.f, source, d.opts.MoveTo, candidate)
+		} else {
+			outcome = deleteEntry(removeCtx, d.f, source, candidate)
+		}
+		outcome.Attempts = attempt
+		outcome.Size = target.Size
+		status := AuditSucceeded
+		if outcome.Err != nil {
+			status = AuditFailed
+		}
+		// The attempt has already been made, so there is nothing to do about a failure to record how it went except
+		// report it when the audit log is closed
+		d.opts.Audit.record(outcome, attempt, status)
+		switch {
+		case outcome.Err == nil && outcome.MovedTo != "":
+			logger.Info("quarantined", "moved_to", outcome.MovedTo, "attempt", attempt)
+			return outcome
+		case outcome.Err == nil:
+			logger.Info("deleted", "attempt", attempt)
+			return outcome
+		case !errors.Is(outcome.Err, ErrTransient) || attempt >= d.opts.MaxAttempts:
+			logger.Error("could not delete", "attempt", attempt, "error", outcome.Err)
+			return outcome
+		}
+		wait := d.backoff(attempt)
+		logger.Warn("could not delete, retrying", "attempt", attempt, "backoff", wait, "error", outcome.Err)
+		if err := d.sleep(ctx, wait); err != nil {
+			return outcome
+		}
+	}
+}
+
+const (
+	// maxMeasureDepth is how many levels of subdirectories contentSize lists below the directory it measures
+	maxMeasureDepth = 4
+	// maxMeasureEntries is the most entries contentSize lists before giving up, so that measuring a huge directory
+	// doesn't add a huge load on the doors
+	maxMeasureEntries = 10000
+)
+
+// contentSize returns the total size of the files within the directory at dirURL, including those in its
+// subdirectories.  Listing lines that can't be parsed are skipped.  It gives up with ErrTooLargeToMeasure if the
+// directory is nested deeper than maxMeasureDepth or has more than maxMeasureEntries entries.
+func contentSize(ctx context.Context, f FileAccessor, dirURL string) (int64, error) {
+	listed := 0
+	return measureDir(ctx, f, dirURL, 0, &listed)
+}
+
+func measureDir(ctx context.Context, f FileAccessor, dirURL string, depth int, listed *int) (int64, error) {
+	stream := StreamDropboxFiles(ctx, f, dirURL, -1)
+	defer stream.Close()
+	var total int64
+	subdirs := make([]string, 0)
+	for entry := range stream.Entries() {
+		*listed++
+		if *listed > maxMeasureEntries {
+			return 0, fmt.Errorf("%w: more than %d entries", ErrTooLargeToMeasure, maxMeasureEntries)
+		}
+		if entry.isDirectory {
+			subdirs = append(subdirs, entry.filename)
+			continue
+		}
+		total += entry.size
+	}
+	if err := stream.Err(); err != nil && !errors.Is(err, ErrNoFileEntries) {
+		return 0, err
+	}
+	if len(subdirs) != 0 && depth >= maxMeasureDepth {
+		return 0, fmt.Errorf("%w: nested more than %d levels deep", ErrTooLargeToMeasure, maxMeasureDepth)
+	}
+	for _, name := range subdirs {
+		n, err := measureDir(ctx, f, entryURL(dirURL, name), depth+1, listed)
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// backoff is how long to wait after the given failed attempt.  The wait doubles with each attempt up to MaxBackoff, and
+// a random half of it is jitter so that workers that failed together don't all retry together.
+func (d *DeletionExecutor) backoff(attempt int) time.Duration {
+	wait := d.opts.InitialBackoff
+	for i := 1; i < attempt && wait < d.opts.MaxBackoff; i++ {
+		wait *= 2
+	}
+	wait = min(wait, d.opts.MaxBackoff)
+	half := wait / 2
+	return half + time.Duration(d.randInt63n(int64(wait-half)+1))
+}
+
+// checkWithinRoot returns an error wrapping ErrOutsideDropbox unless target is strictly within the dropbox root.  This
+// is checked on the URLs themselves, before any FileAccessor sees them, so a bad entry name or a mistake in building a
+// URL can't reach anything else.  Targets with "." or ".." components or encoded slashes are refused outright rather
+// than resolved.
+func checkWithinRoot(root, target string) error {
+	rootURL, err := url.Parse(root)
+	if err != nil {
+		return fmt.Errorf("%w: invalid dropbox root %q: %w", ErrOutsideDropbox, root, err)
+	}
+	rootComponents, err := pathComponents(rootURL)
+	if err != nil || len(rootComponents) == 0 {
+		return fmt.Errorf("%w: %q is not usable as a dropbox root", ErrOutsideDropbox, root)
+	}
+
+	lower := strings.ToLower(target)
+	if strings.Contains(lower, "%2f") || strings.Contains(lower, "%5c") || strings.Contains(target, "\\") {
+		return fmt.Errorf("%w: %s has an encoded slash or a backslash", ErrOutsideDropbox, target)
+	}
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return fmt.Errorf("%w: invalid target %q: %w", ErrOutsideDropbox, target, err)
+	}
+	if targetURL.RawQuery != "" || targetURL.Fragment != "" {
+		return fmt.Errorf("%w: %s has a query or fragment", ErrOutsideDropbox, target)
+	}
+	if !strings.EqualFold(targetURL.Scheme, rootURL.Scheme) || !strings.EqualFold(targetURL.Host, rootURL.Host) {
+		return fmt.Errorf("%w: %s is not on the same server as %s", ErrOutsideDropbox, target, root)
+	}
+	targetComponents, err := pathComponents(targetURL)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrOutsideDropbox, target, err)
+	}
+
+	for i, c := range rootComponents {
+		if i >= len(targetComponents) || targetComponents[i] != c {
+			return fmt.Errorf("%w: %s is not within %s", ErrOutsideDropbox, target, root)
+		}
+	}
+	if len(targetComponents) == len(rootComponents) {
+		return fmt.Errorf("%w: %s is the dropbox root itself", ErrOutsideDropbox, target)
+	}
+	return nil
+}
+
+// pathComponents splits u's path into its non-empty components, and fails if any of them is "." or ".."
+func pathComponents(u *url.URL) ([]string, error) {
+	components := make([]string, 0)
+	for _, c := range strings.Split(u.Path, "/") {
+		switch c {
+		case "":
+		case ".", "..":
+			return nil, errors.New("path traversal components are not allowed")
+		default:
+			components = append(components, c)
+		}
+	}
+	return components, nil
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+var (
+	// ErrTransient marks errors that are worth retrying, such as timeouts and server errors
+	ErrTransient = errors.New("transient error")
+	// ErrOutsideDropbox is returned for anything that would delete or move something other than an entry within the
+	// dropbox
+	ErrOutsideDropbox = errors.New("refusing to operate outside the dropbox")
+	// ErrTooLargeToMeasure is returned when measuring a directory would take more listing than it is worth
+	ErrTooLargeToMeasure = errors.New("directory is too large to measure")
+)
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyFileAccessor fails each removal with the errors queued for its URL, in order, before succeeding
+type flakyFileAccessor struct {
+	*testFileAccessor
+	mu       sync.Mutex
+	errs     map[string][]error
+	attempts map[string]int
+	inFlight atomic.Int64
+	// maxInFlight is the most removals that were ever running at once
+	maxInFlight atomic.Int64
+}
+
+func newFlakyFileAccessor(errs map[string][]error) *flakyFileAccessor {
+	return &flakyFileAccessor{
+		testFileAccessor: newTestFileAccessor(nil, false, nil),
+		errs:             errs,
+		attempts:         make(map[string]int),
+	}
+}
+
+func (f *flakyFileAccessor) removeFile(ctx context.Context, urlOrPath string) error {
+	return f.removeDir(ctx, urlOrPath)
+}
+
+func (f *flakyFileAccessor) removeDir(ctx context.Context, urlOrPath string) error {
+	n := f.inFlight.Add(1)
+	defer f.inFlight.Add(-1)
+	for {
+		prev := f.maxInFlight.Load()
+		if n <= prev || f.maxInFlight.CompareAndSwap(prev, n) {
+			break
+		}
+	}
+	if err := f.testFileAccessor.removeDir(ctx, urlOrPath); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.attempts[urlOrPath]++
+	if queued := f.errs[urlOrPath]; len(queued) > 0 {
+		f.errs[urlOrPath] = queued[1:]
+		return queued[0]
+	}
+	return nil
+}
+
+func testCandidates(names ...string) []PlannedEntry {
+	candidates := make([]PlannedEntry, 0, len(names))
+	for _, name := range names {
+		candidates = append(candidates, PlannedEntry{FileEntry{name, time.Time{}, true, 0}, DecisionDelete, ""})
+	}
+	return candidates
+}
+
+func TestDeletionExecutorRetries(t *testing.T) {
+	type testCase struct {
+		description      string
+		errs             []error
+		expectedAttempts int
+		expectedSleeps   []time.Duration
+		expectedErr      error
+	}
+
+	errTimeout := fmt.Errorf("%w: gfal-rm failed: Connection timed out", ErrTransient)
+	errNotFound := errors.New("gfal-rm failed: HTTP 404")
+
+	testCases := []testCase{
+		{
+			"Succeeds straight away",
+			nil,
+			1,
+			[]time.Duration{},
+			nil,
+		},
+		{
+			"Transient errors are retried with backoff",
+			[]error{errTimeout, errTimeout},
+			3,
+			[]time.Duration{time.Second, 2 * time.Second},
+			nil,
+		},
+		{
+			"Transient errors give up after MaxAttempts",
+			[]error{errTimeout, errTimeout, errTimeout, errTimeout},
+			3,
+			[]time.Duration{time.Second, 2 * time.Second},
+			ErrTransient,
+		},
+		{
+			"Permanent errors are never retried",
+			[]error{errNotFound},
+			1,
+			[]time.Duration{},
+			errNotFound,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(
+			test.description,
+			func(t *testing.T) {
+				f := newFlakyFileAccessor(map[string][]error{"/dropbox/dir": test.errs})
+				d := NewDeletionExecutor(f, DeletionOptions{Workers: 1, MaxAttempts: 3, InitialBackoff: time.Second, MaxBackoff: time.Minute})
+				sleeps := make([]time.Duration, 0)
+				d.sleep = func(_ context.Context, d time.Duration) error {
+					sleeps = append(sleeps, d)
+					return nil
+				}
+				// No jitter
+				d.randInt63n = func(n int64) int64 { return n - 1 }
+
+				outcomes := d.Delete(context.Background(), "/dropbox", testCandidates("dir"))
+				if assert.Len(t, outcomes, 1) {
+					assert.Equal(t, "/dropbox/dir", outcomes[0].URL)
+					assert.Equal(t, test.expectedAttempts, outcomes[0].Attempts)
+					if test.expectedErr == nil {
+						assert.NoError(t, outcomes[0].Err)
+					} else {
+						assert.ErrorIs(t, outcomes[0].Err, test.expectedErr)
+					}
+				}
+				assert.Equal(t, test.expectedAttempts, f.attempts["/dropbox/dir"])
+				assert.Equal(t, test.expectedSleeps, sleeps)
+			},
+		)
+	}
+}
+
+func TestDeletionExecutorSize(t *testing.T) {
+	type testCase struct {
+		description   string
+		measure       bool
+		moveTo        string
+		listingError  bool
+		contents      map[string][]FileEntry
+		expectedSizes []int64
+	}
+
+	contents := map[string][]FileEntry{
+		"/dropbox/dir":     {{"a", time.Time{}, false, 1000}, {"sub", time.Time{}, true, 512}},
+		"/dropbox/dir/sub": {{"b", time.Time{}, false, 24}},
+	}
+	tooDeep := map[string][]FileEntry{}
+	for i, dir := 0, "/dropbox/dir"; i <= maxMeasureDepth+1; i, dir = i+1, dir+"/sub" {
+		tooDeep[dir] = []FileEntry{{"a", time.Time{}, false, 1000}, {"sub", time.Time{}, true, 512}}
+	}
+	tooMany := map[string][]FileEntry{"/dropbox/dir": make([]FileEntry, 0, maxMeasureEntries+1)}
+	for i := 0; i <= maxMeasureEntries; i++ {
+		tooMany["/dropbox/dir"] = append(tooMany["/dropbox/dir"], FileEntry{fmt.Sprintf("f%d", i), time.Time{}, false, 1})
+	}
+
+	testCases := []testCase{
+		{"Directories are measured by their contents", true, "", false, contents, []int64{1024, 100}},
+		{"Directories are not measured unless asked", false, "", false, contents, []int64{512, 100}},
+		{"Nothing is reclaimed by moving", true, "/dropbox/.quarantine", false, contents, []int64{0, 0}},
+		{"Directories that can't be listed are still deleted", true, "", true, contents, []int64{512, 100}},
+		{"Directories nested too deep are not measured", true, "", false, tooDeep, []int64{512, 100}},
+		{"Directories with too many entries are not measured", true, "", false, tooMany, []int64{512, 100}},
+	}
+
+	for _, test := range testCases {
+		t.Run(
+			test.description,
+			func(t *testing.T) {
+				candidates := []PlannedEntry{
+					{FileEntry{"dir", time.Time{}, true, 512}, DecisionDelete, ""},
+					{FileEntry{"file", time.Time{}, false, 100}, DecisionDelete, ""},
+				}
+				f := newTestFileAccessor(nil, test.listingError, nil)
+				f.contents = test.contents
+				d := NewDeletionExecutor(f, DeletionOptions{Workers: 1, MoveTo: test.moveTo, MeasureDirectories: test.measure})
+
+				outcomes := d.Delete(context.Background(), "/dropbox", candidates)
+				sizes := make([]int64, 0, len(outcomes))
+				for _, o := range outcomes {
+					assert.NoError(t, o.Err)
+					sizes = append(sizes, o.Size)
+				}
+				assert.Equal(t, test.expectedSizes, sizes)
+				assert.Len(t, f.removed, 2)
+			},
+		)
+	}
+}
+
+func TestDeletionExecutorBackoff(t *testing.T) {
+	d := NewDeletionExecutor(nil, DeletionOptions{InitialBackoff: time.Second, MaxBackoff: 10 * time.Second})
+
+	d.randInt63n = func(n int64) int64 { return n - 1 }
+	maxBackoffs := make([]time.Duration, 0)
+	for attempt := 1; attempt <= 6; attempt++ {
+		maxBackoffs = append(maxBackoffs, d.backoff(attempt))
+	}
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}, maxBackoffs)
+
+	d.randInt63n = func(int64) int64 { return 0 }
+	assert.Equal(t, 2*time.Second, d.backoff(3), "jitter is at most half of the backoff")
+	assert.Equal(t, 5*time.Second, d.backoff(100))
+}
+
+func TestDeletionExecutorConcurrency(t *testing.T) {
+	names := make([]string, 0, 20)
+	for i := 0; i < 20; i++ {
+		names = append(names, fmt.Sprintf("dir%02d", i))
+	}
+	f := newFlakyFileAccessor(map[string][]error{"/dropbox/dir03": {errors.New("permission denied")}})
+	f.removeDelay = 10 * time.Millisecond
+
+	outcomes := NewDeletionExecutor(f, DeletionOptions{Workers: 4}).Delete(context.Background(), "/dropbox", testCandidates(names...))
+	assert.LessOrEqual(t, f.maxInFlight.Load(), int64(4))
+	assert.Greater(t, f.maxInFlight.Load(), int64(1))
+	if assert.Len(t, outcomes, len(names)) {
+		for i, o := range outcomes {
+			assert.Equal(t, "/dropbox/"+names[i], o.URL, "outcomes should be in candidate order")
+			if i == 3 {
+				assert.Error(t, o.Err)
+			} else {
+				assert.NoError(t, o.Err)
+			}
+		}
+	}
+}
+
+func TestDeletionExecutorStopped(t *testing.T) {
+	errUnavailable := fmt.Errorf("%w: gfal-rm failed: HTTP 503", ErrTransient)
+	f := newFlakyFileAccessor(map[string][]error{"/dropbox/a": {errUnavailable, errUnavailable}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	f.onRemove = func(string) { cancel() }
+
+	outcomes := NewDeletionExecutor(f, DeletionOptions{Workers: 1, InitialBackoff: time.Hour}).Delete(ctx, "/dropbox", testCandidates("a", "b", "c"))
+	if assert.Len(t, outcomes, 1, "no deletions should be started once stopped") {
+		assert.Equal(t, 1, outcomes[0].Attempts, "no retries should be started once stopped")
+		assert.ErrorIs(t, outcomes[0].Err, ErrTransient)
+	}
+}
+
+func TestDeletionExecutorCancelled(t *testing.T) {
+	type testCase struct {
+		description      string
+		workers          int
+		cancelOnRemove   bool
+		expectedRemovals int
+	}
+
+	testCases := []testCase{
+		{
+			"Cancelled before starting",
+			4,
+			false,
+			0,
+		},
+		{
+			"Cancelled during the first removal",
+			1,
+			true,
+			1,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(
+			test.description,
+			func(t *testing.T) {
+				// Whether a candidate slips through after cancellation is down to the scheduler, so give it plenty of
+				// chances
+				for i := 0; i < 100; i++ {
+					f := newTestFileAccessor(nil, false, nil)
+					ctx, cancel := context.WithCancel(context.Background())
+					if test.cancelOnRemove {
+						f.onRemove = func(string) { cancel() }
+					} else {
+						cancel()
+					}
+
+					outcomes := NewDeletionExecutor(f, DeletionOptions{Workers: test.workers}).Delete(ctx, "/dropbox", testCandidates("a", "b", "c", "d", "e", "f"))
+					cancel()
+					if !assert.Len(t, f.removed, test.expectedRemovals) || !assert.Len(t, outcomes, test.expectedRemovals) {
+						return
+					}
+				}
+			},
+		)
+	}
+}
+
+func TestCheckWithinRoot(t *testing.T) {
+	type testCase struct {
+		description string
+		root        string
+		target      string
+		expectedOK  bool
+	}
+
+	const root = "https://fndcadoor.fnal.gov:2880/GM2/resilient/jobsub_stage"
+
+	testCases := []testCase{
+		{"Entry in the dropbox", root, root + "/abc", true},
+		{"Entry nested in the dropbox", root, root + "/.quarantine/2024-01-01/abc", true},
+		{"Root with a trailing slash", root + "/", root + "/abc", true},
+		{"Local path", "/pnfs/gm2/resilient/jobsub_stage", "/pnfs/gm2/resilient/jobsub_stage/abc", true},
+		{"Root itself", root, root, false},
+		{"Root itself with a trailing slash", root, root + "/", false},
+		{"Root itself with doubled slashes", root, root + "//", false},
+		{"Sibling with the root as a prefix", root, root + "_old/abc", false},
+		{"Parent of the root", root, "https://fndcadoor.fnal.gov:2880/GM2/resilient", false},
+		{"Different host", root, "https://otherdoor.fnal.gov:2880/GM2/resilient/jobsub_stage/abc", false},
+		{"Different scheme", root, "davs://fndcadoor.fnal.gov:2880/GM2/resilient/jobsub_stage/abc", false},
+		{"Dot dot", root, root + "/../abc", false},
+		{"Dot dot that stays inside", root, root + "/abc/../def", false},
+		{"Dot", root, root + "/./abc", false},
+		{"Encoded dot dot", root, root + "/%2e%2e/abc", false},
+		{"Encoded slash", root, root + "/abc%2Fdef", false},
+		{"Encoded backslash", root, root + "/abc%5cdef", false},
+		{"Backslash", root, root + `/abc\def`, false},
+		{"Query", root, root + "/abc?recursive=true", false},
+		{"Root of the filesystem", "https://fndcadoor.fnal.gov:2880/", "https://fndcadoor.fnal.gov:2880/abc", false},
+	}
+
+	for _, test := range testCases {
+		t.Run(
+			test.description,
+			func(t *testing.T) {
+				err := checkWithinRoot(test.root, test.target)
+				if test.expectedOK {
+					assert.NoError(t, err)
+				} else {
+					assert.ErrorIs(t, err, ErrOutsideDropbox)
+				}
+			},
+		)
+	}
+}
+
+func TestDeletionExecutorRefusesOutsideRoot(t *testing.T) {
+	f := newFlakyFileAccessor(nil)
+	d := NewDeletionExecutor(f, DeletionOptions{Workers: 1})
+	outcomes := d.Delete(context.Background(), "/dropbox", testCandidates("", "..", "a%2fb", "ok"))
+	if assert.Len(t, outcomes, 4) {
+		for _, o := range outcomes[:3] {
+			assert.ErrorIs(t, o.Err, ErrOutsideDropbox)
+			assert.Equal(t, 0, o.Attempts)
+		}
+		assert.NoError(t, outcomes[3].Err)
+	}
+	assert.Equal(t, []string{"/dropbox/ok/"}, f.removed)
+
+	// Where candidates are moved to must be within the root too
+	f = newFlakyFileAccessor(nil)
+	d = NewDeletionExecutor(f, DeletionOptions{Workers: 1, MoveTo: "/elsewhere", Root: "/dropbox"})
+	outcomes = d.Delete(context.Background(), "/dropbox", testCandidates("abc"))
+	if assert.Len(t, outcomes, 1) {
+		assert.ErrorIs(t, outcomes[0].Err, ErrOutsideDropbox)
+	}
+	assert.Empty(t, f.removed)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// TokenSources maps each experiment to the TokenSource used for its dropbox.  There is deliberately no fallback:  an
+// experiment without its own TokenSource cannot get another experiment's token.
+type TokenSources map[string]TokenSource
+
+func (t TokenSources) tokenForExperiment(ctx context.Context, experiment string) (string, error) {
+	ts, ok := t[experiment]
+	if !ok || ts == nil {
+		return "", fmt.Errorf("%w: %s", ErrNoTokenForExperiment, experiment)
+	}
+	token, err := ts.Token(ctx)
+	if err != nil {
+		return "", fmt.Errorf("could not get token for experiment %s: %w", experiment, err)
+	}
+	return token, nil
+}
+
+// GfalFileAccessor is a FileAccessor that uses the gfal2 command-line tools.  Every command gets its bearer token from
+// the experiment's TokenSource at the time it is run.
+type GfalFileAccessor struct {
+	experiment string
+	tokens     TokenSources
+}
+
+// NewGfalFileAccessor returns a GfalFileAccessor that acts on behalf of experiment, using its token from tokens
+func NewGfalFileAccessor(experiment string, tokens TokenSources) *GfalFileAccessor {
+	return &GfalFileAccessor{experiment: experiment, tokens: tokens}
+}
+
+func (g *GfalFileAccessor) getFilesList(ctx context.Context, source string) ([][]byte, error) {
+	fileListings := make([][]byte, 0)
+	err := g.streamFilesList(ctx, source, func(line []byte) error {
+		fileListings = append(fileListings, line)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fileListings, nil
+}
+
+// streamFilesList runs gfal-ls -l on the source and emits each line of its output as it is read.  gfal-ls is killed if
+// ctx is cancelled.
+func (g *GfalFileAccessor) streamFilesList(ctx context.Context, source string, emit func(line []byte) error) error {
+	cmd, err := g.command(ctx, "gfal-ls", "-l", source)
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	var emitErr error
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		// The scanner reuses its buffer, so hand over a copy
+		if emitErr = emit(bytes.Clone(scanner.Bytes())); emitErr != nil {
+			break
+		}
+	}
+	if emitErr != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return emitErr
+	}
+	if err := scanner.Err(); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	if err := cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("gfal-ls -l %s was stopped: %w", source, ctx.Err())
+		}
+		return fmt.Errorf("gfal-ls -l %s failed: %w: %s", source, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// removeFile runs gfal-rm on a single file
+func (g *GfalFileAccessor) removeFile(ctx context.Context, urlOrPath string) error {
+	return g.run(ctx, "gfal-rm", urlOrPath)
+}
+
+// removeDir runs gfal-rm -r on a directory and everything in it
+func (g *GfalFileAccessor) removeDir(ctx context.Context, urlOrPath string) error {
+	return g.run(ctx, "gfal-rm", "-r", urlOrPath)
+}
+
+// rename runs gfal-rename to move a file or directory
+func (g *GfalFileAccessor) rename(ctx context.Context, from, to string) error {
+	return g.run(ctx, "gfal-rename", from, to)
+}
+
+// makeDir runs gfal-mkdir -p to make a directory and any missing parents
+func (g *GfalFileAccessor) makeDir(ctx context.Context, urlOrPath string) error {
+	return g.run(ctx, "gfal-mkdir", "-p", urlOrPath)
+}
+
+// run runs a gfal command to completion, killing it if ctx is cancelled
+func (g *GfalFileAccessor) run(ctx context.Context, name string, args ...string) error {
+	cmd, err := g.command(ctx, name, args...)
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		commandLine := strings.Join(append([]string{name}, args...), " ")
+		if ctx.Err() != nil {
+			return fmt.Errorf("%s was stopped: %w", commandLine, ctx.Err())
+		}
+		errOutput := strings.TrimSpace(stderr.String())
+		err = fmt.Errorf("%s failed: %w: %s", commandLine, err, errOutput)
+		if gfalErrorIsTransient(errOutput) {
+			return fmt.Errorf("%w: %w", ErrTransient, err)
+		}
+		return err
+	}
+	return nil
+}
+
+var (
+	// gfalPermanentErrorRegex matches gfal error output that retrying cannot fix
+	gfalPermanentErrorRegex = regexp.MustCompile(`(?i)\b40[134]\b|forbidden|unauthori[sz]ed|not found|no such file|permission denied`)
+	// gfalTransientErrorRegex matches gfal error output for timeouts and server-side errors
+	gfalTransientErrorRegex = regexp.MustCompile(`(?i)\b5\d\d\b|timed out|timeout|connection (reset|refused)|temporarily unavailable|service unavailable`)
+)
+
+// gfalErrorIsTransient reports whether the error output of a failed gfal command means the command is worth retrying
+func gfalErrorIsTransient(errOutput string) bool {
+	return !gfalPermanentErrorRegex.MatchString(errOutput) && gfalTransientErrorRegex.MatchString(errOutput)
+}
+
+func (g *GfalFileAccessor) fileListingToFileEntry(line io.Reader) (FileEntry, error) {
+	b := new(strings.Builder)
+	if _, err := io.Copy(b, line); err != nil {
+		return FileEntry{}, err
+	}
+	entry, err := scanDropboxLineToFileEntry(strings.TrimSpace(b.String()))
+	if err != nil {
+		return FileEntry{}, err
+	}
+	return *entry, nil
+}
+
+// command sets up a gfal command with the experiment's token as BEARER_TOKEN.  Any bearer token settings inherited from
+// our own environment are dropped so that they cannot be picked up by the command instead.
+func (g *GfalFileAccessor) command(ctx context.Context, name string, args ...string) (*exec.Cmd, error) {
+	token, err := g.tokens.tokenForExperiment(ctx, g.experiment)
+	if err != nil {
+		return nil, err
+	}
+
+	env := make([]string, 0, len(os.Environ())+1)
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, "BEARER_TOKEN=") || strings.HasPrefix(kv, "BEARER_TOKEN_FILE=") {
+			continue
+		}
+		env = append(env, kv)
+	}
+	env = append(env, "BEARER_TOKEN="+token)
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = env
+	return cmd, nil
+}
+
+var ErrNoTokenForExperiment = errors.New("no token source is configured for experiment")
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// installFakeCommand writes a shell script with the given body to a temporary directory named name, and puts that
+// directory at the front of $PATH for the rest of the test
+func installFakeCommand(t *testing.T, name, body string) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+body), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestGfalFileAccessorGetFilesList(t *testing.T) {
+	tokenLog := filepath.Join(t.TempDir(), "tokens.log")
+	installFakeCommand(t, "gfal-ls", `echo "$BEARER_TOKEN|$BEARER_TOKEN_FILE" >> `+tokenLog+`
+echo "-rwxrwxrwx   0 0     0            50 Sep 26 14:55 bogus_file.out"
+echo ""
+echo "drwxrwxrwx   0 0     0             0 Apr  6  2022 bogus_dir"
+`)
+	// These must not leak into the gfal commands
+	t.Setenv("BEARER_TOKEN", "hosttoken")
+	t.Setenv("BEARER_TOKEN_FILE", "/path/to/hosttokenfile")
+
+	tokens := TokenSources{
+		"gm2":  &staticTokenSource{"gm2token"},
+		"mu2e": &staticTokenSource{"mu2etoken"},
+	}
+
+	for _, experiment := range []string{"gm2", "mu2e"} {
+		g := NewGfalFileAccessor(experiment, tokens)
+		listings, err := g.getFilesList(context.Background(), "https://fndcadoor.fnal.gov:2880/"+experiment+"/resilient/jobsub_stage")
+		assert.NoError(t, err)
+		assert.Equal(
+			t,
+			[][]byte{
+				[]byte("-rwxrwxrwx   0 0     0            50 Sep 26 14:55 bogus_file.out"),
+				[]byte("drwxrwxrwx   0 0     0             0 Apr  6  2022 bogus_dir"),
+			},
+			listings,
+		)
+	}
+
+	b, _ := os.ReadFile(tokenLog)
+	assert.Equal(t, "gm2token|\nmu2etoken|\n", string(b))
+}
+
+func TestGfalFileAccessorErrors(t *testing.T) {
+	type testCase struct {
+		description string
+		experiment  string
+		tokens      TokenSources
+		gfalLs      string
+		expectedErr error
+	}
+
+	errToken := errors.New("token error")
+
+	testCases := []testCase{
+		{
+			"No token source for experiment",
+			"nova",
+			TokenSources{"gm2": &staticTokenSource{"gm2token"}},
+			"echo shouldnotrun",
+			ErrNoTokenForExperiment,
+		},
+		{
+			"Token source fails",
+			"gm2",
+			TokenSources{"gm2": &failingTokenSource{errToken}},
+			"echo shouldnotrun",
+			errToken,
+		},
+		{
+			"gfal-ls fails",
+			"gm2",
+			TokenSources{"gm2": &staticTokenSource{"gm2token"}},
+			"echo 'Permission denied' >&2\nexit 1",
+			nil,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(
+			test.description,
+			func(t *testing.T) {
+				installFakeCommand(t, "gfal-ls", test.gfalLs)
+				g := NewGfalFileAccessor(test.experiment, test.tokens)
+				listings, err := g.getFilesList(context.Background(), "https://fndcadoor.fnal.gov:2880/dropbox")
+				assert.Error(t, err)
+				if test.expectedErr != nil {
+					assert.ErrorIs(t, err, test.expectedErr)
+				}
+				assert.Nil(t, listings)
+			},
+		)
+	}
+}
+
+func TestGfalFileAccessorFileListingToFileEntry(t *testing.T) {
+	g := NewGfalFileAccessor("gm2", TokenSources{})
+
+	entry, err := g.fileListingToFileEntry(bytes.NewReader([]byte("drwxrwxrwx   0 0     0             0 Apr  6  2022 bogus_dir\n")))
+	assert.NoError(t, err)
+	assert.Equal(t, FileEntry{"bogus_dir", time.Date(2022, 4, 6, 0, 0, 0, 0, time.Local), true, 0}, entry)
+
+	_, err = g.fileListingToFileEntry(strings.NewReader("boogityboo"))
+	assert.ErrorIs(t, err, ErrParseLine)
+}
+
+type failingTokenSource struct {
+	err error
+}
+
+func (f *failingTokenSource) Token(context.Context) (string, error) { return "", f.err }
+
+func TestGfalFileAccessorRemove(t *testing.T) {
+	argsLog := filepath.Join(t.TempDir(), "args.log")
+	installFakeCommand(t, "gfal-rm", `echo "$BEARER_TOKEN $*" >> `+argsLog+`
+case "$*" in
+*missing*) echo "No such file or directory" >&2; exit 2;;
+esac
+`)
+	g := NewGfalFileAccessor("gm2", TokenSources{"gm2": &staticTokenSource{"gm2token"}})
+	ctx := context.Background()
+
+	assert.NoError(t, g.removeFile(ctx, "https://fndcadoor.fnal.gov:2880/dropbox/file"))
+	assert.NoError(t, g.removeDir(ctx, "https://fndcadoor.fnal.gov:2880/dropbox/dir"))
+	err := g.removeFile(ctx, "https://fndcadoor.fnal.gov:2880/dropbox/missing")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "No such file or directory")
+	}
+
+	b, _ := os.ReadFile(argsLog)
+	assert.Equal(
+		t,
+		"gm2token https://fndcadoor.fnal.gov:2880/dropbox/file\n"+
+			"gm2token -r https://fndcadoor.fnal.gov:2880/dropbox/dir\n"+
+			"gm2token https://fndcadoor.fnal.gov:2880/dropbox/missing\n",
+		string(b),
+	)
+}
+
+func TestGfalFileAccessorCancellation(t *testing.T) {
+	installFakeCommand(t, "gfal-ls", "echo \"drwxrwxrwx   0 0     0             0 Apr  6  2022 bogus_dir\"\nexec sleep 30\n")
+	installFakeCommand(t, "gfal-rm", "exec sleep 30\n")
+	g := NewGfalFileAccessor("gm2", TokenSources{"gm2": &staticTokenSource{"gm2token"}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := g.getFilesList(ctx, "https://fndcadoor.fnal.gov:2880/dropbox")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	err = g.removeDir(ctx, "https://fndcadoor.fnal.gov:2880/dropbox/dir")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 10*time.Second, "the commands should have been killed")
+}
+
+func TestGfalErrorIsTransient(t *testing.T) {
+	type testCase struct {
+		description string
+		errOutput   string
+		expected    bool
+	}
+
+	testCases := []testCase{
+		{"Timeout", "gfal-rm error: 110 (Connection timed out) - Operation timed out", true},
+		{"Server error", "gfal-rm error: 5 (Input/output error) - HTTP 503 : Unexpected server error: 503", true},
+		{"Forbidden", "gfal-rm error: 13 (Permission denied) - HTTP 403 : Permission refused", false},
+		{"Not found", "gfal-rm error: 2 (No such file or directory) - HTTP 404 : File not found", false},
+		{"Unknown", "something went wrong", false},
+	}
+
+	for _, test := range testCases {
+		t.Run(
+			test.description,
+			func(t *testing.T) {
+				assert.Equal(t, test.expected, gfalErrorIsTransient(test.errOutput))
+			},
+		)
+	}
+}
+
+func TestGfalFileAccessorTransientRemoveError(t *testing.T) {
+	installFakeCommand(t, "gfal-rm", "echo 'gfal-rm error: 5 (Input/output error) - HTTP 503 : Unexpected server error: 503' >&2\nexit 5\n")
+	g := NewGfalFileAccessor("gm2", TokenSources{"gm2": &staticTokenSource{"gm2token"}})
+
+	err := g.removeDir(context.Background(), "https://fndcadoor.fnal.gov:2880/dropbox/dir")
+	assert.ErrorIs(t, err, ErrTransient)
+}
+
+func TestGfalFileAccessorRenameAndMakeDir(t *testing.T) {
+	argsLog := filepath.Join(t.TempDir(), "args.log")
+	installFakeCommand(t, "gfal-rename", `echo "gfal-rename $*" >> `+argsLog+"\n")
+	installFakeCommand(t, "gfal-mkdir", `echo "gfal-mkdir $*" >> `+argsLog+"\n")
+	g := NewGfalFileAccessor("gm2", TokenSources{"gm2": &staticTokenSource{"gm2token"}})
+	ctx := context.Background()
+
+	assert.NoError(t, g.makeDir(ctx, "https://fndcadoor.fnal.gov:2880/dropbox/.quarantine/2024-01-01"))
+	assert.NoError(t, g.rename(ctx, "https://fndcadoor.fnal.gov:2880/dropbox/dir", "https://fndcadoor.fnal.gov:2880/dropbox/.quarantine/2024-01-01/dir"))
+
+	b, _ := os.ReadFile(argsLog)
+	assert.Equal(
+		t,
+		"gfal-mkdir -p https://fndcadoor.fnal.gov:2880/dropbox/.quarantine/2024-01-01\n"+
+			"gfal-rename https://fndcadoor.fnal.gov:2880/dropbox/dir https://fndcadoor.fnal.gov:2880/dropbox/.quarantine/2024-01-01/dir\n",
+		string(b),
+	)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+var validLogFormats = []string{logFormatText, logFormatJSON}
+
+// Keys for the fields attached to log records, so that every stage of the pipeline logs them under the same names
+const (
+	logKeyRunID      = "run_id"
+	logKeyExperiment = "experiment"
+	logKeySource     = "source"
+	logKeySchedd     = "schedd"
+	logKeyJobID      = "job_id"
+	logKeyPath       = "path"
+)
+
+// jobIDAttributes are the job attributes that make up a job's ID, so that problems with a job can be logged along with
+// which job it was
+var jobIDAttributes = []string{"ClusterId", "ProcId"}
+
+type loggerKey struct{}
+
+// withLogger returns a copy of ctx that carries logger
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// loggerFrom returns the logger carried by ctx, or the default logger if it doesn't carry one.  Each stage of the
+// pipeline adds its own fields to the logger it passes on, so that records are logged with everything known about where
+// they came from.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// jobID returns the job's ID, like "1234.0", or "" if the job doesn't have the attributes it is made from
+func jobID(job map[string][]byte) string {
+	cluster, ok := job["ClusterId"]
+	if !ok {
+		return ""
+	}
+	proc, ok := job["ProcId"]
+	if !ok {
+		return string(bytes.TrimSpace(cluster))
+	}
+	return string(bytes.TrimSpace(cluster)) + "." + string(bytes.TrimSpace(proc))
+}
+
+// logOptions control the log written to stderr
+type logOptions struct {
+	level  slog.Level
+	format string
+}
+
+// logFlags adds the flags for the log to flags
+func logFlags(flags *flag.FlagSet) *logOptions {
+	o := &logOptions{level: slog.LevelInfo, format: logFormatText}
+	flags.TextVar(&o.level, "log-level", o.level, "Lowest level of log messages written to stderr: debug, info, warn or error")
+	flags.StringVar(&o.format, "log-format", o.format, "Format of the log written to stderr: "+strings.Join(validLogFormats, ", "))
+	return o
+}
+
+func (o *logOptions) validate() error {
+	if !slices.Contains(validLogFormats, o.format) {
+		return fmt.Errorf("-log-format must be one of %s", strings.Join(validLogFormats, ", "))
+	}
+	return nil
+}
+
+// newLogger returns a logger that writes to w as o says
+func (o *logOptions) newLogger(w io.Writer) *slog.Logger {
+	handlerOpts := &slog.HandlerOptions{Level: o.level}
+	if o.format == logFormatJSON {
+		return slog.New(slog.NewJSONHandler(w, handlerOpts))
+	}
+	return slog.New(slog.NewTextHandler(w, handlerOpts))
+}
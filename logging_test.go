@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The pipeline logs to the default logger unless it is given one, so keep the test output readable
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// captureLogs returns a context carrying a debug-level JSON logger, and a function that returns the records logged to
+// it so far
+func captureLogs(ctx context.Context) (context.Context, func() []map[string]any) {
+	var b bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&b, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	return withLogger(ctx, logger), func() []map[string]any {
+		records := make([]map[string]any, 0)
+		dec := json.NewDecoder(bytes.NewReader(b.Bytes()))
+		for {
+			var r map[string]any
+			if err := dec.Decode(&r); err != nil {
+				return records
+			}
+			records = append(records, r)
+		}
+	}
+}
+
+// findLogRecord returns the first record with the given message, or nil
+func findLogRecord(records []map[string]any, msg string) map[string]any {
+	for _, r := range records {
+		if r["msg"] == msg {
+			return r
+		}
+	}
+	return nil
+}
+
+func TestLoggerFrom(t *testing.T) {
+	assert.Equal(t, slog.Default(), loggerFrom(context.Background()))
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	assert.Equal(t, logger, loggerFrom(withLogger(context.Background(), logger)))
+}
+
+func TestJobID(t *testing.T) {
+	type testCase struct {
+		description string
+		job         map[string][]byte
+		expected    string
+	}
+
+	testCases := []testCase{
+		{"Cluster and proc", map[string][]byte{"ClusterId": []byte("1234"), "ProcId": []byte("5")}, "1234.5"},
+		{"Cluster only", map[string][]byte{"ClusterId": []byte("1234")}, "1234"},
+		{"Neither", map[string][]byte{"PNFS_INPUT_FILES": []byte("/dropbox/a")}, ""},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			assert.Equal(t, test.expected, jobID(test.job))
+		})
+	}
+}
+
+func TestLogFlags(t *testing.T) {
+	type testCase struct {
+		description    string
+		args           []string
+		expectedErr    bool
+		expectedRecord string
+	}
+
+	testCases := []testCase{
+		{"Defaults are info level text", []string{}, false, "level=INFO msg=hello run_id=abc\n"},
+		{"Debug level", []string{"-log-level", "debug"}, false, "level=DEBUG msg=\"debugging hello\" run_id=abc\nlevel=INFO msg=hello run_id=abc\n"},
+		{"Error level", []string{"-log-level", "error"}, false, ""},
+		{"JSON", []string{"-log-format", "json"}, false, `{"level":"INFO","msg":"hello","run_id":"abc"}` + "\n"},
+		{"Unknown format", []string{"-log-format", "xml"}, true, ""},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			flags := flag.NewFlagSet("test", flag.ContinueOnError)
+			o := logFlags(flags)
+			assert.NoError(t, flags.Parse(test.args))
+			if test.expectedErr {
+				assert.Error(t, o.validate())
+				return
+			}
+			assert.NoError(t, o.validate())
+
+			var b bytes.Buffer
+			logger := o.newLogger(&b).With(logKeyRunID, "abc")
+			logger.Debug("debugging hello")
+			logger.Info("hello")
+			// Drop the timestamps
+			var out strings.Builder
+			for _, line := range strings.SplitAfter(b.String(), "\n") {
+				if line == "" {
+					continue
+				}
+				if strings.HasPrefix(line, "{") {
+					var r map[string]any
+					assert.NoError(t, json.Unmarshal([]byte(line), &r))
+					delete(r, "time")
+					j, _ := json.Marshal(r)
+					out.Write(append(j, '\n'))
+				} else {
+					out.WriteString(line[strings.Index(line, "level="):])
+				}
+			}
+			assert.Equal(t, test.expectedRecord, out.String())
+		})
+	}
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	logFlags(flags)
+	assert.Error(t, flags.Parse([]string{"-log-level", "loud"}))
+}
+
+func TestDropboxFilesFromJobsLogsJobs(t *testing.T) {
+	ctx, records := captureLogs(context.Background())
+	schedd := NewCondorSchedd("", "", []JobFileAttribute{{"Jobsub_Tarballs", attributeFormatClassAdList}})
+	jobs := []map[string][]byte{
+		{"ClusterId": []byte("1"), "ProcId": []byte("0"), "Jobsub_Tarballs": []byte(`{"/dropbox/a"}`)},
+		{"ClusterId": []byte("2"), "ProcId": []byte("0")},
+		{"ClusterId": []byte("3"), "ProcId": []byte("1"), "Jobsub_Tarballs": []byte(`{"/dropbox/b"`)},
+	}
+	files := dropboxFilesFromJobs(ctx, schedd, jobs)
+	assert.Equal(t, []string{"/dropbox/a"}, files)
+
+	logged := records()
+	if assert.Len(t, logged, 2) {
+		assert.Equal(t, "DEBUG", logged[0]["level"])
+		assert.Equal(t, "2.0", logged[0][logKeyJobID])
+		assert.Equal(t, "WARN", logged[1]["level"])
+		assert.Equal(t, "3.1", logged[1][logKeyJobID])
+		assert.Equal(t, "could not get dropbox files from job", logged[1]["msg"])
+	}
+}
+
+func TestPipelineLogFields(t *testing.T) {
+	ctx, records := captureLogs(context.Background())
+	ctx = withLogger(ctx, loggerFrom(ctx).With(logKeyRunID, "run1"))
+
+	e := testRunExperimentConfig(t)
+	source := e.Dropbox
+	maxParseFailures := 1
+	e.Retention.MaxParseFailures = &maxParseFailures
+	old := time.Now().Add(-60 * 24 * time.Hour)
+	f := newTestFileAccessor([]FileEntry{{"stale", old, true, 0}, {"garbage", old, false, 0}}, false, []bool{false, true})
+	jobLister := &recordingJobLister{jobs: []map[string][]byte{{"ClusterId": []byte("7"), "ProcId": []byte("0")}}}
+	result := RunExperiment(ctx, e, f, []NamedJobLister{{"jobsub01.fnal.gov", jobLister}}, nil, nil, RunOptions{})
+	assert.NoError(t, result.Err)
+
+	logged := records()
+	for _, r := range logged {
+		assert.Equal(t, "run1", r[logKeyRunID], r["msg"])
+		assert.Equal(t, "gm2", r[logKeyExperiment], r["msg"])
+	}
+	if r := findLogRecord(logged, "could not parse dropbox listing line"); assert.NotNil(t, r) {
+		assert.Equal(t, source, r[logKeySource])
+		assert.Equal(t, "garbage", r["line"])
+	}
+	if r := findLogRecord(logged, "could not get dropbox files from job"); assert.NotNil(t, r) {
+		assert.Equal(t, "jobsub01.fnal.gov", r[logKeySchedd])
+		assert.Equal(t, "7.0", r[logKeyJobID])
+	}
+	if r := findLogRecord(logged, "planned cleanup"); assert.NotNil(t, r) {
+		assert.Equal(t, source, r[logKeySource])
+		assert.Equal(t, float64(1), r["candidates"])
+	}
+	if r := findLogRecord(logged, "deleted"); assert.NotNil(t, r) {
+		assert.Equal(t, entryURL(source, "stale"), r[logKeyPath])
+	}
+}
+
+func TestDeletionExecutorLogsRetries(t *testing.T) {
+	ctx, records := captureLogs(context.Background())
+	const source = "/pnfs/gm2/resilient/jobsub_stage"
+	errTimeout := errors.Join(ErrTransient, errors.New("Connection timed out"))
+	f := newFlakyFileAccessor(map[string][]error{source + "/a": {errTimeout, errTimeout}})
+	d := NewDeletionExecutor(f, DeletionOptions{MaxAttempts: 2})
+	d.sleep = func(context.Context, time.Duration) error { return nil }
+	d.Delete(ctx, source, append(testCandidates("a"), PlannedEntry{FileEntry{"../b", time.Time{}, false, 0}, DecisionDelete, ""}))
+
+	msgs := make([]string, 0)
+	for _, r := range records() {
+		msgs = append(msgs, r["level"].(string)+" "+r["msg"].(string)+" "+r[logKeyPath].(string))
+	}
+	assert.ElementsMatch(
+		t,
+		[]string{
+			"WARN could not delete, retrying " + source + "/a",
+			"ERROR could not delete " + source + "/a",
+			"ERROR refused to delete " + source + "/../b",
+		},
+		msgs,
+	)
+}
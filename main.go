@@ -2,11 +2,18 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
 	"regexp"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -33,6 +40,49 @@ drwxrwxrwx   0 0     0             0 Apr  6  2023 bogus_dir
 10) gfal-rm dir in (8)
 */
 
+const defaultConfigPath = "/etc/jobsub-pnfs-dropbox-cleanup/config.yaml"
+
+// Process exit codes
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+	// exitInterrupted means the run was stopped by a signal, so only part of it was done
+	exitInterrupted = 3
+)
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s <command> [flags]\n\nCommands:\n", filepath.Base(os.Args[0]))
+	fmt.Fprintln(w, "  run                Clean up each experiment's dropbox")
+	fmt.Fprintln(w, "  purge              Permanently delete old quarantined dropbox entries")
+	fmt.Fprintln(w, "  restore <entry>    Move a quarantined dropbox entry back into the dropbox")
+	fmt.Fprintln(w, "  validate-config    Check the config file and report every problem found in it")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage(os.Stderr)
+		os.Exit(exitUsage)
+	}
+
+	switch os.Args[1] {
+	case "run":
+		os.Exit(runRun(os.Args[2:], os.Stdout, os.Stderr))
+	case "purge":
+		os.Exit(runPurge(os.Args[2:], os.Stdout, os.Stderr))
+	case "restore":
+		os.Exit(runRestore(os.Args[2:], os.Stdout, os.Stderr))
+	case "validate-config":
+		os.Exit(runValidateConfig(os.Args[2:], os.Stdout, os.Stderr))
+	case "-h", "-help", "--help", "help":
+		usage(os.Stdout)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n", os.Args[1])
+		usage(os.Stderr)
+		os.Exit(exitUsage)
+	}
+}
+
 // "-rwxrwxrwx   0 0     0            50 Sep 26 14:55 bogus_file.out"
 // "drwxrwxrwx   0 0     0             0 Apr  6  2022 bogus_dir"
 
@@ -51,37 +101,176 @@ type FileEntry struct {
 	filename    string
 	created     time.Time
 	isDirectory bool
+	// size is the entry's size in bytes, as listed.  For directories, this is whatever the storage reports, which is
+	// usually not the size of their contents.
+	size int64
 }
 
 type FileAccessor interface {
-	getFilesList(source string) ([][]byte, error)
+	getFilesList(ctx context.Context, source string) ([][]byte, error)
 	fileListingToFileEntry(line io.Reader) (FileEntry, error)
-	// TODO
-	// removeFile(urlOrPath string) error
-	// removeDir(urlOrPath string) error
+	removeFile(ctx context.Context, urlOrPath string) error
+	removeDir(ctx context.Context, urlOrPath string) error
+	rename(ctx context.Context, from, to string) error
+	makeDir(ctx context.Context, urlOrPath string) error
 }
 
-// GetDropboxFiles uses a FileAccessor to provide a slice of the files present at the path or URL given by the source string
-func GetDropboxFiles(f FileAccessor, source string) ([]FileEntry, error) {
-	fileListings, err := f.getFilesList(source)
-	if err != nil {
+// ParseFailure records a file listing line that could not be turned into a FileEntry, along with the reason why
+type ParseFailure struct {
+	Line string
+	Err  error
+}
+
+// DropboxFiles is the result of listing a dropbox.  Entries holds the FileEntries that were successfully parsed, and
+// Failures holds the listing lines that could not be parsed.  Those lines are neither kept nor deleted knowingly, so
+// callers should report them.
+type DropboxFiles struct {
+	Entries  []FileEntry
+	Failures []ParseFailure
+}
+
+// GetDropboxFiles uses a FileAccessor to provide the files present at the path or URL given by the source string.  If more
+// than maxParseFailures listing lines cannot be parsed, GetDropboxFiles returns the partial result along with an error
+// wrapping ErrTooManyParseFailures so that the run can be aborted.  A negative maxParseFailures disables this check.
+//
+// GetDropboxFiles holds the whole listing in memory.  For very large dropboxes, use StreamDropboxFiles instead.
+func GetDropboxFiles(ctx context.Context, f FileAccessor, source string, maxParseFailures int) (*DropboxFiles, error) {
+	stream := StreamDropboxFiles(ctx, f, source, maxParseFailures)
+	result := &DropboxFiles{Entries: make([]FileEntry, 0)}
+	for entry := range stream.Entries() {
+		result.Entries = append(result.Entries, entry)
+	}
+	result.Failures = stream.Failures()
+
+	if err := stream.Err(); err != nil {
+		if errors.Is(err, ErrNoFileEntries) || errors.Is(err, ErrTooManyParseFailures) {
+			return result, err
+		}
 		return nil, err
 	}
+	return result, nil
+}
 
-	fileEntries := make([]FileEntry, 0, len(fileListings))
-	for _, listing := range fileListings {
-		if entry, err := f.fileListingToFileEntry(bytes.NewReader(listing)); err != nil {
-			// TODO log error
-			continue
-		} else {
-			fileEntries = append(fileEntries, entry)
+// listingStreamer is implemented by FileAccessors that can hand over file listing lines as the backend produces them,
+// rather than returning the whole listing at once.  streamFilesList must call emit once per line, and stop and return
+// emit's error if emit returns one.  emit blocks until the consumer is ready for the next line.
+type listingStreamer interface {
+	streamFilesList(ctx context.Context, source string, emit func(line []byte) error) error
+}
+
+// DropboxFileStream yields the FileEntries at a dropbox source as they are parsed.  Callers should range over Entries(),
+// and once that channel is closed, check Err() and Failures().  Close can be used to stop the stream early.
+type DropboxFileStream struct {
+	entries          chan FileEntry
+	stop             chan struct{}
+	stopOnce         sync.Once
+	finished         chan struct{}
+	failures         []ParseFailure
+	err              error
+	maxParseFailures int
+}
+
+// StreamDropboxFiles starts listing the source using the FileAccessor, and returns a DropboxFileStream that yields each
+// FileEntry as soon as its listing line is parsed.  Entries are handed over one at a time, so a slow consumer holds up the
+// listing rather than the listing piling up in memory.  If the FileAccessor does not implement streaming, the listing
+// is retrieved all at once with getFilesList and then streamed.  maxParseFailures has the same meaning as it does for
+// GetDropboxFiles; once it is exceeded, no more entries or failures are yielded, but the rest of the listing is still
+// read so that the error can say how many of its lines could not be parsed.  The stream stops if ctx is cancelled.
+func StreamDropboxFiles(ctx context.Context, f FileAccessor, source string, maxParseFailures int) *DropboxFileStream {
+	s := &DropboxFileStream{
+		entries:          make(chan FileEntry),
+		stop:             make(chan struct{}),
+		finished:         make(chan struct{}),
+		maxParseFailures: maxParseFailures,
+	}
+	go s.run(ctx, f, source)
+	return s
+}
+
+// Entries returns the channel on which FileEntries are sent.  It is closed when the listing is done or has failed.
+func (s *DropboxFileStream) Entries() <-chan FileEntry { return s.entries }
+
+// Failures returns the listing lines that could not be parsed.  It should only be called after Entries() is closed.
+func (s *DropboxFileStream) Failures() []ParseFailure { return s.failures }
+
+// Err returns the error that ended the stream, if any.  It should only be called after Entries() is closed.
+func (s *DropboxFileStream) Err() error { return s.err }
+
+// Close stops the stream early and waits for the listing to wind down
+func (s *DropboxFileStream) Close() {
+	s.stopOnce.Do(func() { close(s.stop) })
+	<-s.finished
+}
+
+func (s *DropboxFileStream) run(ctx context.Context, f FileAccessor, source string) {
+	defer close(s.finished)
+	defer close(s.entries)
+
+	logger := loggerFrom(ctx).With(logKeySource, source)
+	var numLines, numEntries, numFailures int
+	tooManyFailures := func() bool { return s.maxParseFailures >= 0 && numFailures > s.maxParseFailures }
+	emit := func(line []byte) error {
+		numLines++
+		entry, err := f.fileListingToFileEntry(bytes.NewReader(line))
+		if err != nil {
+			numFailures++
+			if tooManyFailures() && numFailures > s.maxParseFailures+1 {
+				return nil
+			}
+			logger.Warn("could not parse dropbox listing line", "line", string(line), "error", err)
+			s.failures = append(s.failures, ParseFailure{Line: string(line), Err: err})
+			return nil
+		}
+		if tooManyFailures() {
+			return nil
+		}
+		select {
+		case s.entries <- entry:
+			numEntries++
+			return nil
+		case <-s.stop:
+			return errStreamStopped
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
 
-	if len(fileListings) != 0 && len(fileEntries) == 0 {
-		return nil, errors.New("there was an error processing the file listings into file entries.  No file entries were generated")
+	var err error
+	if streamer, ok := f.(listingStreamer); ok {
+		err = streamer.streamFilesList(ctx, source, emit)
+	} else {
+		err = emitFilesList(ctx, f, source, emit)
 	}
-	return fileEntries, nil
+
+	switch {
+	case errors.Is(err, errStreamStopped):
+		return
+	case err != nil:
+		s.err = err
+	case tooManyFailures():
+		s.err = fmt.Errorf("%w: %d of %d lines could not be parsed (threshold %d)", ErrTooManyParseFailures, numFailures, numLines, s.maxParseFailures)
+	case numLines != 0 && numEntries == 0:
+		s.err = ErrNoFileEntries
+	}
+	if s.err != nil {
+		logger.Error("could not list dropbox", "lines", numLines, "entries", numEntries, "error", s.err)
+		return
+	}
+	logger.Debug("listed dropbox", "lines", numLines, "entries", numEntries, "parse_failures", len(s.failures))
+}
+
+// emitFilesList adapts a FileAccessor that can only return a whole listing to the streaming API
+func emitFilesList(ctx context.Context, f FileAccessor, source string, emit func(line []byte) error) error {
+	fileListings, err := f.getFilesList(ctx, source)
+	if err != nil {
+		return err
+	}
+	for _, listing := range fileListings {
+		if err := emit(listing); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func scanDropboxLineToFileEntry(line string) (*FileEntry, error) {
@@ -105,6 +294,11 @@ func scanDropboxLineToFileEntry(line string) (*FileEntry, error) {
 		return nil, ErrParseLine
 	}
 
+	f.size, err = strconv.ParseInt(lineParts[5], 10, 64)
+	if err != nil {
+		return nil, ErrParseLine
+	}
+
 	return f, nil
 }
 
@@ -150,50 +344,35 @@ func fileIsRecent(f *FileEntry) bool {
 	return now.Sub(f.created) < recentDuration
 }
 
-type CondorSchedd struct {
-}
-
-func (c *CondorSchedd) getDropboxFilesFromJob(j map[string]io.Reader) ([]string, error) {
-	attribute := "PNFS_INPUT_FILES"
-	val, ok := j[attribute]
-	if !ok {
-		return nil, ErrMissingJobDropboxFiles
-	}
-
-	b := new(strings.Builder)
-	_, err := io.Copy(b, val)
-	if err != nil {
-		return nil, err
-	}
-	rawSlice := strings.Split((b.String()), ",")
-	finalSlice := make([]string, 0, len(rawSlice))
-
-	for _, elt := range rawSlice {
-		finalSlice = append(finalSlice, strings.TrimSpace(elt))
-	}
-	return finalSlice, nil
-
-}
-
 var (
 	ErrParseLine              = errors.New("could not parse line")
 	ErrMalformedPerms         = errors.New("perms string is malformed")
 	ErrMissingJobDropboxFiles = errors.New("required job attribute is missing to get job dropbox files")
+	ErrNoFileEntries          = errors.New("there was an error processing the file listings into file entries.  No file entries were generated")
+	ErrTooManyParseFailures   = errors.New("too many file listings could not be parsed into file entries")
+	errStreamStopped          = errors.New("dropbox file stream was stopped")
 )
 
 type JobLister interface {
-	queryJobsList(attributes []string, constraint []string) (jobs []map[string][]byte, err error)
+	queryJobsList(ctx context.Context, attributes []string, constraint ClassAdExpr) (jobs []map[string][]byte, err error)
 	getDropboxFilesFromJob(job map[string]io.Reader) (files []string, err error)
 }
 
-func GetActiveFiles(j JobLister, attributes []string, constraints []string) ([]string, error) {
-	activeFiles := make([]string, 0)
+func GetActiveFiles(ctx context.Context, j JobLister, attributes []string, constraint ClassAdExpr) ([]string, error) {
 	// Run Query
-	// QueryJobsList(attribute string, ...constraints []string) ([]map[string][]byte, error)
-	jobs, err := j.queryJobsList(attributes, constraints)
+	jobs, err := j.queryJobsList(ctx, attributes, constraint)
 	if err != nil {
-		return activeFiles, err
+		loggerFrom(ctx).Error("could not query jobs", "error", err)
+		return make([]string, 0), err
 	}
+	return dropboxFilesFromJobs(ctx, j, jobs), nil
+}
+
+// dropboxFilesFromJobs uses the JobLister to get the dropbox files referenced by each of jobs.  Jobs whose files can't
+// be read are logged and skipped.
+func dropboxFilesFromJobs(ctx context.Context, j JobLister, jobs []map[string][]byte) []string {
+	logger := loggerFrom(ctx)
+	activeFiles := make([]string, 0)
 	for _, job := range jobs {
 		readerJob := make(map[string]io.Reader)
 		for k, v := range job {
@@ -202,11 +381,16 @@ func GetActiveFiles(j JobLister, attributes []string, constraints []string) ([]s
 
 		files, err := j.getDropboxFilesFromJob(readerJob)
 		if err != nil {
-			// log error
+			// Plenty of jobs don't use the dropbox at all
+			level := slog.LevelWarn
+			if errors.Is(err, ErrMissingJobDropboxFiles) {
+				level = slog.LevelDebug
+			}
+			logger.Log(ctx, level, "could not get dropbox files from job", logKeyJobID, jobID(job), "error", err)
 			continue
 		}
 
 		activeFiles = append(activeFiles, files...)
 	}
-	return activeFiles, nil
+	return activeFiles
 }
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"runtime"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -158,6 +163,7 @@ func TestScanDropboxLineToFileEntry(t *testing.T) {
 				"bogus_file.out",
 				adjustAnswerYearIfNeeded(time.Date(time.Now().Year(), 9, 26, 14, 55, 0, 0, time.Local)),
 				false,
+				50,
 			},
 		},
 		{
@@ -167,6 +173,7 @@ func TestScanDropboxLineToFileEntry(t *testing.T) {
 				"bogus_directory",
 				adjustAnswerYearIfNeeded(time.Date(time.Now().Year(), 9, 26, 14, 55, 0, 0, time.Local)),
 				true,
+				50,
 			},
 		},
 		{
@@ -176,6 +183,7 @@ func TestScanDropboxLineToFileEntry(t *testing.T) {
 				"bogus_dir",
 				adjustAnswerYearIfNeeded(time.Date(2022, 4, 6, 0, 0, 0, 0, time.Local)),
 				true,
+				0,
 			},
 		},
 	}
@@ -211,6 +219,7 @@ func TestFileIsRecent(t *testing.T) {
 				"/path/to/recent_file.txt",
 				recentDate,
 				false,
+				0,
 			},
 			true,
 		},
@@ -220,6 +229,7 @@ func TestFileIsRecent(t *testing.T) {
 				"/path/to/old_file.txt",
 				oldDate,
 				false,
+				0,
 			},
 			false,
 		},
@@ -229,6 +239,7 @@ func TestFileIsRecent(t *testing.T) {
 				"/path/to/reallyOld_file.txt",
 				reallyOldDate,
 				false,
+				0,
 			},
 			false,
 		},
@@ -327,7 +338,7 @@ type testJobLister struct {
 	files      []testFileString
 }
 
-func (jl *testJobLister) queryJobsList([]string, []string) ([]map[string][]byte, error) {
+func (jl *testJobLister) queryJobsList(context.Context, []string, ClassAdExpr) ([]map[string][]byte, error) {
 	if jl.queryError {
 		return nil, errors.New("this is an error")
 	}
@@ -407,7 +418,7 @@ func TestGetActiveFiles(t *testing.T) {
 		t.Run(
 			test.description,
 			func(t *testing.T) {
-				files, err := GetActiveFiles(test.jobLister, test.attributes, []string{})
+				files, err := GetActiveFiles(context.Background(), test.jobLister, test.attributes, nil)
 				if test.shouldError {
 					assert.Error(t, err)
 				}
@@ -425,23 +436,81 @@ func newTestFileAccessor(files []FileEntry, existsFileListingError bool, errorsB
 	}
 }
 
+var errTestFileListing = errors.New("some generic file listing error")
+
 type testFileAccessor struct {
 	fileEntries            []FileEntry
 	existsFileListingError bool
 	errorsByFileEntry      []bool
+	// removed records every removeFile, removeDir, and rename call, with directories suffixed by "/"
+	removed   []string
+	madeDirs  []string
+	removedMu sync.Mutex
+	// removeErrs are returned by removeFile and removeDir for the given URLs
+	removeErrs map[string]error
+	// onRemove, if set, is called before each removal
+	onRemove func(urlOrPath string)
+	// removeDelay is how long each removal takes, unless its context is cancelled first
+	removeDelay time.Duration
+	// contents are what listing each directory URL returns.  Listing any other URL that ends in one of fileEntries
+	// returns nothing, and listing anything else returns fileEntries.
+	contents map[string][]FileEntry
 }
 
-func (t *testFileAccessor) getFilesList(source string) ([][]byte, error) {
+func (t *testFileAccessor) getFilesList(ctx context.Context, source string) ([][]byte, error) {
 	if t.existsFileListingError {
-		return nil, errors.New("some generic file listing error")
+		return nil, errTestFileListing
 	}
-	returnSlice := make([][]byte, 0, len(t.fileEntries))
-	for _, entry := range t.fileEntries {
+	entries := t.fileEntries
+	if contents, ok := t.contents[source]; ok {
+		entries = contents
+	} else if slices.ContainsFunc(t.fileEntries, func(e FileEntry) bool { return strings.HasSuffix(source, "/"+e.filename) }) {
+		entries = nil
+	}
+	returnSlice := make([][]byte, 0, len(entries))
+	for _, entry := range entries {
 		returnSlice = append(returnSlice, []byte(entry.filename))
 	}
 	return returnSlice, nil
 }
 
+func (t *testFileAccessor) removeFile(ctx context.Context, urlOrPath string) error {
+	return t.remove(ctx, urlOrPath, urlOrPath)
+}
+
+func (t *testFileAccessor) removeDir(ctx context.Context, urlOrPath string) error {
+	return t.remove(ctx, urlOrPath, urlOrPath+"/")
+}
+
+// rename records moves as "from -> to"
+func (t *testFileAccessor) rename(ctx context.Context, from, to string) error {
+	return t.remove(ctx, from, from+" -> "+to)
+}
+
+func (t *testFileAccessor) makeDir(ctx context.Context, urlOrPath string) error {
+	t.removedMu.Lock()
+	defer t.removedMu.Unlock()
+	t.madeDirs = append(t.madeDirs, urlOrPath)
+	return nil
+}
+
+func (t *testFileAccessor) remove(ctx context.Context, urlOrPath, record string) error {
+	if t.onRemove != nil {
+		t.onRemove(urlOrPath)
+	}
+	t.removedMu.Lock()
+	t.removed = append(t.removed, record)
+	t.removedMu.Unlock()
+	if t.removeDelay > 0 {
+		select {
+		case <-time.After(t.removeDelay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return t.removeErrs[urlOrPath]
+}
+
 func (t *testFileAccessor) fileListingToFileEntry(r io.Reader) (FileEntry, error) {
 	var b strings.Builder
 	io.Copy(&b, r)
@@ -454,6 +523,13 @@ func (t *testFileAccessor) fileListingToFileEntry(r io.Reader) (FileEntry, error
 			return entry, nil
 		}
 	}
+	for _, contents := range t.contents {
+		for _, entry := range contents {
+			if entry.filename == filename {
+				return entry, nil
+			}
+		}
+	}
 	return FileEntry{}, errors.New("File not found in testFileAccessor")
 }
 
@@ -461,8 +537,10 @@ func TestGetDropboxFiles(t *testing.T) {
 	type testCase struct {
 		description string
 		FileAccessor
+		maxParseFailures int
 		expectedFiles    []FileEntry
-		expectedErrorNil bool
+		expectedFailures int
+		expectedErr      error
 	}
 
 	testCases := []testCase{
@@ -474,37 +552,45 @@ func TestGetDropboxFiles(t *testing.T) {
 						"/path/to/foo",
 						time.Date(2023, 4, 5, 6, 54, 32, 0, time.Local),
 						false,
+						0,
 					},
 					{"/path/to/bardir",
 						time.Date(2023, 1, 2, 3, 45, 6, 0, time.Local),
 						true,
+						0,
 					},
 					{
 						"/more/sub/dir/paths/to/baz",
 						time.Date(2023, 5, 6, 7, 12, 34, 0, time.Local),
 						false,
+						0,
 					},
 				},
 				false,
 				[]bool{false, false, false},
 			),
+			0,
 			[]FileEntry{
 				{
 					"/path/to/foo",
 					time.Date(2023, 4, 5, 6, 54, 32, 0, time.Local),
 					false,
+					0,
 				},
 				{"/path/to/bardir",
 					time.Date(2023, 1, 2, 3, 45, 6, 0, time.Local),
 					true,
+					0,
 				},
 				{
 					"/more/sub/dir/paths/to/baz",
 					time.Date(2023, 5, 6, 7, 12, 34, 0, time.Local),
 					false,
+					0,
 				},
 			},
-			true,
+			0,
+			nil,
 		},
 		{
 			"Mix of files and dirs, listing error",
@@ -514,22 +600,27 @@ func TestGetDropboxFiles(t *testing.T) {
 						"/path/to/foo",
 						time.Date(2023, 4, 5, 6, 54, 32, 0, time.Local),
 						false,
+						0,
 					},
 					{"/path/to/bardir",
 						time.Date(2023, 1, 2, 3, 45, 6, 0, time.Local),
 						true,
+						0,
 					},
 					{
 						"/more/sub/dir/paths/to/baz",
 						time.Date(2023, 5, 6, 7, 12, 34, 0, time.Local),
 						false,
+						0,
 					},
 				},
 				true,
 				[]bool{false, true, false},
 			),
+			0,
 			nil,
-			false,
+			0,
+			errTestFileListing,
 		},
 		{
 			"Mix of files and dirs, lines-to-fileEntry errors in some cases",
@@ -539,33 +630,71 @@ func TestGetDropboxFiles(t *testing.T) {
 						"/path/to/foo",
 						time.Date(2023, 4, 5, 6, 54, 32, 0, time.Local),
 						false,
+						0,
 					},
 					{"/path/to/bardir",
 						time.Date(2023, 1, 2, 3, 45, 6, 0, time.Local),
 						true,
+						0,
 					},
 					{
 						"/more/sub/dir/paths/to/baz",
 						time.Date(2023, 5, 6, 7, 12, 34, 0, time.Local),
 						false,
+						0,
 					},
 				},
 				false,
 				[]bool{false, true, false},
 			),
+			1,
 			[]FileEntry{
 				{
 					"/path/to/foo",
 					time.Date(2023, 4, 5, 6, 54, 32, 0, time.Local),
 					false,
+					0,
 				},
 				{
 					"/more/sub/dir/paths/to/baz",
 					time.Date(2023, 5, 6, 7, 12, 34, 0, time.Local),
 					false,
+					0,
 				},
 			},
-			true,
+			1,
+			nil,
+		},
+		{
+			"Mix of files and dirs, lines-to-fileEntry errors exceed threshold",
+			newTestFileAccessor(
+				[]FileEntry{
+					{
+						"/path/to/foo",
+						time.Date(2023, 4, 5, 6, 54, 32, 0, time.Local),
+						false,
+						0,
+					},
+					{"/path/to/bardir",
+						time.Date(2023, 1, 2, 3, 45, 6, 0, time.Local),
+						true,
+						0,
+					},
+				},
+				false,
+				[]bool{false, true},
+			),
+			0,
+			[]FileEntry{
+				{
+					"/path/to/foo",
+					time.Date(2023, 4, 5, 6, 54, 32, 0, time.Local),
+					false,
+					0,
+				},
+			},
+			1,
+			ErrTooManyParseFailures,
 		},
 		{
 			"Mix of files and dirs, lines-to-fileEntry errors in all cases",
@@ -575,22 +704,27 @@ func TestGetDropboxFiles(t *testing.T) {
 						"/path/to/foo",
 						time.Date(2023, 4, 5, 6, 54, 32, 0, time.Local),
 						false,
+						0,
 					},
 					{"/path/to/bardir",
 						time.Date(2023, 1, 2, 3, 45, 6, 0, time.Local),
 						true,
+						0,
 					},
 					{
 						"/more/sub/dir/paths/to/baz",
 						time.Date(2023, 5, 6, 7, 12, 34, 0, time.Local),
 						false,
+						0,
 					},
 				},
 				false,
 				[]bool{true, true, true},
 			),
-			nil,
-			false,
+			-1,
+			[]FileEntry{},
+			3,
+			ErrNoFileEntries,
 		},
 	}
 
@@ -598,11 +732,19 @@ func TestGetDropboxFiles(t *testing.T) {
 		t.Run(
 			test.description,
 			func(t *testing.T) {
-				files, err := GetDropboxFiles(test.FileAccessor, "")
-				if !test.expectedErrorNil {
-					assert.Error(t, err)
+				result, err := GetDropboxFiles(context.Background(), test.FileAccessor, "", test.maxParseFailures)
+				assert.ErrorIs(t, err, test.expectedErr)
+
+				if test.expectedFiles == nil {
+					assert.Nil(t, result)
+					return
+				}
+				assert.Equal(t, test.expectedFiles, result.Entries)
+				assert.Len(t, result.Failures, test.expectedFailures)
+				for _, failure := range result.Failures {
+					assert.NotEmpty(t, failure.Line)
+					assert.Error(t, failure.Err)
 				}
-				assert.Equal(t, test.expectedFiles, files)
 			},
 		)
 	}
@@ -613,3 +755,243 @@ func TestGetDropboxFiles(t *testing.T) {
 // * Test that checks *condorSchedd.queryJobsList
 // * Test that checks *gfalList.getFilesList
 // * Test that checks *gfalList.fileListingToFileEntry
+
+// testStreamingFileAccessor is a testFileAccessor that also implements listingStreamer.  It records how many lines it has
+// handed over so that tests can check that the listing does not run ahead of the consumer.
+type testStreamingFileAccessor struct {
+	*testFileAccessor
+	linesEmitted atomic.Int64
+}
+
+func (t *testStreamingFileAccessor) streamFilesList(ctx context.Context, source string, emit func([]byte) error) error {
+	if t.existsFileListingError {
+		return errTestFileListing
+	}
+	for _, entry := range t.fileEntries {
+		t.linesEmitted.Add(1)
+		if err := emit([]byte(entry.filename)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestStreamDropboxFiles(t *testing.T) {
+	type testCase struct {
+		description      string
+		fileAccessor     FileAccessor
+		maxParseFailures int
+		expectedFiles    []FileEntry
+		expectedFailures int
+		expectedErr      error
+	}
+
+	entries := []FileEntry{
+		{"/path/to/foo", time.Date(2023, 4, 5, 6, 54, 32, 0, time.Local), false, 0},
+		{"/path/to/bardir", time.Date(2023, 1, 2, 3, 45, 6, 0, time.Local), true, 0},
+		{"/more/sub/dir/paths/to/baz", time.Date(2023, 5, 6, 7, 12, 34, 0, time.Local), false, 0},
+	}
+
+	testCases := []testCase{
+		{
+			"Streaming accessor, no errors",
+			&testStreamingFileAccessor{testFileAccessor: newTestFileAccessor(entries, false, []bool{false, false, false})},
+			0,
+			entries,
+			0,
+			nil,
+		},
+		{
+			"Streaming accessor, listing error",
+			&testStreamingFileAccessor{testFileAccessor: newTestFileAccessor(entries, true, []bool{false, false, false})},
+			0,
+			[]FileEntry{},
+			0,
+			errTestFileListing,
+		},
+		{
+			"Streaming accessor, parse error under threshold",
+			&testStreamingFileAccessor{testFileAccessor: newTestFileAccessor(entries, false, []bool{false, true, false})},
+			1,
+			[]FileEntry{entries[0], entries[2]},
+			1,
+			nil,
+		},
+		{
+			"Streaming accessor, parse error over threshold stops yielding entries",
+			&testStreamingFileAccessor{testFileAccessor: newTestFileAccessor(entries, false, []bool{false, true, false})},
+			0,
+			[]FileEntry{entries[0]},
+			1,
+			ErrTooManyParseFailures,
+		},
+		{
+			"Streaming accessor, all parse errors",
+			&testStreamingFileAccessor{testFileAccessor: newTestFileAccessor(entries, false, []bool{true, true, true})},
+			-1,
+			[]FileEntry{},
+			3,
+			ErrNoFileEntries,
+		},
+		{
+			"Non-streaming accessor falls back to getFilesList",
+			newTestFileAccessor(entries, false, []bool{false, false, false}),
+			0,
+			entries,
+			0,
+			nil,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(
+			test.description,
+			func(t *testing.T) {
+				stream := StreamDropboxFiles(context.Background(), test.fileAccessor, "", test.maxParseFailures)
+				files := make([]FileEntry, 0)
+				for entry := range stream.Entries() {
+					files = append(files, entry)
+				}
+				assert.ErrorIs(t, stream.Err(), test.expectedErr)
+				assert.Equal(t, test.expectedFiles, files)
+				assert.Len(t, stream.Failures(), test.expectedFailures)
+			},
+		)
+	}
+}
+
+func TestStreamDropboxFilesTooManyParseFailures(t *testing.T) {
+	entries := []FileEntry{
+		{"/path/to/foo", time.Now(), false, 0},
+		{"/path/to/bardir", time.Now(), true, 0},
+		{"/path/to/baz", time.Now(), false, 0},
+	}
+	f := &testStreamingFileAccessor{testFileAccessor: newTestFileAccessor(entries, false, []bool{true, false, true})}
+
+	stream := StreamDropboxFiles(context.Background(), f, "", 0)
+	files := make([]FileEntry, 0)
+	for entry := range stream.Entries() {
+		files = append(files, entry)
+	}
+	assert.Empty(t, files)
+	// Only the failures up to the one that crossed the threshold are kept, but all of them are counted
+	assert.Len(t, stream.Failures(), 1)
+	if assert.ErrorIs(t, stream.Err(), ErrTooManyParseFailures) {
+		assert.Contains(t, stream.Err().Error(), "2 of 3 lines could not be parsed (threshold 0)")
+	}
+}
+
+func TestStreamDropboxFilesBackpressure(t *testing.T) {
+	entries := make([]FileEntry, 0, 100)
+	for i := 0; i < 100; i++ {
+		entries = append(entries, FileEntry{fmt.Sprintf("/path/to/file%d", i), time.Now(), false, 0})
+	}
+	f := &testStreamingFileAccessor{testFileAccessor: newTestFileAccessor(entries, false, make([]bool, len(entries)))}
+
+	stream := StreamDropboxFiles(context.Background(), f, "", 0)
+	for i := 0; i < 10; i++ {
+		<-stream.Entries()
+	}
+	// Give the producer a chance to run ahead if it were going to
+	time.Sleep(10 * time.Millisecond)
+	// The producer can have read at most one line beyond what we've consumed:  the one it is blocked trying to send
+	assert.LessOrEqual(t, f.linesEmitted.Load(), int64(11))
+
+	stream.Close()
+	assert.NoError(t, stream.Err())
+	assert.Less(t, f.linesEmitted.Load(), int64(len(entries)))
+	_, ok := <-stream.Entries()
+	assert.False(t, ok)
+}
+
+// generatedFileAccessor synthesizes a gfal-ls style listing of numLines directories on the fly
+type generatedFileAccessor struct {
+	numLines int
+}
+
+func (b *generatedFileAccessor) getFilesList(ctx context.Context, source string) ([][]byte, error) {
+	listing := make([][]byte, 0, b.numLines)
+	err := b.streamFilesList(ctx, source, func(line []byte) error {
+		listing = append(listing, line)
+		return nil
+	})
+	return listing, err
+}
+
+func (b *generatedFileAccessor) streamFilesList(ctx context.Context, source string, emit func([]byte) error) error {
+	for i := 0; i < b.numLines; i++ {
+		line := fmt.Appendf(nil, "drwxrwxrwx   0 0     0             0 Apr  6  2022 %064x", i)
+		if err := emit(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *generatedFileAccessor) removeFile(context.Context, string) error { return nil }
+
+func (b *generatedFileAccessor) removeDir(context.Context, string) error { return nil }
+
+func (b *generatedFileAccessor) rename(context.Context, string, string) error { return nil }
+
+func (b *generatedFileAccessor) makeDir(context.Context, string) error { return nil }
+
+func (b *generatedFileAccessor) fileListingToFileEntry(r io.Reader) (FileEntry, error) {
+	line, err := io.ReadAll(r)
+	if err != nil {
+		return FileEntry{}, err
+	}
+	entry, err := scanDropboxLineToFileEntry(string(line))
+	if err != nil {
+		return FileEntry{}, err
+	}
+	return *entry, nil
+}
+
+// heapInUse returns the bytes of heap in use after a garbage collection
+func heapInUse() uint64 {
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+// TestStreamDropboxFilesMemory checks that neither listing a dropbox nor planning it holds on to memory in proportion
+// to the size of the dropbox, as long as nothing in it is to be deleted
+func TestStreamDropboxFilesMemory(t *testing.T) {
+	// streamed is the heap in use halfway through consuming a listing of numLines, and planned is the heap held by the
+	// plan of the listing
+	measure := func(numLines int) (streamed, planned int64) {
+		f := &generatedFileAccessor{numLines: numLines}
+
+		baseline := heapInUse()
+		stream := StreamDropboxFiles(context.Background(), f, "", 0)
+		count := 0
+		for range stream.Entries() {
+			count++
+			if count == numLines/2 {
+				streamed = int64(heapInUse()) - int64(baseline)
+			}
+		}
+		if stream.Err() != nil || count != numLines {
+			t.Fatalf("stream failed after %d entries: %s", count, stream.Err())
+		}
+
+		// Everything in the generated listing is kept
+		baseline = heapInUse()
+		plan, err := NewPlanner(100*365*24*time.Hour, nil).PlanStream(StreamDropboxFiles(context.Background(), f, "", 0))
+		if err != nil || plan.Scanned != numLines {
+			t.Fatalf("planning failed: %s", err)
+		}
+		planned = int64(heapInUse()) - int64(baseline)
+		runtime.KeepAlive(plan)
+		return streamed, planned
+	}
+
+	// Holding on to each of the extra entries would take several megabytes
+	const limit = 1 << 20
+	smallStreamed, smallPlanned := measure(2000)
+	largeStreamed, largePlanned := measure(20000)
+	assert.Less(t, largeStreamed-smallStreamed, int64(limit), "listing memory grows with the number of lines")
+	assert.Less(t, largePlanned-smallPlanned, int64(limit), "plan memory grows with the number of lines")
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// metricsPrefix starts the name of every exported metric
+	metricsPrefix = "jobsub_dropbox_cleanup_"
+	// metricsJobName is the job label the metrics are pushed to the pushgateway under
+	metricsJobName = "jobsub_pnfs_dropbox_cleanup"
+	// metricsContentType is the Prometheus text exposition format
+	metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+	metricsPushTimeout = 30 * time.Second
+)
+
+// RunMetrics are the Prometheus metrics for one cleanup run.  Each export replaces the last, so what the run did is
+// exported as gauges named for the last run rather than as counters, which Prometheus would expect to only ever go up.
+type RunMetrics struct {
+	// Experiments are all of the configured experiments, including any that were never run
+	Experiments []string
+	Results     []*RunResult
+	Duration    time.Duration
+	// State is the run state after this run was recorded in it.  It holds the time of each experiment's last
+	// successful run, which may well be from before this one.
+	State *RunState
+	Now   time.Time
+}
+
+// metricFamily is a metric and all of its samples, in the text exposition format
+type metricFamily struct {
+	name       string
+	help       string
+	metricType string
+	samples    []metricSample
+}
+
+type metricSample struct {
+	// labels alternates label names and values
+	labels []string
+	value  float64
+}
+
+func (f *metricFamily) add(value float64, labels ...string) {
+	f.samples = append(f.samples, metricSample{labels, value})
+}
+
+func (f *metricFamily) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s%s %s\n", metricsPrefix, f.name, f.help)
+	fmt.Fprintf(w, "# TYPE %s%s %s\n", metricsPrefix, f.name, f.metricType)
+	for _, s := range f.samples {
+		fmt.Fprintf(w, "%s%s", metricsPrefix, f.name)
+		if len(s.labels) > 0 {
+			pairs := make([]string, 0, len(s.labels)/2)
+			for i := 0; i+1 < len(s.labels); i += 2 {
+				pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", s.labels[i], escapeLabelValue(s.labels[i+1])))
+			}
+			fmt.Fprintf(w, "{%s}", strings.Join(pairs, ","))
+		}
+		fmt.Fprintf(w, " %s\n", strconv.FormatFloat(s.value, 'f', -1, 64))
+	}
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+// families builds the metric families for the run
+func (m *RunMetrics) families() []*metricFamily {
+	scanned := &metricFamily{name: "entries_scanned_last_run", help: "Dropbox entries listed by the last run.", metricType: "gauge"}
+	deleted := &metricFamily{name: "entries_deleted_last_run", help: "Dropbox entries deleted or quarantined by the last run.", metricType: "gauge"}
+	failed := &metricFamily{name: "entries_failed_last_run", help: "Dropbox entries that the last run failed to delete.", metricType: "gauge"}
+	reclaimed := &metricFamily{name: "bytes_reclaimed_last_run", help: "Bytes reclaimed by the last run, counting deleted directories by their contents.", metricType: "gauge"}
+	scheddErrors := &metricFamily{name: "schedd_query_errors_last_run", help: "Schedd queries that failed during the last run.", metricType: "gauge"}
+	success := &metricFamily{name: "success", help: "Whether the experiment's cleanup succeeded in the run.", metricType: "gauge"}
+	lastSuccess := &metricFamily{name: "last_success_timestamp_seconds", help: "When the experiment's cleanup last succeeded.", metricType: "gauge"}
+	duration := &metricFamily{name: "run_duration_seconds", help: "How long the run took.", metricType: "gauge"}
+	lastRun := &metricFamily{name: "last_run_timestamp_seconds", help: "When the run finished.", metricType: "gauge"}
+
+	results := make(map[string]*RunResult, len(m.Results))
+	for _, r := range m.Results {
+		results[r.Experiment] = r
+	}
+	rows := make(map[string]SummaryRow, len(m.Results))
+	for _, row := range Summarize(NewReport(m.Results, m.Now)) {
+		rows[row.Experiment] = row
+	}
+
+	for _, e := range m.Experiments {
+		r, ran := results[e]
+		row := rows[e]
+		scanned.add(float64(row.Scanned), "experiment", e)
+		deleted.add(float64(row.Deleted), "experiment", e)
+		failed.add(float64(row.Failed), "experiment", e)
+		reclaimed.add(float64(row.BytesReclaimed), "experiment", e)
+		if ran && r.Plan != nil {
+			for _, s := range r.Plan.ScheddStats {
+				queryErrors := 0.0
+				if s.Err != nil {
+					queryErrors = 1
+				}
+				scheddErrors.add(queryErrors, "experiment", e, "schedd", s.Schedd)
+			}
+		}
+		ok := 0.0
+		if ran && r.Err == nil && !r.Interrupted {
+			ok = 1
+		}
+		success.add(ok, "experiment", e)
+		if previous := m.State.previous(e); previous != nil {
+			lastSuccess.add(float64(previous.Time.Unix()), "experiment", e)
+		}
+	}
+	duration.add(m.Duration.Seconds())
+	lastRun.add(float64(m.Now.Unix()))
+
+	return []*metricFamily{scanned, deleted, failed, reclaimed, scheddErrors, success, lastSuccess, duration, lastRun}
+}
+
+// WriteTo writes the metrics to w in the Prometheus text exposition format
+func (m *RunMetrics) WriteTo(w io.Writer) (int64, error) {
+	var b bytes.Buffer
+	for _, f := range m.families() {
+		if len(f.samples) > 0 {
+			f.write(&b)
+		}
+	}
+	return b.WriteTo(w)
+}
+
+// WriteMetricsTextfile writes m to path for node_exporter's textfile collector.  The file is written under a temporary
+// name and renamed into place, so the collector never reads a partial file.
+func WriteMetricsTextfile(path string, m *RunMetrics) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := m.WriteTo(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// PushMetrics pushes m to the pushgateway at gatewayURL, replacing whatever the last run pushed
+func PushMetrics(ctx context.Context, client *http.Client, gatewayURL string, m *RunMetrics) error {
+	var body bytes.Buffer
+	if _, err := m.WriteTo(&body); err != nil {
+		return err
+	}
+	pushURL := strings.TrimSuffix(gatewayURL, "/") + "/metrics/job/" + url.PathEscape(metricsJobName)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, pushURL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", metricsContentType)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("pushgateway returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// metricsOptions are where a run's metrics are exported to.  Either or both may be empty.
+type metricsOptions struct {
+	textfile    string
+	pushgateway string
+}
+
+// metricsFlags adds the flags for exporting metrics to flags
+func metricsFlags(flags *flag.FlagSet) *metricsOptions {
+	o := new(metricsOptions)
+	flags.StringVar(&o.textfile, "metrics-textfile", "", "Write Prometheus metrics to this file for node_exporter's textfile collector")
+	flags.StringVar(&o.pushgateway, "metrics-pushgateway", "", "Push Prometheus metrics to the pushgateway at this URL")
+	return o
+}
+
+// export writes or pushes m to wherever o says.  Pushing isn't stopped by ctx being cancelled, since an interrupted
+// run is exactly the kind that should be reported.
+func (o *metricsOptions) export(ctx context.Context, m *RunMetrics) error {
+	var errs []error
+	if o.textfile != "" {
+		if err := WriteMetricsTextfile(o.textfile, m); err != nil {
+			errs = append(errs, fmt.Errorf("could not write metrics to %s: %w", o.textfile, err))
+		}
+	}
+	if o.pushgateway != "" {
+		pushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), metricsPushTimeout)
+		defer cancel()
+		if err := PushMetrics(pushCtx, http.DefaultClient, o.pushgateway, m); err != nil {
+			errs = append(errs, fmt.Errorf("could not push metrics to %s: %w", o.pushgateway, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testRunMetrics() *RunMetrics {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	old := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	const source = "/pnfs/gm2/resilient/jobsub_stage"
+	deleted := PlannedEntry{FileEntry{"stale", old, true, 512}, DecisionDelete, "older than 720h0m0s and not referenced by any job"}
+	failed := PlannedEntry{FileEntry{"stale.tar", old, false, 1024}, DecisionDelete, "older than 720h0m0s and not referenced by any job"}
+	return &RunMetrics{
+		Experiments: []string{"gm2", "mu2e", "no\"va"},
+		Results: []*RunResult{
+			{
+				Experiment: "gm2",
+				Plan: withTestEntries(
+					&Plan{
+						Experiment: "gm2",
+						Source:     source,
+						ScheddStats: []ScheddQueryStats{
+							{"schedd01.fnal.gov", time.Second, 2, 2, nil},
+							{"schedd02.fnal.gov", time.Second, 0, 0, errors.New("timed out")},
+						},
+					},
+					PlannedEntry{FileEntry{"recent", now.Add(-time.Hour), true, 512}, DecisionKeepRecent, "newer than 720h0m0s"},
+					deleted,
+					failed,
+				),
+				Outcomes: []DeletionOutcome{
+					{deleted, source + "/stale", "", 1, 4096, nil},
+					{failed, source + "/stale.tar", "", 3, 0, errors.New("gfal-rm failed")},
+				},
+				Err: errors.New("1 of 2 deletions failed"),
+			},
+			{
+				Experiment: "mu2e",
+				Plan:       &Plan{Experiment: "mu2e", Source: "/pnfs/mu2e/resilient/jobsub_stage", Entries: []PlannedEntry{}},
+			},
+			{Experiment: "no\"va", Err: errors.New("token has expired")},
+		},
+		Duration: 90 * time.Second,
+		State: &RunState{Experiments: map[string]ExperimentRunState{
+			"gm2":  {Time: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+			"mu2e": {Time: now},
+		}},
+		Now: now,
+	}
+}
+
+const testRunMetricsText = `# HELP jobsub_dropbox_cleanup_entries_scanned_last_run Dropbox entries listed by the last run.
+# TYPE jobsub_dropbox_cleanup_entries_scanned_last_run gauge
+jobsub_dropbox_cleanup_entries_scanned_last_run{experiment="gm2"} 3
+jobsub_dropbox_cleanup_entries_scanned_last_run{experiment="mu2e"} 0
+jobsub_dropbox_cleanup_entries_scanned_last_run{experiment="no\"va"} 0
+# HELP jobsub_dropbox_cleanup_entries_deleted_last_run Dropbox entries deleted or quarantined by the last run.
+# TYPE jobsub_dropbox_cleanup_entries_deleted_last_run gauge
+jobsub_dropbox_cleanup_entries_deleted_last_run{experiment="gm2"} 1
+jobsub_dropbox_cleanup_entries_deleted_last_run{experiment="mu2e"} 0
+jobsub_dropbox_cleanup_entries_deleted_last_run{experiment="no\"va"} 0
+# HELP jobsub_dropbox_cleanup_entries_failed_last_run Dropbox entries that the last run failed to delete.
+# TYPE jobsub_dropbox_cleanup_entries_failed_last_run gauge
+jobsub_dropbox_cleanup_entries_failed_last_run{experiment="gm2"} 1
+jobsub_dropbox_cleanup_entries_failed_last_run{experiment="mu2e"} 0
+jobsub_dropbox_cleanup_entries_failed_last_run{experiment="no\"va"} 0
+# HELP jobsub_dropbox_cleanup_bytes_reclaimed_last_run Bytes reclaimed by the last run, counting deleted directories by their contents.
+# TYPE jobsub_dropbox_cleanup_bytes_reclaimed_last_run gauge
+jobsub_dropbox_cleanup_bytes_reclaimed_last_run{experiment="gm2"} 4096
+jobsub_dropbox_cleanup_bytes_reclaimed_last_run{experiment="mu2e"} 0
+jobsub_dropbox_cleanup_bytes_reclaimed_last_run{experiment="no\"va"} 0
+# HELP jobsub_dropbox_cleanup_schedd_query_errors_last_run Schedd queries that failed during the last run.
+# TYPE jobsub_dropbox_cleanup_schedd_query_errors_last_run gauge
+jobsub_dropbox_cleanup_schedd_query_errors_last_run{experiment="gm2",schedd="schedd01.fnal.gov"} 0
+jobsub_dropbox_cleanup_schedd_query_errors_last_run{experiment="gm2",schedd="schedd02.fnal.gov"} 1
+# HELP jobsub_dropbox_cleanup_success Whether the experiment's cleanup succeeded in the run.
+# TYPE jobsub_dropbox_cleanup_success gauge
+jobsub_dropbox_cleanup_success{experiment="gm2"} 0
+jobsub_dropbox_cleanup_success{experiment="mu2e"} 1
+jobsub_dropbox_cleanup_success{experiment="no\"va"} 0
+# HELP jobsub_dropbox_cleanup_last_success_timestamp_seconds When the experiment's cleanup last succeeded.
+# TYPE jobsub_dropbox_cleanup_last_success_timestamp_seconds gauge
+jobsub_dropbox_cleanup_last_success_timestamp_seconds{experiment="gm2"} 1706745600
+jobsub_dropbox_cleanup_last_success_timestamp_seconds{experiment="mu2e"} 1709294400
+# HELP jobsub_dropbox_cleanup_run_duration_seconds How long the run took.
+# TYPE jobsub_dropbox_cleanup_run_duration_seconds gauge
+jobsub_dropbox_cleanup_run_duration_seconds 90
+# HELP jobsub_dropbox_cleanup_last_run_timestamp_seconds When the run finished.
+# TYPE jobsub_dropbox_cleanup_last_run_timestamp_seconds gauge
+jobsub_dropbox_cleanup_last_run_timestamp_seconds 1709294400
+`
+
+func TestRunMetricsWriteTo(t *testing.T) {
+	var b bytes.Buffer
+	n, err := testRunMetrics().WriteTo(&b)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(b.Len()), n)
+	assert.Equal(t, testRunMetricsText, b.String())
+}
+
+func TestEscapeLabelValue(t *testing.T) {
+	assert.Equal(t, `a\\b\"c\nd`, escapeLabelValue("a\\b\"c\nd"))
+}
+
+func TestWriteMetricsTextfile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "jobsub_dropbox_cleanup.prom")
+	assert.NoError(t, os.WriteFile(path, []byte("stale\n"), 0o600))
+
+	assert.NoError(t, WriteMetricsTextfile(path, testRunMetrics()))
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, testRunMetricsText, string(data))
+	info, err := os.Stat(path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0o644), info.Mode().Perm())
+	}
+	files, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1, "temporary file was left behind")
+
+	assert.Error(t, WriteMetricsTextfile(filepath.Join(dir, "missing", "metrics.prom"), testRunMetrics()))
+}
+
+func TestPushMetrics(t *testing.T) {
+	type testCase struct {
+		description string
+		status      int
+		expectedErr bool
+	}
+
+	testCases := []testCase{
+		{"Pushgateway accepts the metrics", http.StatusOK, false},
+		{"Pushgateway accepts the metrics with no content", http.StatusAccepted, false},
+		{"Pushgateway rejects the metrics", http.StatusBadRequest, true},
+		{"Pushgateway is broken", http.StatusInternalServerError, true},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			var method, path, contentType, body string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				method, path, contentType = r.Method, r.URL.Path, r.Header.Get("Content-Type")
+				b, _ := io.ReadAll(r.Body)
+				body = string(b)
+				w.WriteHeader(test.status)
+				io.WriteString(w, "pushgateway says hi\n")
+			}))
+			defer server.Close()
+
+			err := PushMetrics(context.Background(), server.Client(), server.URL+"/", testRunMetrics())
+			if test.expectedErr {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), "pushgateway says hi")
+				}
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, http.MethodPut, method)
+			assert.Equal(t, "/metrics/job/jobsub_pnfs_dropbox_cleanup", path)
+			assert.Equal(t, metricsContentType, contentType)
+			assert.Equal(t, testRunMetricsText, body)
+		})
+	}
+}
+
+func TestMetricsOptionsExport(t *testing.T) {
+	pushes := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushes++
+	}))
+	defer server.Close()
+
+	// A cancelled run still exports its metrics
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	path := filepath.Join(t.TempDir(), "metrics.prom")
+	o := metricsOptions{path, server.URL}
+	assert.NoError(t, o.export(ctx, testRunMetrics()))
+	assert.Equal(t, 1, pushes)
+	assert.FileExists(t, path)
+
+	// Nothing is exported without somewhere to export to
+	assert.NoError(t, (&metricsOptions{}).export(ctx, testRunMetrics()))
+
+	o = metricsOptions{filepath.Join(t.TempDir(), "missing", "metrics.prom"), "http://127.0.0.1:0"}
+	err := o.export(context.Background(), testRunMetrics())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "could not write metrics")
+		assert.Contains(t, err.Error(), "could not push metrics")
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// Decision is what the planner decided to do with a dropbox entry
+type Decision string
+
+const (
+	DecisionDelete     Decision = "delete"
+	DecisionKeepRecent Decision = "keep-recent"
+	DecisionKeepInUse  Decision = "keep-in-use"
+	// DecisionKeepQuarantine is for the dropbox's quarantine area itself, which is cleaned up by purging instead
+	DecisionKeepQuarantine Decision = "keep-quarantine"
+	// DecisionKeepRule is for entries that match one of the experiment's protect rules
+	DecisionKeepRule Decision = "keep-rule"
+)
+
+// PlannedEntry is a dropbox entry along with what the planner decided to do with it, and why
+type PlannedEntry struct {
+	Entry    FileEntry
+	Decision Decision
+	Reason   string
+}
+
+// Plan is the set of decisions for one experiment's dropbox
+type Plan struct {
+	Experiment string
+	Source     string
+	// JobConstraint is the constraint that was used to find the jobs whose files are in use
+	JobConstraint string
+	// ScheddStats reports how querying each schedd for jobs went
+	ScheddStats []ScheddQueryStats
+	// Entries are the entries the plan deletes, along with the ones kept by a protect rule so that the report can say
+	// which rule kept them.  Every other entry is only counted, so that the plan for a very large dropbox takes memory in
+	// proportion to what it deletes rather than to the whole dropbox.
+	Entries []PlannedEntry
+	// Scanned is how many dropbox entries were planned, and Kept how many of them were kept for each reason
+	Scanned int
+	Kept    map[Decision]int
+	// Newest is the most recently created dropbox entry that a job could have uploaded.  The quarantine area and
+	// entries protected by rules are left out, since they are recent for reasons that have nothing to do with jobs.
+	Newest FileEntry
+	// ParseFailures are the listing lines that could not be parsed, and so were neither kept nor deleted knowingly
+	ParseFailures []ParseFailure
+}
+
+// add records the decision for one dropbox entry
+func (p *Plan) add(e PlannedEntry) {
+	p.Scanned++
+	if e.Decision != DecisionDelete {
+		if p.Kept == nil {
+			p.Kept = make(map[Decision]int)
+		}
+		p.Kept[e.Decision]++
+	}
+	if e.Decision == DecisionDelete || e.Decision == DecisionKeepRule {
+		p.Entries = append(p.Entries, e)
+	}
+	if e.Decision != DecisionKeepQuarantine && e.Decision != DecisionKeepRule && e.Entry.created.After(p.Newest.created) {
+		p.Newest = e.Entry
+	}
+}
+
+// Candidates returns the entries that the plan says should be deleted
+func (p *Plan) Candidates() []PlannedEntry {
+	candidates := make([]PlannedEntry, 0)
+	for _, e := range p.Entries {
+		if e.Decision == DecisionDelete {
+			candidates = append(candidates, e)
+		}
+	}
+	return candidates
+}
+
+// Planner decides what to do with each dropbox entry
+type Planner struct {
+	recentDuration time.Duration
+	now            time.Time
+	// activeComponents holds every path component of every file in use by a job.  Dropbox listings only give us the
+	// entries' base names, so an entry is in use if its name appears anywhere in an in-use file's path.  This can only
+	// err on the side of keeping things.
+	activeComponents map[string]struct{}
+	// quarantineDir is the name of the dropbox's quarantine area, if it has one
+	quarantineDir string
+	// protectRules and includeRules are checked before anything else.  See RulesConfig.
+	protectRules []*PathRule
+	includeRules []*PathRule
+}
+
+// NewPlanner returns a Planner that keeps entries newer than recentDuration, and entries referenced by activeFiles
+func NewPlanner(recentDuration time.Duration, activeFiles []string) *Planner {
+	p := &Planner{
+		recentDuration:   recentDuration,
+		now:              time.Now(),
+		activeComponents: make(map[string]struct{}),
+	}
+	for _, f := range activeFiles {
+		for _, component := range strings.Split(activeFilePath(f), "/") {
+			if component != "" {
+				p.activeComponents[component] = struct{}{}
+			}
+		}
+	}
+	return p
+}
+
+// activeFilePath strips any URL scheme and host from an in-use file reference
+func activeFilePath(f string) string {
+	if _, rest, ok := strings.Cut(f, "://"); ok {
+		if i := strings.Index(rest, "/"); i >= 0 {
+			return rest[i:]
+		}
+		return ""
+	}
+	return f
+}
+
+// Decide decides what to do with a single dropbox entry
+func (p *Planner) Decide(f FileEntry) PlannedEntry {
+	if p.quarantineDir != "" && f.filename == p.quarantineDir {
+		return PlannedEntry{f, DecisionKeepQuarantine, "quarantine area"}
+	}
+	included := matchingRule(p.includeRules, f.filename)
+	if included == nil {
+		if protected := matchingRule(p.protectRules, f.filename); protected != nil {
+			return PlannedEntry{f, DecisionKeepRule, "protected by rule " + protected.Name}
+		}
+	}
+	planned := p.decideByAgeAndUse(f)
+	if included != nil {
+		planned.Reason += " (included by rule " + included.Name + ")"
+	}
+	return planned
+}
+
+// decideByAgeAndUse keeps recent and in-use entries, and deletes everything else
+func (p *Planner) decideByAgeAndUse(f FileEntry) PlannedEntry {
+	if p.now.Sub(f.created) < p.recentDuration {
+		return PlannedEntry{f, DecisionKeepRecent, "newer than " + p.recentDuration.String()}
+	}
+	if _, ok := p.activeComponents[path.Base(f.filename)]; ok {
+		return PlannedEntry{f, DecisionKeepInUse, "referenced by a job"}
+	}
+	return PlannedEntry{f, DecisionDelete, "older than " + p.recentDuration.String() + " and not referenced by any job"}
+}
+
+// PlanStream decides what to do with each entry of the stream as it arrives.  The plan is returned along with the
+// stream's error, if any.  Only the entries that the plan has to hold on to are kept in memory (see Plan.Entries).
+func (p *Planner) PlanStream(stream *DropboxFileStream) (*Plan, error) {
+	plan := &Plan{Entries: make([]PlannedEntry, 0)}
+	for entry := range stream.Entries() {
+		plan.add(p.Decide(entry))
+	}
+	plan.ParseFailures = stream.Failures()
+	return plan, stream.Err()
+}
+
+// PlanExperiment finds the files in use by the experiment's jobs on each of jobListers, then lists the experiment's
+// dropbox with f and decides what to do with each entry.  The job constraint built from the experiment's job status
+// policy and the stats for each schedd query are recorded in the plan.
+//
+// If the schedds have no jobs at all for the experiment, the result is checked against collector and the dropbox's
+// recent entries (see checkEmptyJobQuery), and if it doesn't hold up, the plan is returned with an error just as if a
+// query had failed.
+func PlanExperiment(ctx context.Context, e *ExperimentConfig, f FileAccessor, jobListers []NamedJobLister, collector RunningJobsCounter) (*Plan, error) {
+	constraint := And(
+		Eq(Attr("Jobsub_Group"), Str(e.JobsubGroup)),
+		e.JobStatus.Policy().constraint(time.Now()),
+	)
+	activeFiles, scheddStats, err := GetActiveFilesFromSchedds(ctx, jobListers, fileAttributeNames(e.JobAttributes), constraint, e.ScheddQuery.Options())
+	if err != nil {
+		return &Plan{Experiment: e.Name, Source: e.Dropbox, JobConstraint: constraint.String(), ScheddStats: scheddStats},
+			fmt.Errorf("could not get files in use by %s jobs: %w", e.Name, err)
+	}
+
+	maxParseFailures := 0
+	if e.Retention.MaxParseFailures != nil {
+		maxParseFailures = *e.Retention.MaxParseFailures
+	}
+	planner := NewPlanner(time.Duration(e.Retention.Recent), activeFiles)
+	planner.quarantineDir = e.Quarantine.Dir
+	if planner.protectRules, planner.includeRules, err = e.Rules.PathRules(); err != nil {
+		return &Plan{Experiment: e.Name, Source: e.Dropbox, JobConstraint: constraint.String(), ScheddStats: scheddStats}, err
+	}
+	plan, err := planner.PlanStream(StreamDropboxFiles(ctx, f, e.Dropbox, maxParseFailures))
+	plan.Experiment = e.Name
+	plan.Source = e.Dropbox
+	plan.JobConstraint = constraint.String()
+	plan.ScheddStats = scheddStats
+	if err != nil {
+		return plan, err
+	}
+
+	numJobs := 0
+	for _, s := range scheddStats {
+		numJobs += s.NumJobs
+	}
+	if numJobs == 0 {
+		if err := checkEmptyJobQuery(ctx, collector, plan.Newest, e.Preflight.recentWindow(), time.Now()); err != nil {
+			return plan, fmt.Errorf("could not get files in use by %s jobs: %w", e.Name, err)
+		}
+	}
+	return plan, nil
+}
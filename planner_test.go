@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// withTestEntries adds entries to plan as PlanStream would, and returns plan
+func withTestEntries(plan *Plan, entries ...PlannedEntry) *Plan {
+	for _, e := range entries {
+		plan.add(e)
+	}
+	return plan
+}
+
+func TestPlannerDecide(t *testing.T) {
+	type testCase struct {
+		description      string
+		entry            FileEntry
+		expectedDecision Decision
+	}
+
+	now := time.Now()
+	planner := NewPlanner(
+		30*24*time.Hour,
+		[]string{
+			"/pnfs/gm2/resilient/jobsub_stage/inuse1/file.tar",
+			"https://fndcadoor.fnal.gov:2880/gm2/resilient/jobsub_stage/inuse2/file.tar",
+		},
+	)
+	planner.now = now
+
+	testCases := []testCase{
+		{
+			"Recent entry",
+			FileEntry{"recent", now.AddDate(0, 0, -1), true, 0},
+			DecisionKeepRecent,
+		},
+		{
+			"Recent entry that is also in use",
+			FileEntry{"inuse1", now.AddDate(0, 0, -1), true, 0},
+			DecisionKeepRecent,
+		},
+		{
+			"Old entry in use by path",
+			FileEntry{"inuse1", now.AddDate(0, -2, 0), true, 0},
+			DecisionKeepInUse,
+		},
+		{
+			"Old entry in use by URL",
+			FileEntry{"inuse2", now.AddDate(0, -2, 0), true, 0},
+			DecisionKeepInUse,
+		},
+		{
+			"Old entry not in use",
+			FileEntry{"stale", now.AddDate(0, -2, 0), true, 0},
+			DecisionDelete,
+		},
+		{
+			"URL host is not mistaken for a path component",
+			FileEntry{"fndcadoor.fnal.gov:2880", now.AddDate(0, -2, 0), true, 0},
+			DecisionDelete,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(
+			test.description,
+			func(t *testing.T) {
+				planned := planner.Decide(test.entry)
+				assert.Equal(t, test.entry, planned.Entry)
+				assert.Equal(t, test.expectedDecision, planned.Decision)
+				assert.NotEmpty(t, planned.Reason)
+			},
+		)
+	}
+}
+
+func TestPlannerDecideRules(t *testing.T) {
+	type testCase struct {
+		description      string
+		entry            FileEntry
+		expectedDecision Decision
+		expectedReason   string
+	}
+
+	now := time.Now()
+	old := now.AddDate(0, -2, 0)
+	planner := NewPlanner(30*24*time.Hour, []string{"/pnfs/gm2/resilient/jobsub_stage/shared_tmp_inuse/file.tar"})
+	planner.now = now
+	planner.quarantineDir = ".quarantine"
+	shared, _ := NewGlobRule("shared tarballs", "shared_*")
+	everything, _ := NewRegexRule("everything", ".")
+	tmp, _ := NewGlobRule("shared scratch", "shared_tmp_*")
+	planner.protectRules = []*PathRule{shared, everything}
+	planner.includeRules = []*PathRule{tmp}
+
+	testCases := []testCase{
+		{
+			"First matching protect rule is named",
+			FileEntry{"shared_gm2", old, true, 0},
+			DecisionKeepRule,
+			"protected by rule shared tarballs",
+		},
+		{
+			"Protect rules are checked before age",
+			FileEntry{"stale", old, true, 0},
+			DecisionKeepRule,
+			"protected by rule everything",
+		},
+		{
+			"Include rule overrides protect rules",
+			FileEntry{"shared_tmp_1", old, true, 0},
+			DecisionDelete,
+			"older than 720h0m0s and not referenced by any job (included by rule shared scratch)",
+		},
+		{
+			"Included entries are still kept while recent",
+			FileEntry{"shared_tmp_2", now, true, 0},
+			DecisionKeepRecent,
+			"newer than 720h0m0s (included by rule shared scratch)",
+		},
+		{
+			"Included entries are still kept while in use",
+			FileEntry{"shared_tmp_inuse", old, true, 0},
+			DecisionKeepInUse,
+			"referenced by a job (included by rule shared scratch)",
+		},
+		{
+			"Quarantine area is not subject to rules",
+			FileEntry{".quarantine", old, true, 0},
+			DecisionKeepQuarantine,
+			"quarantine area",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(
+			test.description,
+			func(t *testing.T) {
+				planned := planner.Decide(test.entry)
+				assert.Equal(t, test.expectedDecision, planned.Decision)
+				assert.Equal(t, test.expectedReason, planned.Reason)
+			},
+		)
+	}
+}
+
+// recordingJobLister is a JobLister that returns a fixed set of jobs and records the queries made of it
+type recordingJobLister struct {
+	jobs        []map[string][]byte
+	attributes  [][]string
+	constraints []string
+}
+
+func (r *recordingJobLister) queryJobsList(ctx context.Context, attributes []string, constraint ClassAdExpr) ([]map[string][]byte, error) {
+	r.attributes = append(r.attributes, attributes)
+	r.constraints = append(r.constraints, constraint.String())
+	return r.jobs, nil
+}
+
+func (r *recordingJobLister) getDropboxFilesFromJob(job map[string]io.Reader) ([]string, error) {
+	return new(CondorSchedd).getDropboxFilesFromJob(job)
+}
+
+func TestPlanExperiment(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`experiments:
+  - name: gm2
+    dropbox: https://fndcadoor.fnal.gov:2880/GM2/resilient/jobsub_stage
+    jobsub_group: gm2
+    schedds: [jobsub01.fnal.gov]
+    job_status:
+      protect: [running]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &cfg.Experiments[0]
+
+	old := time.Now().AddDate(0, -2, 0)
+	entries := []FileEntry{
+		{"inuse", old, true, 0},
+		{"stale", old, true, 0},
+		{"recent", time.Now(), true, 0},
+	}
+	f := newTestFileAccessor(entries, false, []bool{false, false, false})
+	j := &recordingJobLister{jobs: []map[string][]byte{{"PNFS_INPUT_FILES": []byte("/pnfs/gm2/resilient/jobsub_stage/inuse/file")}}}
+
+	plan, err := PlanExperiment(context.Background(), e, f, []NamedJobLister{{"jobsub01.fnal.gov", j}}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "gm2", plan.Experiment)
+	assert.Equal(t, e.Dropbox, plan.Source)
+	assert.Equal(t, `Jobsub_Group == "gm2" && (JobStatus == 2 || JobStatus == 6 || JobStatus == 3 || JobStatus == 4)`, plan.JobConstraint)
+	assert.Equal(t, []string{plan.JobConstraint}, j.constraints)
+	assert.Equal(t, [][]string{{"PNFS_INPUT_FILES", "ClusterId", "ProcId"}}, j.attributes)
+	if assert.Len(t, plan.ScheddStats, 1) {
+		assert.Equal(t, "jobsub01.fnal.gov", plan.ScheddStats[0].Schedd)
+		assert.Equal(t, 1, plan.ScheddStats[0].NumJobs)
+	}
+
+	// Only the candidate is held on to.  The kept entries are just counted.
+	assert.Equal(t, 3, plan.Scanned)
+	assert.Equal(t, map[Decision]int{DecisionKeepInUse: 1, DecisionKeepRecent: 1}, plan.Kept)
+	if assert.Len(t, plan.Entries, 1) {
+		assert.Equal(t, entries[1], plan.Entries[0].Entry)
+		assert.Equal(t, DecisionDelete, plan.Entries[0].Decision)
+	}
+	assert.Equal(t, plan.Entries, plan.Candidates())
+	assert.Equal(t, entries[2], plan.Newest)
+}
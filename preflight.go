@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultPreflightRecentWindow = 6 * time.Hour
+
+// RunningJobsCounter counts an experiment's running jobs independently of the schedd queries, so that an empty schedd
+// query result can be checked
+type RunningJobsCounter interface {
+	countRunningJobs(ctx context.Context) (int, error)
+}
+
+// CondorCollector counts an accounting group's running jobs from the collector's submitter ads
+type CondorCollector struct {
+	pool            string
+	accountingGroup string
+}
+
+// NewCondorCollector returns a CondorCollector that queries pool for the submitters in accountingGroup, such as
+// "group_gm2".  An empty pool means the default collector.
+func NewCondorCollector(pool, accountingGroup string) *CondorCollector {
+	return &CondorCollector{pool: pool, accountingGroup: accountingGroup}
+}
+
+func (c *CondorCollector) countRunningJobs(ctx context.Context) (int, error) {
+	args := []string{"-submitters"}
+	if c.pool != "" {
+		args = append(args, "-pool", c.pool)
+	}
+	submitters, err := runCondorJobQuery(ctx, "condor_status", args, []string{"Name", "RunningJobs"}, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	running := 0
+	for _, submitter := range submitters {
+		// Submitter names look like group_gm2.production.gm2pro@fnal.gov
+		name := string(submitter["Name"])
+		if !strings.HasPrefix(name, c.accountingGroup+".") && !strings.HasPrefix(name, c.accountingGroup+"@") {
+			continue
+		}
+		n, err := strconv.Atoi(string(submitter["RunningJobs"]))
+		if err != nil {
+			return 0, fmt.Errorf("submitter %s has invalid RunningJobs %q: %w", name, submitter["RunningJobs"], err)
+		}
+		running += n
+	}
+	return running, nil
+}
+
+// checkEmptyJobQuery is run when the schedd queries found no jobs at all for an experiment.  That is only believable if
+// the collector, queried with collector, shows that the experiment has no running jobs, and newest, the dropbox's newest
+// entry, is older than recentWindow:  a job that uploaded an entry that recently should still be in the queue or
+// history.  Otherwise the empty result is treated as a failed query, and the returned error wraps ErrEmptyJobQuery.  A
+// nil collector or a zero recentWindow skips that part of the check.
+func checkEmptyJobQuery(ctx context.Context, collector RunningJobsCounter, newest FileEntry, recentWindow time.Duration, now time.Time) error {
+	if collector != nil {
+		running, err := collector.countRunningJobs(ctx)
+		if err != nil {
+			return fmt.Errorf("%w, and the collector could not be checked for running jobs: %w", ErrEmptyJobQuery, err)
+		}
+		if running > 0 {
+			return fmt.Errorf("%w, but the collector shows %d running jobs", ErrEmptyJobQuery, running)
+		}
+	}
+	if recentWindow > 0 && !newest.created.IsZero() && now.Sub(newest.created) < recentWindow {
+		return fmt.Errorf("%w, but dropbox entry %s was created within the last %s", ErrEmptyJobQuery, newest.filename, recentWindow)
+	}
+	return nil
+}
+
+var ErrEmptyJobQuery = errors.New("the schedd queries found no jobs")
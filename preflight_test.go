@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeRunningJobsCounter struct {
+	running int
+	err     error
+}
+
+func (f *fakeRunningJobsCounter) countRunningJobs(context.Context) (int, error) {
+	return f.running, f.err
+}
+
+func TestCondorCollectorCountRunningJobs(t *testing.T) {
+	condorStatus := installFakeCondorCommand(t, "condor_status", `[
+{"Name": "group_gm2.production.gm2pro@fnal.gov", "RunningJobs": 12},
+{"Name": "group_gm2.analysis.someone@fnal.gov", "RunningJobs": 3},
+{"Name": "group_gm2x.analysis.someone@fnal.gov", "RunningJobs": 100},
+{"Name": "group_mu2e.production.mu2epro@fnal.gov", "RunningJobs": 50}
+]`, 0)
+
+	running, err := NewCondorCollector("gpcollector03.fnal.gov", "group_gm2").countRunningJobs(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 15, running)
+	assert.Equal(t, []string{"-submitters -pool gpcollector03.fnal.gov -json -attributes Name,RunningJobs"}, condorStatus())
+}
+
+func TestCondorCollectorCountRunningJobsFails(t *testing.T) {
+	installFakeCondorCommand(t, "condor_status", "Failed to connect to collector", 1)
+	_, err := NewCondorCollector("", "group_gm2").countRunningJobs(context.Background())
+	assert.Error(t, err)
+}
+
+func TestCheckEmptyJobQuery(t *testing.T) {
+	type testCase struct {
+		description string
+		collector   RunningJobsCounter
+		entryAge    time.Duration
+		expectedErr error
+	}
+
+	now := time.Now()
+	errCollector := errors.New("collector is down")
+
+	testCases := []testCase{
+		{
+			"Collector agrees there are no jobs and nothing is recent",
+			&fakeRunningJobsCounter{},
+			24 * time.Hour,
+			nil,
+		},
+		{
+			"Collector shows running jobs",
+			&fakeRunningJobsCounter{running: 5},
+			24 * time.Hour,
+			ErrEmptyJobQuery,
+		},
+		{
+			"Collector can't be checked",
+			&fakeRunningJobsCounter{err: errCollector},
+			24 * time.Hour,
+			errCollector,
+		},
+		{
+			"Recent dropbox entries exist",
+			&fakeRunningJobsCounter{},
+			time.Hour,
+			ErrEmptyJobQuery,
+		},
+		{
+			"No collector to check",
+			nil,
+			24 * time.Hour,
+			nil,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(
+			test.description,
+			func(t *testing.T) {
+				newest := FileEntry{"dir", now.Add(-test.entryAge), true, 0}
+				err := checkEmptyJobQuery(context.Background(), test.collector, newest, 6*time.Hour, now)
+				if test.expectedErr == nil {
+					assert.NoError(t, err)
+				} else {
+					assert.ErrorIs(t, err, test.expectedErr)
+					assert.ErrorIs(t, err, ErrEmptyJobQuery)
+				}
+			},
+		)
+	}
+
+	// A zero window skips the recent entries check, as does an empty dropbox
+	assert.NoError(t, checkEmptyJobQuery(context.Background(), nil, FileEntry{"dir", now, true, 0}, 0, now))
+	assert.NoError(t, checkEmptyJobQuery(context.Background(), nil, FileEntry{}, 6*time.Hour, now))
+}
+
+func TestPlanExperimentEmptyJobQuery(t *testing.T) {
+	type testCase struct {
+		description string
+		entries     []FileEntry
+		running     int
+		expectedErr error
+	}
+
+	stale := FileEntry{"stale", time.Now().AddDate(0, -2, 0), true, 0}
+	recent := time.Now().Add(-time.Hour)
+	testCases := []testCase{
+		{
+			"Jobs are running",
+			[]FileEntry{stale},
+			3,
+			ErrEmptyJobQuery,
+		},
+		{
+			"No jobs are running",
+			[]FileEntry{stale},
+			0,
+			nil,
+		},
+		{
+			"Recent upload",
+			[]FileEntry{stale, {"upload", recent, true, 0}},
+			0,
+			ErrEmptyJobQuery,
+		},
+		{
+			"Recent quarantine area and protected entry are not uploads",
+			[]FileEntry{stale, {".quarantine", recent, true, 0}, {"shared_tarball", recent, false, 10}},
+			0,
+			nil,
+		},
+	}
+
+	cfg, err := ParseConfig([]byte(`experiments:
+  - name: gm2
+    dropbox: https://fndcadoor.fnal.gov:2880/GM2/resilient/jobsub_stage
+    schedds: [jobsub01.fnal.gov]
+    rules:
+      protect:
+        - glob: shared_*
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &cfg.Experiments[0]
+	listers := []NamedJobLister{{"jobsub01.fnal.gov", &recordingJobLister{}}}
+
+	for _, test := range testCases {
+		t.Run(
+			test.description,
+			func(t *testing.T) {
+				f := newTestFileAccessor(test.entries, false, make([]bool, len(test.entries)))
+				plan, err := PlanExperiment(context.Background(), e, f, listers, &fakeRunningJobsCounter{running: test.running})
+				assert.ErrorIs(t, err, test.expectedErr)
+				if assert.NotNil(t, plan) {
+					assert.Equal(t, len(test.entries), plan.Scanned)
+				}
+			},
+		)
+	}
+}
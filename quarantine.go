@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultQuarantineDir        = ".quarantine"
+	defaultQuarantinePurgeAfter = 14 * 24 * time.Hour
+	// quarantineDateLayout names the dated directories within the quarantine area
+	quarantineDateLayout = "2006-01-02"
+)
+
+// rootURL is the URL of the quarantine area within the dropbox at source
+func (q QuarantineConfig) rootURL(source string) string {
+	return entryURL(source, q.Dir)
+}
+
+// dateURL is the URL of the quarantine directory for entries quarantined at now
+func (q QuarantineConfig) dateURL(source string, now time.Time) string {
+	return entryURL(q.rootURL(source), now.Format(quarantineDateLayout))
+}
+
+// PlanPurge lists the experiment's quarantine area with f, and plans the deletion of each dated quarantine directory
+// that is older than the experiment's purge threshold.  Anything in the quarantine area that isn't a dated directory is
+// reported as a parse failure and left alone.
+func PlanPurge(ctx context.Context, e *ExperimentConfig, f FileAccessor, now time.Time) (*Plan, error) {
+	root := e.Quarantine.rootURL(e.Dropbox)
+	plan := &Plan{Experiment: e.Name, Source: root, Entries: make([]PlannedEntry, 0), ParseFailures: make([]ParseFailure, 0)}
+	listing, err := GetDropboxFiles(ctx, f, root, -1)
+	if errors.Is(err, ErrNoFileEntries) {
+		return plan, nil
+	}
+	if err != nil {
+		return plan, err
+	}
+	plan.ParseFailures = append(plan.ParseFailures, listing.Failures...)
+	purgeAfter := time.Duration(e.Quarantine.PurgeAfter)
+	for _, entry := range listing.Entries {
+		quarantined, err := time.ParseInLocation(quarantineDateLayout, entry.filename, now.Location())
+		if err != nil || !entry.isDirectory {
+			plan.ParseFailures = append(plan.ParseFailures, ParseFailure{entry.filename, ErrNotQuarantineDate})
+			continue
+		}
+		// Everything in the directory was quarantined by the end of its day
+		if now.Sub(quarantined.AddDate(0, 0, 1)) < purgeAfter {
+			plan.add(PlannedEntry{entry, DecisionKeepRecent, "quarantined less than " + purgeAfter.String() + " ago"})
+			continue
+		}
+		plan.add(PlannedEntry{entry, DecisionDelete, "quarantined more than " + purgeAfter.String() + " ago"})
+	}
+	return plan, nil
+}
+
+// PurgeExperiment permanently deletes the experiment's quarantined entries that are older than its purge threshold.  It
+// stops the same way RunExperiment does when ctx is cancelled.
+func PurgeExperiment(ctx context.Context, e *ExperimentConfig, f FileAccessor, opts RunOptions) *RunResult {
+	logger := loggerFrom(ctx).With(logKeyExperiment, e.Name)
+	ctx = withLogger(ctx, logger)
+	result := &RunResult{Experiment: e.Name, DryRun: opts.DryRun}
+	if !opts.DryRun {
+		// The quarantine area only exists once something has been quarantined, and listing it would fail
+		if err := f.makeDir(ctx, e.Quarantine.rootURL(e.Dropbox)); err != nil {
+			result.Err = fmt.Errorf("could not create quarantine area: %w", err)
+			return result
+		}
+	}
+	plan, err := PlanPurge(ctx, e, f, time.Now())
+	if err != nil && opts.DryRun && ctx.Err() == nil {
+		// A dry run doesn't create the quarantine area, so it might not exist yet, in which case there's nothing to purge
+		if exists, existsErr := hasEntry(ctx, f, e.Dropbox, e.Quarantine.Dir); existsErr == nil && !exists {
+			err = nil
+		}
+	}
+	result.Plan = plan
+	if err != nil {
+		logger.Error("could not plan purge", logKeySource, plan.Source, "error", err)
+		result.Err = err
+		result.Interrupted = ctx.Err() != nil
+		return result
+	}
+	logger.Info("planned purge", logKeySource, plan.Source, "entries", plan.Scanned, "candidates", len(plan.Candidates()))
+	if opts.DryRun {
+		return result
+	}
+
+	deletionOpts := e.Deletion.Options()
+	deletionOpts.GracePeriod = opts.GracePeriod
+	deletionOpts.Root = e.Dropbox
+	deletionOpts.Audit = opts.Audit.ForExperiment(opts.RunID, e.Name, opts.TokenSubject)
+	deletionOpts.MeasureDirectories = opts.MeasureDirectories
+	result.Outcomes = NewDeletionExecutor(f, deletionOpts).Delete(ctx, plan.Source, plan.Candidates())
+	if ctx.Err() != nil {
+		result.Interrupted = true
+		result.Err = fmt.Errorf("stopped purging: %w", ctx.Err())
+	}
+	return result
+}
+
+// RestoreFromQuarantine moves the entry with the given name from the experiment's quarantine area back into its
+// dropbox, recording the move with audit.  If the entry was quarantined more than once, the most recently quarantined
+// copy is restored.  Nothing is restored if the dropbox already has an entry with that name.  It returns the URL the
+// entry was restored from.
+func RestoreFromQuarantine(ctx context.Context, e *ExperimentConfig, f FileAccessor, name string, audit *Auditor) (string, error) {
+	if !isPlainEntryName(name) {
+		return "", fmt.Errorf("%w: %q", ErrNotInQuarantine, name)
+	}
+	root := e.Quarantine.rootURL(e.Dropbox)
+	dates, err := GetDropboxFiles(ctx, f, root, -1)
+	if err != nil && !errors.Is(err, ErrNoFileEntries) {
+		return "", err
+	}
+
+	var latest time.Time
+	var from string
+	var quarantinedEntry FileEntry
+	for _, date := range dates.Entries {
+		quarantined, err := time.Parse(quarantineDateLayout, date.filename)
+		if err != nil || !date.isDirectory || (from != "" && !quarantined.After(latest)) {
+			continue
+		}
+		dateURL := entryURL(root, date.filename)
+		entries, err := GetDropboxFiles(ctx, f, dateURL, -1)
+		if err != nil && !errors.Is(err, ErrNoFileEntries) {
+			return "", err
+		}
+		for _, entry := range entries.Entries {
+			if entry.filename == name {
+				latest, from, quarantinedEntry = quarantined, entryURL(dateURL, name), entry
+				break
+			}
+		}
+	}
+	if from == "" {
+		return "", fmt.Errorf("%w: %s", ErrNotInQuarantine, name)
+	}
+	to := entryURL(e.Dropbox, name)
+	if err := errors.Join(checkWithinRoot(e.Dropbox, from), checkWithinRoot(e.Dropbox, to)); err != nil {
+		return "", err
+	}
+	// Moving onto an existing entry would replace it, or put the restored entry inside it
+	exists, err := hasEntry(ctx, f, e.Dropbox, name)
+	if err != nil {
+		return "", fmt.Errorf("could not check the dropbox for %s: %w", name, err)
+	}
+	if exists {
+		return "", fmt.Errorf("%w: %s", ErrAlreadyInDropbox, to)
+	}
+
+	outcome := DeletionOutcome{Entry: PlannedEntry{Entry: quarantinedEntry}, URL: from, MovedTo: to, Attempts: 1}
+	if err := audit.recordRestore(outcome, AuditStarted); err != nil {
+		return "", fmt.Errorf("not attempted because the audit log could not be written: %w", err)
+	}
+	outcome.Err = f.rename(ctx, from, to)
+	status := AuditSucceeded
+	if outcome.Err != nil {
+		status = AuditFailed
+	}
+	// As with deletions, the move has already been made, so a failure to record it is only reported when the audit log
+	// is closed
+	audit.recordRestore(outcome, status)
+	if outcome.Err != nil {
+		return "", outcome.Err
+	}
+	return from, nil
+}
+
+// hasEntry reports whether the directory at dirURL has an entry with the given name.  The listing is stopped as soon as
+// the entry is found.
+func hasEntry(ctx context.Context, f FileAccessor, dirURL, name string) (bool, error) {
+	stream := StreamDropboxFiles(ctx, f, dirURL, -1)
+	defer stream.Close()
+	for entry := range stream.Entries() {
+		if entry.filename == name {
+			return true, nil
+		}
+	}
+	if err := stream.Err(); err != nil && !errors.Is(err, ErrNoFileEntries) {
+		return false, err
+	}
+	return false, nil
+}
+
+// isPlainEntryName reports whether name is a single path component that can name a dropbox entry
+func isPlainEntryName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+// quarantineExperiments returns the experiments in cfg that have quarantine enabled
+func quarantineExperiments(cfg *Config) []*ExperimentConfig {
+	experiments := make([]*ExperimentConfig, 0)
+	for i := range cfg.Experiments {
+		if cfg.Experiments[i].Quarantine.Enabled {
+			experiments = append(experiments, &cfg.Experiments[i])
+		}
+	}
+	return experiments
+}
+
+// runPurge is the purge command.  It permanently deletes each experiment's old quarantined entries and writes the
+// report of what it did to stdout.  Signals are handled as they are for the run command.
+func runPurge(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("purge", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configPath := flags.String("config", defaultConfigPath, "Path to the config file")
+	var opts RunOptions
+	flags.BoolVar(&opts.DryRun, "dry-run", false, "Report what would be purged without deleting anything")
+	flags.DurationVar(&opts.GracePeriod, "grace-period", defaultGracePeriod, "How long deletions in progress when the purge is interrupted are given to finish")
+	auditOpts := auditLogFlags(flags)
+	reportOpts := reportFlags(flags)
+	logOpts := logFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if err := errors.Join(auditOpts.validate(), reportOpts.validate(), logOpts.validate()); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(stderr, "Could not load %s: %s\n", *configPath, err)
+		return exitFailure
+	}
+
+	if !opts.DryRun {
+		if opts.Audit, err = auditOpts.open(); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitFailure
+		}
+	}
+	opts.RunID = NewRunID(time.Now())
+	opts.MeasureDirectories = reportOpts.topDeleted > 0
+
+	ctx, stop := signalContext(stderr, opts.GracePeriod)
+	defer stop()
+	ctx = withLogger(ctx, logOpts.newLogger(stderr).With(logKeyRunID, opts.RunID))
+
+	tokens := cfg.TokenSources()
+	limiters := cfg.DoorRateLimiters()
+	experiments := quarantineExperiments(cfg)
+	results := make([]*RunResult, 0, len(experiments))
+	var errs []error
+	started := 0
+	for _, e := range experiments {
+		if ctx.Err() != nil {
+			break
+		}
+		started++
+		experimentOpts := opts
+		if !opts.DryRun {
+			if err := VerifyTokenCanDelete(ctx, tokens[e.Name], e.tokenScopePath()); err != nil {
+				results = append(results, &RunResult{Experiment: e.Name, Err: err})
+				errs = append(errs, fmt.Errorf("%s: %w", e.Name, err))
+				continue
+			}
+			experimentOpts.TokenSubject, _ = TokenSubject(ctx, tokens[e.Name])
+		}
+		result := PurgeExperiment(ctx, e, limiters.Wrap(NewGfalFileAccessor(e.Name, tokens)), experimentOpts)
+		results = append(results, result)
+		if result.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", e.Name, result.Err))
+		}
+	}
+
+	if err := reportOpts.write(stdout, stderr, results, time.Now()); err != nil {
+		errs = append(errs, fmt.Errorf("could not write report: %w", err))
+	}
+	if err := opts.Audit.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("audit log: %w", err))
+	}
+	return exitCode(ctx, errs, len(experiments)-started, len(experiments), stderr)
+}
+
+// runRestore is the restore command.  It moves a quarantined entry back into an experiment's dropbox.
+func runRestore(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configPath := flags.String("config", defaultConfigPath, "Path to the config file")
+	experiment := flags.String("experiment", "", "Experiment whose dropbox the entry belongs to.  Required if more than one experiment uses quarantine.")
+	auditOpts := auditLogFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if err := auditOpts.validate(); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(stderr, "restore takes the name of exactly one quarantined dropbox entry")
+		return exitUsage
+	}
+	name := flags.Arg(0)
+
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(stderr, "Could not load %s: %s\n", *configPath, err)
+		return exitFailure
+	}
+
+	var e *ExperimentConfig
+	experiments := quarantineExperiments(cfg)
+	switch {
+	case *experiment != "":
+		for _, candidate := range experiments {
+			if candidate.Name == *experiment {
+				e = candidate
+			}
+		}
+		if e == nil {
+			fmt.Fprintf(stderr, "Experiment %s is not configured, or does not use quarantine\n", *experiment)
+			return exitUsage
+		}
+	case len(experiments) == 1:
+		e = experiments[0]
+	default:
+		fmt.Fprintf(stderr, "%d experiments use quarantine, so -experiment is required\n", len(experiments))
+		return exitUsage
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	auditLog, err := auditOpts.open()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitFailure
+	}
+	tokens := cfg.TokenSources()
+	tokenSubject, _ := TokenSubject(ctx, tokens[e.Name])
+	audit := auditLog.ForExperiment(NewRunID(time.Now()), e.Name, tokenSubject)
+
+	f := cfg.DoorRateLimiters().Wrap(NewGfalFileAccessor(e.Name, tokens))
+	from, err := RestoreFromQuarantine(ctx, e, f, name, audit)
+	if err != nil {
+		fmt.Fprintf(stderr, "Could not restore %s for %s: %s\n", name, e.Name, err)
+		auditLog.Close()
+		return exitFailure
+	}
+	fmt.Fprintf(stdout, "Restored %s to %s\n", from, entryURL(e.Dropbox, name))
+	if err := auditLog.Close(); err != nil {
+		fmt.Fprintf(stderr, "audit log: %s\n", err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+var (
+	ErrNotQuarantineDate = errors.New("not a dated quarantine directory")
+	ErrNotInQuarantine   = errors.New("entry is not in quarantine")
+	ErrAlreadyInDropbox  = errors.New("an entry with that name is already in the dropbox")
+)
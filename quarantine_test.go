@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// treeFileAccessor is a testFileAccessor that lists a different set of directories for each source.  Everything in it
+// was created on Apr 6 2022.
+type treeFileAccessor struct {
+	*testFileAccessor
+	dirs map[string][]string
+}
+
+func newTreeFileAccessor(dirs map[string][]string) *treeFileAccessor {
+	return &treeFileAccessor{testFileAccessor: newTestFileAccessor(nil, false, nil), dirs: dirs}
+}
+
+func (t *treeFileAccessor) getFilesList(ctx context.Context, source string) ([][]byte, error) {
+	names, ok := t.dirs[source]
+	if !ok {
+		return nil, fmt.Errorf("no such directory %s", source)
+	}
+	listing := make([][]byte, 0, len(names))
+	for _, name := range names {
+		listing = append(listing, fmt.Appendf(nil, "drwxrwxrwx   0 0     0             0 Apr  6  2022 %s", name))
+	}
+	return listing, nil
+}
+
+func (t *treeFileAccessor) fileListingToFileEntry(r io.Reader) (FileEntry, error) {
+	var b strings.Builder
+	io.Copy(&b, r)
+	entry, err := scanDropboxLineToFileEntry(b.String())
+	if err != nil {
+		return FileEntry{}, err
+	}
+	return *entry, nil
+}
+
+func testQuarantineConfig(t *testing.T) *ExperimentConfig {
+	t.Helper()
+	cfg, err := ParseConfig([]byte(`experiments:
+  - name: gm2
+    dropbox: https://fndcadoor.fnal.gov:2880/GM2/resilient/jobsub_stage
+    schedds: [jobsub01.fnal.gov]
+    deletion:
+      workers: 1
+    quarantine:
+      enabled: true
+      purge_after: 7d
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &cfg.Experiments[0]
+}
+
+func TestRunExperimentQuarantine(t *testing.T) {
+	const dropbox = "https://fndcadoor.fnal.gov:2880/GM2/resilient/jobsub_stage"
+	e := testQuarantineConfig(t)
+	old := time.Now().AddDate(0, -2, 0)
+	f := newTestFileAccessor([]FileEntry{{"stale", old, true, 0}, {".quarantine", old, true, 0}}, false, []bool{false, false})
+
+	result := RunExperiment(context.Background(), e, f, testRunJobListers(), nil, nil, RunOptions{})
+	assert.NoError(t, result.Err)
+
+	today := dropbox + "/.quarantine/" + time.Now().Format("2006-01-02")
+	assert.Equal(t, today, result.QuarantineTo)
+	assert.Equal(t, []string{today}, f.madeDirs)
+	assert.Equal(t, []string{dropbox + "/stale -> " + today + "/stale"}, f.removed)
+	assert.Equal(t, 1, result.Plan.Kept[DecisionKeepQuarantine], "the quarantine area itself must never be a candidate")
+	if assert.Len(t, result.Outcomes, 1) {
+		assert.Equal(t, today+"/stale", result.Outcomes[0].MovedTo)
+	}
+}
+
+func TestPurgeExperiment(t *testing.T) {
+	const root = "https://fndcadoor.fnal.gov:2880/GM2/resilient/jobsub_stage/.quarantine"
+	e := testQuarantineConfig(t)
+	now := time.Now()
+	recent := now.AddDate(0, 0, -3).Format("2006-01-02")
+	old := now.AddDate(0, 0, -10).Format("2006-01-02")
+	f := newTreeFileAccessor(map[string][]string{root: {recent, old, "notadate"}})
+
+	plan, err := PlanPurge(context.Background(), e, f, now)
+	assert.NoError(t, err)
+	if assert.Len(t, plan.Candidates(), 1) {
+		assert.Equal(t, old, plan.Candidates()[0].Entry.filename)
+	}
+	assert.Equal(t, map[Decision]int{DecisionKeepRecent: 1}, plan.Kept)
+	if assert.Len(t, plan.ParseFailures, 1) {
+		assert.Equal(t, ParseFailure{"notadate", ErrNotQuarantineDate}, plan.ParseFailures[0])
+	}
+
+	result := PurgeExperiment(context.Background(), e, f, RunOptions{})
+	assert.NoError(t, result.Err)
+	assert.Equal(t, []string{root}, f.madeDirs)
+	assert.Equal(t, []string{root + "/" + old + "/"}, f.removed)
+
+	// Dry runs don't touch anything
+	f = newTreeFileAccessor(map[string][]string{root: {old}})
+	result = PurgeExperiment(context.Background(), e, f, RunOptions{DryRun: true})
+	assert.NoError(t, result.Err)
+	assert.Empty(t, f.madeDirs)
+	assert.Empty(t, f.removed)
+
+	// ... including creating the quarantine area, so a dry run before anything has been quarantined has nothing to purge
+	f = newTreeFileAccessor(map[string][]string{e.Dropbox: {"stale"}})
+	result = PurgeExperiment(context.Background(), e, f, RunOptions{DryRun: true})
+	assert.NoError(t, result.Err)
+	if assert.NotNil(t, result.Plan) {
+		assert.Equal(t, 0, result.Plan.Scanned)
+	}
+	assert.Empty(t, f.madeDirs)
+
+	// but a quarantine area that exists and can't be listed is still an error
+	f = newTreeFileAccessor(map[string][]string{e.Dropbox: {".quarantine"}})
+	result = PurgeExperiment(context.Background(), e, f, RunOptions{DryRun: true})
+	assert.Error(t, result.Err)
+}
+
+func TestRestoreFromQuarantine(t *testing.T) {
+	type testCase struct {
+		description  string
+		name         string
+		expectedFrom string
+		expectedErr  error
+	}
+
+	const dropbox = "https://fndcadoor.fnal.gov:2880/GM2/resilient/jobsub_stage"
+	const root = dropbox + "/.quarantine"
+	dirs := map[string][]string{
+		dropbox:              {".quarantine", "xyz"},
+		root:                 {"2024-01-01", "2024-02-01", "2024-03-01"},
+		root + "/2024-01-01": {"abc", "def"},
+		root + "/2024-02-01": {"abc"},
+		root + "/2024-03-01": {"xyz"},
+	}
+
+	testCases := []testCase{
+		{"Most recent copy is restored", "abc", root + "/2024-02-01/abc", nil},
+		{"Only copy is restored", "def", root + "/2024-01-01/def", nil},
+		{"Not in quarantine", "ghi", "", ErrNotInQuarantine},
+		{"Not an entry name", "../abc", "", ErrNotInQuarantine},
+		{"Already in the dropbox", "xyz", "", ErrAlreadyInDropbox},
+	}
+
+	for _, test := range testCases {
+		t.Run(
+			test.description,
+			func(t *testing.T) {
+				path := filepath.Join(t.TempDir(), "audit.jsonl")
+				a, err := OpenAuditLog(path, 0, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				f := newTreeFileAccessor(dirs)
+				from, err := RestoreFromQuarantine(context.Background(), testQuarantineConfig(t), f, test.name, a.ForExperiment("run1", "gm2", "gm2pro"))
+				assert.NoError(t, a.Close())
+				records := readAuditLog(t, path)
+				if test.expectedErr != nil {
+					assert.ErrorIs(t, err, test.expectedErr)
+					assert.Empty(t, f.removed)
+					assert.Empty(t, records)
+					return
+				}
+				to := dropbox + "/" + test.name
+				assert.NoError(t, err)
+				assert.Equal(t, test.expectedFrom, from)
+				assert.Equal(t, []string{test.expectedFrom + " -> " + to}, f.removed)
+				if assert.Len(t, records, 2) {
+					for i, status := range []string{AuditStarted, AuditSucceeded} {
+						assert.Equal(t, "restore", records[i].Action)
+						assert.Equal(t, test.expectedFrom, records[i].URL)
+						assert.Equal(t, to, records[i].MovedTo)
+						assert.Equal(t, test.name, records[i].Entry.Name)
+						assert.Equal(t, status, records[i].Status)
+					}
+				}
+			},
+		)
+	}
+}
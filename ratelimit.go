@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRateLimitMaxSlowdown = 10
+	// slowdownRecovery is how much of the slowdown is given back after each request that goes well
+	slowdownRecovery = 0.9
+)
+
+// RateLimitOptions describes the rate limit for one dCache door
+type RateLimitOptions struct {
+	// Rate is how many requests per second may be sent to the door
+	Rate float64
+	// Burst is how many requests may be sent at once after the door has been idle.  If zero, it is Rate rounded up.
+	Burst int
+	// LatencyThreshold is how long a request may take before the door is considered overloaded.  Zero disables the
+	// latency check.
+	LatencyThreshold time.Duration
+	// MaxSlowdown is the most the rate is ever divided by when the door is overloaded.  If zero,
+	// defaultRateLimitMaxSlowdown is used.
+	MaxSlowdown float64
+}
+
+// RateLimiter is a token bucket that limits how fast requests are sent to a dCache door.  When the door returns
+// transient errors or responds slowly, the rate is cut in half, down to Rate/MaxSlowdown, and recovers gradually as
+// requests go well again.  A nil RateLimiter doesn't limit anything.
+type RateLimiter struct {
+	opts RateLimitOptions
+
+	mu       sync.Mutex
+	tokens   float64
+	last     time.Time
+	slowdown float64
+
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+// NewRateLimiter returns a RateLimiter with a full bucket
+func NewRateLimiter(opts RateLimitOptions) *RateLimiter {
+	if opts.Burst <= 0 {
+		opts.Burst = max(1, int(opts.Rate+0.999999))
+	}
+	if opts.MaxSlowdown < 1 {
+		opts.MaxSlowdown = defaultRateLimitMaxSlowdown
+	}
+	return &RateLimiter{opts: opts, tokens: float64(opts.Burst), slowdown: 1, now: time.Now, sleep: sleepContext}
+}
+
+// Wait blocks until a request may be sent, or ctx is cancelled
+func (r *RateLimiter) Wait(ctx context.Context) error {
+	if r == nil || r.opts.Rate <= 0 {
+		return ctx.Err()
+	}
+
+	r.mu.Lock()
+	r.refill()
+	// Take the token now, even if it has to be waited for, so that waiters are served in order
+	r.tokens--
+	var wait time.Duration
+	if r.tokens < 0 {
+		wait = time.Duration(-r.tokens / r.rate() * float64(time.Second))
+	}
+	r.mu.Unlock()
+
+	if wait == 0 {
+		return ctx.Err()
+	}
+	if err := r.sleep(ctx, wait); err != nil {
+		r.mu.Lock()
+		r.tokens++
+		r.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Observe adjusts the rate based on how a request went.  Transient errors or a latency over the threshold slow the
+// limiter down.  Anything else speeds it back up towards the configured rate.
+func (r *RateLimiter) Observe(latency time.Duration, err error) {
+	if r == nil {
+		return
+	}
+	overloaded := errors.Is(err, ErrTransient) || (r.opts.LatencyThreshold > 0 && latency > r.opts.LatencyThreshold)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Settle the tokens earned at the old rate before changing it
+	r.refill()
+	if overloaded {
+		r.slowdown = min(r.slowdown*2, r.opts.MaxSlowdown)
+	} else {
+		r.slowdown = max(r.slowdown*slowdownRecovery, 1)
+	}
+}
+
+// CurrentRate is the rate that requests are being let through at, including any slowdown
+func (r *RateLimiter) CurrentRate() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rate()
+}
+
+func (r *RateLimiter) rate() float64 {
+	return r.opts.Rate / r.slowdown
+}
+
+// refill adds the tokens earned since the last refill.  r.mu must be held.
+func (r *RateLimiter) refill() {
+	now := r.now()
+	if !r.last.IsZero() {
+		r.tokens = min(r.tokens+now.Sub(r.last).Seconds()*r.rate(), float64(r.opts.Burst))
+	}
+	r.last = now
+}
+
+// DoorRateLimiters holds a RateLimiter for each dCache door host that has a rate limit.  The same limiter is shared by
+// every experiment whose dropbox is on that door.
+type DoorRateLimiters map[string]*RateLimiter
+
+// forURL returns the RateLimiter for the door that serves urlOrPath, or nil if there isn't one
+func (d DoorRateLimiters) forURL(urlOrPath string) *RateLimiter {
+	u, err := url.Parse(urlOrPath)
+	if err != nil || u.Host == "" {
+		return nil
+	}
+	return d[u.Hostname()]
+}
+
+// Wrap returns a FileAccessor that sends f's listings and removals through the rate limiter for their door
+func (d DoorRateLimiters) Wrap(f FileAccessor) FileAccessor {
+	if len(d) == 0 {
+		return f
+	}
+	return &rateLimitedFileAccessor{f, d}
+}
+
+// rateLimitedFileAccessor is a FileAccessor that waits for the door's RateLimiter before each listing or removal, and
+// tells the limiter how each one went
+type rateLimitedFileAccessor struct {
+	FileAccessor
+	limiters DoorRateLimiters
+}
+
+func (r *rateLimitedFileAccessor) getFilesList(ctx context.Context, source string) ([][]byte, error) {
+	var listings [][]byte
+	err := r.limit(ctx, source, false, func() error {
+		var err error
+		listings, err = r.FileAccessor.getFilesList(ctx, source)
+		return err
+	})
+	return listings, err
+}
+
+func (r *rateLimitedFileAccessor) streamFilesList(ctx context.Context, source string, emit func(line []byte) error) error {
+	return r.limit(ctx, source, false, func() error {
+		if streamer, ok := r.FileAccessor.(listingStreamer); ok {
+			return streamer.streamFilesList(ctx, source, emit)
+		}
+		return emitFilesList(ctx, r.FileAccessor, source, emit)
+	})
+}
+
+func (r *rateLimitedFileAccessor) removeFile(ctx context.Context, urlOrPath string) error {
+	return r.limit(ctx, urlOrPath, true, func() error { return r.FileAccessor.removeFile(ctx, urlOrPath) })
+}
+
+func (r *rateLimitedFileAccessor) removeDir(ctx context.Context, urlOrPath string) error {
+	return r.limit(ctx, urlOrPath, true, func() error { return r.FileAccessor.removeDir(ctx, urlOrPath) })
+}
+
+func (r *rateLimitedFileAccessor) rename(ctx context.Context, from, to string) error {
+	return r.limit(ctx, from, true, func() error { return r.FileAccessor.rename(ctx, from, to) })
+}
+
+func (r *rateLimitedFileAccessor) makeDir(ctx context.Context, urlOrPath string) error {
+	return r.limit(ctx, urlOrPath, true, func() error { return r.FileAccessor.makeDir(ctx, urlOrPath) })
+}
+
+// limit runs request once the limiter for urlOrPath's door allows it.  Listings take as long as the dropbox is big and
+// the consumer is slow, so their latency is not held against the door.
+func (r *rateLimitedFileAccessor) limit(ctx context.Context, urlOrPath string, observeLatency bool, request func() error) error {
+	limiter := r.limiters.forURL(urlOrPath)
+	if err := limiter.Wait(ctx); err != nil {
+		return err
+	}
+	start := time.Now()
+	err := request()
+	var latency time.Duration
+	if observeLatency {
+		latency = time.Since(start)
+	}
+	limiter.Observe(latency, err)
+	return err
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock is a clock whose sleeps return straight away, moving the time forward instead
+type fakeClock struct {
+	mu     sync.Mutex
+	t      time.Time
+	sleeps []time.Duration
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), sleeps: make([]time.Duration, 0)}
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sleeps = append(c.sleeps, d)
+	c.t = c.t.Add(d)
+	return nil
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func newFakeClockRateLimiter(opts RateLimitOptions) (*RateLimiter, *fakeClock) {
+	clock := newFakeClock()
+	r := NewRateLimiter(opts)
+	r.now = clock.now
+	r.sleep = clock.sleep
+	return r, clock
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	r, clock := newFakeClockRateLimiter(RateLimitOptions{Rate: 2, Burst: 2})
+	ctx := context.Background()
+
+	// The burst goes straight through, then requests are spaced out at the rate
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, r.Wait(ctx))
+	}
+	assert.Equal(t, []time.Duration{500 * time.Millisecond, 500 * time.Millisecond, 500 * time.Millisecond}, clock.sleeps)
+
+	// Idle time refills the bucket, but only up to the burst
+	clock.sleeps = clock.sleeps[:0]
+	clock.advance(time.Hour)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, r.Wait(ctx))
+	}
+	assert.Equal(t, []time.Duration{500 * time.Millisecond}, clock.sleeps)
+}
+
+func TestRateLimiterWaitCancelled(t *testing.T) {
+	r, clock := newFakeClockRateLimiter(RateLimitOptions{Rate: 1, Burst: 1})
+	assert.NoError(t, r.Wait(context.Background()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, r.Wait(ctx), context.Canceled)
+	assert.Empty(t, clock.sleeps)
+
+	// The cancelled wait gave its token back
+	clock.advance(time.Second)
+	assert.NoError(t, r.Wait(context.Background()))
+	assert.Empty(t, clock.sleeps)
+}
+
+func TestRateLimiterAdaptiveSlowdown(t *testing.T) {
+	type testCase struct {
+		description  string
+		observations []error
+		latency      time.Duration
+		expectedRate float64
+	}
+
+	errUnavailable := fmt.Errorf("%w: HTTP 503", ErrTransient)
+	errNotFound := errors.New("HTTP 404")
+
+	testCases := []testCase{
+		{
+			"Successes leave the rate alone",
+			[]error{nil, nil},
+			time.Millisecond,
+			10,
+		},
+		{
+			"Transient errors halve the rate",
+			[]error{errUnavailable, errUnavailable},
+			time.Millisecond,
+			2.5,
+		},
+		{
+			"Slowdown is capped",
+			[]error{errUnavailable, errUnavailable, errUnavailable, errUnavailable, errUnavailable},
+			time.Millisecond,
+			2.5,
+		},
+		{
+			"Permanent errors are not the door's fault",
+			[]error{errNotFound},
+			time.Millisecond,
+			10,
+		},
+		{
+			"High latency slows down",
+			[]error{nil},
+			2 * time.Second,
+			5,
+		},
+		{
+			"Rate recovers gradually",
+			[]error{errUnavailable, nil},
+			time.Millisecond,
+			10 / (2 * slowdownRecovery),
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(
+			test.description,
+			func(t *testing.T) {
+				r, _ := newFakeClockRateLimiter(RateLimitOptions{Rate: 10, LatencyThreshold: time.Second, MaxSlowdown: 4})
+				for _, err := range test.observations {
+					r.Observe(test.latency, err)
+				}
+				assert.InDelta(t, test.expectedRate, r.CurrentRate(), 1e-9)
+			},
+		)
+	}
+}
+
+func TestRateLimiterSlowdownSpacesRequests(t *testing.T) {
+	r, clock := newFakeClockRateLimiter(RateLimitOptions{Rate: 4, Burst: 1})
+	ctx := context.Background()
+
+	assert.NoError(t, r.Wait(ctx))
+	r.Observe(0, fmt.Errorf("%w: timed out", ErrTransient))
+	assert.NoError(t, r.Wait(ctx))
+	assert.Equal(t, []time.Duration{500 * time.Millisecond}, clock.sleeps)
+}
+
+func TestNilRateLimiter(t *testing.T) {
+	var r *RateLimiter
+	assert.NoError(t, r.Wait(context.Background()))
+	r.Observe(time.Hour, ErrTransient)
+}
+
+func TestDoorRateLimitersWrap(t *testing.T) {
+	limiter, clock := newFakeClockRateLimiter(RateLimitOptions{Rate: 1, Burst: 1})
+	limiters := DoorRateLimiters{"fndcadoor.fnal.gov": limiter}
+
+	f := newTestFileAccessor([]FileEntry{{"a", time.Now(), true, 0}}, false, []bool{false})
+	wrapped := limiters.Wrap(f)
+	ctx := context.Background()
+
+	_, err := wrapped.getFilesList(ctx, "https://fndcadoor.fnal.gov:2880/dropbox")
+	assert.NoError(t, err)
+	assert.NoError(t, wrapped.removeDir(ctx, "https://fndcadoor.fnal.gov:2880/dropbox/a"))
+	assert.NoError(t, wrapped.removeFile(ctx, "https://fndcadoor.fnal.gov:2880/dropbox/b"))
+	// Other doors and local paths are not limited
+	assert.NoError(t, wrapped.removeFile(ctx, "https://otherdoor.fnal.gov:2880/dropbox/c"))
+	assert.NoError(t, wrapped.removeFile(ctx, "/pnfs/dropbox/d"))
+
+	assert.Equal(t, []time.Duration{time.Second, time.Second}, clock.sleeps)
+	assert.Equal(
+		t,
+		[]string{
+			"https://fndcadoor.fnal.gov:2880/dropbox/a/",
+			"https://fndcadoor.fnal.gov:2880/dropbox/b",
+			"https://otherdoor.fnal.gov:2880/dropbox/c",
+			"/pnfs/dropbox/d",
+		},
+		f.removed,
+	)
+
+	// Listings still stream through the wrapper
+	stream := StreamDropboxFiles(ctx, wrapped, "https://fndcadoor.fnal.gov:2880/dropbox", 0)
+	entries := make([]FileEntry, 0)
+	for entry := range stream.Entries() {
+		entries = append(entries, entry)
+	}
+	assert.NoError(t, stream.Err())
+	assert.Len(t, entries, 1)
+
+	assert.Same(t, f, DoorRateLimiters{}.Wrap(f))
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reportSchemaVersion is the version of the JSON and CSV report layouts.  It must be bumped whenever a field is removed
+// or its meaning changes, so that anything consuming the reports can tell.
+const reportSchemaVersion = 2
+
+const (
+	reportFormatText = "text"
+	reportFormatJSON = "json"
+	reportFormatCSV  = "csv"
+)
+
+var validReportFormats = []string{reportFormatText, reportFormatJSON, reportFormatCSV}
+
+// Entry outcomes in a Report
+const (
+	OutcomeKept            = "kept"
+	OutcomeWouldDelete     = "would-delete"
+	OutcomeWouldQuarantine = "would-quarantine"
+	OutcomeDeleted         = "deleted"
+	OutcomeQuarantined     = "quarantined"
+	OutcomeFailed          = "failed"
+	OutcomeNotAttempted    = "not-attempted"
+)
+
+// Report is the machine-readable form of the results of a run
+type Report struct {
+	SchemaVersion int                `json:"schema_version"`
+	GeneratedAt   time.Time          `json:"generated_at"`
+	Experiments   []ExperimentReport `json:"experiments"`
+}
+
+// ExperimentReport is what a run planned and did for one experiment's dropbox
+type ExperimentReport struct {
+	Experiment   string `json:"experiment"`
+	Source       string `json:"source"`
+	DryRun       bool   `json:"dry_run"`
+	QuarantineTo string `json:"quarantine_to,omitempty"`
+	// JobConstraint is the job status policy, as the constraint that picked the jobs whose files were kept
+	JobConstraint string `json:"job_constraint,omitempty"`
+	// Schedds is how querying each schedd for the jobs went
+	Schedds     []ScheddReport `json:"schedds"`
+	Interrupted bool           `json:"interrupted"`
+	SafetyError string         `json:"safety_error,omitempty"`
+	Error       string         `json:"error,omitempty"`
+	// Scanned is how many dropbox entries were planned, and Kept how many of them were kept for each reason.  Only the
+	// entries that were to be deleted or were kept by a protect rule are listed in Entries.
+	Scanned       int                  `json:"scanned"`
+	Kept          map[Decision]int     `json:"kept"`
+	Entries       []EntryReport        `json:"entries"`
+	ParseFailures []ParseFailureReport `json:"parse_failures"`
+}
+
+// EntryReport is the planner's decision for one dropbox entry, and what became of it
+type EntryReport struct {
+	Name        string    `json:"name"`
+	URL         string    `json:"url"`
+	IsDirectory bool      `json:"is_directory"`
+	Size        int64     `json:"size"`
+	Created     time.Time `json:"created"`
+	// AgeSeconds is how old the entry was when the report was generated
+	AgeSeconds int64    `json:"age_seconds"`
+	Decision   Decision `json:"decision"`
+	Reason     string   `json:"reason"`
+	// Outcome is one of the Outcome constants
+	Outcome  string `json:"outcome"`
+	Attempts int    `json:"attempts,omitempty"`
+	// ReclaimedBytes is how much deleting the entry reclaimed.  For a directory, that is the size of its contents if it
+	// was measured before being deleted, and its listed Size if not.
+	ReclaimedBytes int64  `json:"reclaimed_bytes,omitempty"`
+	MovedTo        string `json:"moved_to,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+// ScheddReport is how querying one schedd for jobs went
+type ScheddReport struct {
+	Schedd         string  `json:"schedd"`
+	LatencySeconds float64 `json:"latency_seconds"`
+	Jobs           int     `json:"jobs"`
+	Files          int     `json:"files"`
+	Error          string  `json:"error,omitempty"`
+}
+
+// ParseFailureReport is a dropbox listing line that could not be parsed
+type ParseFailureReport struct {
+	Line  string `json:"line"`
+	Error string `json:"error"`
+}
+
+// NewReport builds the Report for results, with entry ages relative to now.  An experiment that failed before it could
+// be planned is reported with just its error.
+func NewReport(results []*RunResult, now time.Time) *Report {
+	report := &Report{SchemaVersion: reportSchemaVersion, GeneratedAt: now, Experiments: make([]ExperimentReport, 0, len(results))}
+	for _, r := range results {
+		if r.Plan == nil {
+			e := ExperimentReport{
+				Experiment:    r.Experiment,
+				DryRun:        r.DryRun,
+				QuarantineTo:  r.QuarantineTo,
+				Schedds:       make([]ScheddReport, 0),
+				Interrupted:   r.Interrupted,
+				Kept:          make(map[Decision]int),
+				Entries:       make([]EntryReport, 0),
+				ParseFailures: make([]ParseFailureReport, 0),
+			}
+			if r.Err != nil {
+				e.Error = r.Err.Error()
+			}
+			report.Experiments = append(report.Experiments, e)
+			continue
+		}
+		e := ExperimentReport{
+			Experiment:    r.Plan.Experiment,
+			Source:        r.Plan.Source,
+			DryRun:        r.DryRun,
+			QuarantineTo:  r.QuarantineTo,
+			JobConstraint: r.Plan.JobConstraint,
+			Schedds:       make([]ScheddReport, 0, len(r.Plan.ScheddStats)),
+			Interrupted:   r.Interrupted,
+			Scanned:       r.Plan.Scanned,
+			Kept:          make(map[Decision]int, len(r.Plan.Kept)),
+			Entries:       make([]EntryReport, 0, len(r.Plan.Entries)),
+			ParseFailures: make([]ParseFailureReport, 0, len(r.Plan.ParseFailures)),
+		}
+		for decision, n := range r.Plan.Kept {
+			e.Kept[decision] = n
+		}
+		for _, s := range r.Plan.ScheddStats {
+			schedd := ScheddReport{Schedd: s.Schedd, LatencySeconds: s.Latency.Seconds(), Jobs: s.NumJobs, Files: s.NumFiles}
+			if s.Err != nil {
+				schedd.Error = s.Err.Error()
+			}
+			e.Schedds = append(e.Schedds, schedd)
+		}
+		if r.SafetyErr != nil {
+			e.SafetyError = r.SafetyErr.Error()
+		}
+		if r.Err != nil {
+			e.Error = r.Err.Error()
+		}
+
+		outcomes := make(map[string]DeletionOutcome, len(r.Outcomes))
+		for _, o := range r.Outcomes {
+			outcomes[o.Entry.Entry.filename] = o
+		}
+		for _, p := range r.Plan.Entries {
+			entry := EntryReport{
+				Name:        p.Entry.filename,
+				URL:         entryURL(r.Plan.Source, p.Entry.filename),
+				IsDirectory: p.Entry.isDirectory,
+				Size:        p.Entry.size,
+				Created:     p.Entry.created,
+				AgeSeconds:  int64(now.Sub(p.Entry.created).Seconds()),
+				Decision:    p.Decision,
+				Reason:      p.Reason,
+			}
+			o, attempted := outcomes[p.Entry.filename]
+			switch {
+			case p.Decision != DecisionDelete:
+				entry.Outcome = OutcomeKept
+			case r.DryRun && r.QuarantineTo != "":
+				entry.Outcome = OutcomeWouldQuarantine
+			case r.DryRun:
+				entry.Outcome = OutcomeWouldDelete
+			case !attempted:
+				entry.Outcome = OutcomeNotAttempted
+			case o.Err != nil:
+				entry.Outcome, entry.Attempts, entry.Error = OutcomeFailed, o.Attempts, o.Err.Error()
+			case o.MovedTo != "":
+				entry.Outcome, entry.Attempts, entry.MovedTo = OutcomeQuarantined, o.Attempts, o.MovedTo
+			default:
+				entry.Outcome, entry.Attempts, entry.ReclaimedBytes = OutcomeDeleted, o.Attempts, o.Size
+			}
+			e.Entries = append(e.Entries, entry)
+		}
+		for _, f := range r.Plan.ParseFailures {
+			e.ParseFailures = append(e.ParseFailures, ParseFailureReport{f.Line, f.Err.Error()})
+		}
+		report.Experiments = append(report.Experiments, e)
+	}
+	return report
+}
+
+// WriteJSON writes the report to w as indented JSON
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	// Job constraints are full of &&
+	enc.SetEscapeHTML(false)
+	return enc.Encode(r)
+}
+
+var reportCSVHeader = []string{
+	"schema_version", "experiment", "source", "dry_run", "name", "url", "is_directory", "size", "created", "age_seconds",
+	"decision", "reason", "outcome", "attempts", "moved_to", "error", "reclaimed_bytes",
+}
+
+// WriteCSV writes the report to w as CSV, with a header row and then one row per dropbox entry.  Experiment-level
+// details such as errors and parse failures are only in the JSON report.
+func (r *Report) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write(reportCSVHeader)
+	for _, e := range r.Experiments {
+		for _, entry := range e.Entries {
+			cw.Write([]string{
+				strconv.Itoa(r.SchemaVersion),
+				e.Experiment,
+				e.Source,
+				strconv.FormatBool(e.DryRun),
+				entry.Name,
+				entry.URL,
+				strconv.FormatBool(entry.IsDirectory),
+				strconv.FormatInt(entry.Size, 10),
+				entry.Created.Format(time.RFC3339),
+				strconv.FormatInt(entry.AgeSeconds, 10),
+				string(entry.Decision),
+				entry.Reason,
+				entry.Outcome,
+				strconv.Itoa(entry.Attempts),
+				entry.MovedTo,
+				entry.Error,
+				strconv.FormatInt(entry.ReclaimedBytes, 10),
+			})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeReportFormat writes the report of results to w in format, one of validReportFormats
+func writeReportFormat(w io.Writer, format string, results []*RunResult, now time.Time) error {
+	switch format {
+	case reportFormatJSON:
+		return NewReport(results, now).WriteJSON(w)
+	case reportFormatCSV:
+		return NewReport(results, now).WriteCSV(w)
+	case reportFormatText, "":
+		WriteReport(w, results)
+		return nil
+	default:
+		return fmt.Errorf("unknown report format %q", format)
+	}
+}
+
+// reportOptions control what is written at the end of a run
+type reportOptions struct {
+	// format is one of validReportFormats
+	format string
+	// topDeleted is how many of each experiment's largest deleted directories are listed in the summary
+	topDeleted int
+}
+
+// reportFlags adds the flags for the report to flags
+func reportFlags(flags *flag.FlagSet) *reportOptions {
+	o := new(reportOptions)
+	flags.StringVar(&o.format, "report-format", reportFormatText, "Format of the report written to stdout: "+strings.Join(validReportFormats, ", "))
+	flags.IntVar(&o.topDeleted, "top-deleted", 0, "How many of each experiment's largest deleted directories to list in the summary.  Each deleted directory is listed first to measure it.")
+	return o
+}
+
+func (o *reportOptions) validate() error {
+	if !slices.Contains(validReportFormats, o.format) {
+		return fmt.Errorf("-report-format must be one of %s", strings.Join(validReportFormats, ", "))
+	}
+	if o.topDeleted < 0 {
+		return errors.New("-top-deleted must not be negative")
+	}
+	return nil
+}
+
+// write writes the report of results to stdout, followed by the summary table.  When the report is machine-readable,
+// the summary goes to stderr instead so that the report can still be parsed.
+func (o *reportOptions) write(stdout, stderr io.Writer, results []*RunResult, now time.Time) error {
+	if err := writeReportFormat(stdout, o.format, results, now); err != nil {
+		return err
+	}
+	summary := stderr
+	if o.format == reportFormatText {
+		summary = stdout
+		fmt.Fprintln(stdout)
+	}
+	return WriteSummary(summary, NewReport(results, now), o.topDeleted)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var updateGolden = flag.Bool("update", false, "Rewrite the golden files in testdata with the current output")
+
+// assertGolden compares got with the golden file testdata/name, or rewrites the golden file if -update is given
+func assertGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(want), string(got))
+}
+
+// testReportResults covers every entry outcome
+func testReportResults() ([]*RunResult, time.Time) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	old := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	const gm2 = "https://fndcadoor.fnal.gov:2880/GM2/resilient/jobsub_stage"
+	const mu2e = "/pnfs/mu2e/resilient/jobsub_stage"
+
+	deleted := PlannedEntry{FileEntry{"stale", old, true, 512}, DecisionDelete, "older than 720h0m0s and not referenced by any job"}
+	failed := PlannedEntry{FileEntry{"stale.tar", old, false, 1048576}, DecisionDelete, "older than 720h0m0s and not referenced by any job"}
+	notAttempted := PlannedEntry{FileEntry{"stale2", old, true, 512}, DecisionDelete, "older than 720h0m0s and not referenced by any job"}
+	quarantined := PlannedEntry{FileEntry{"old, \"quoted\"", old, false, 10}, DecisionDelete, "older than 720h0m0s and not referenced by any job"}
+
+	results := []*RunResult{
+		{
+			Experiment: "gm2",
+			Plan: withTestEntries(
+				&Plan{
+					Experiment:    "gm2",
+					Source:        gm2,
+					JobConstraint: `Jobsub_Group == "gm2" && (JobStatus == 2 || JobStatus == 1)`,
+					ScheddStats: []ScheddQueryStats{
+						{"jobsub01.fnal.gov", 1500 * time.Millisecond, 12, 3, nil},
+						{"jobsub02.fnal.gov", 5 * time.Minute, 0, 0, errors.New("query stopped after 5m0s: context deadline exceeded")},
+					},
+					ParseFailures: []ParseFailure{{"total 12", ErrParseLine}},
+				},
+				PlannedEntry{FileEntry{"recent", now.Add(-time.Hour), true, 512}, DecisionKeepRecent, "newer than 720h0m0s"},
+				PlannedEntry{FileEntry{"inuse", old, true, 512}, DecisionKeepInUse, "referenced by a job"},
+				PlannedEntry{FileEntry{"shared_gm2", old, true, 512}, DecisionKeepRule, "protected by rule shared tarballs"},
+				deleted,
+				failed,
+				notAttempted,
+			),
+			Outcomes: []DeletionOutcome{
+				{deleted, gm2 + "/stale", "", 2, 2048, nil},
+				{failed, gm2 + "/stale.tar", "", 1, 0, errors.New("gfal-rm failed: HTTP 403")},
+			},
+			Interrupted: true,
+			Err:         errors.New("stopped deleting: context canceled"),
+		},
+		{
+			Experiment:   "mu2e",
+			Plan:         withTestEntries(&Plan{Experiment: "mu2e", Source: mu2e, ParseFailures: []ParseFailure{}}, quarantined),
+			DryRun:       true,
+			QuarantineTo: mu2e + "/.quarantine/2024-03-01",
+			SafetyErr:    errors.New("refusing to delete: 1 of 1 entries"),
+		},
+		// An experiment that failed before it was planned is reported with its error
+		{Experiment: "nova", Err: errors.New("token has expired")},
+	}
+	return results, now
+}
+
+func TestReportJSON(t *testing.T) {
+	var b bytes.Buffer
+	results, now := testReportResults()
+	assert.NoError(t, writeReportFormat(&b, reportFormatJSON, results, now))
+	assertGolden(t, "report.json", b.Bytes())
+}
+
+func TestReportCSV(t *testing.T) {
+	var b bytes.Buffer
+	results, now := testReportResults()
+	assert.NoError(t, writeReportFormat(&b, reportFormatCSV, results, now))
+	assertGolden(t, "report.csv", b.Bytes())
+}
+
+func TestReportOutcomes(t *testing.T) {
+	results, now := testReportResults()
+	report := NewReport(results, now)
+	assert.Equal(t, reportSchemaVersion, report.SchemaVersion)
+	if assert.Len(t, report.Experiments, 3) {
+		outcomes := make([]string, 0)
+		for _, e := range report.Experiments {
+			for _, entry := range e.Entries {
+				outcomes = append(outcomes, entry.Outcome)
+			}
+		}
+		assert.Equal(
+			t,
+			[]string{OutcomeKept, OutcomeDeleted, OutcomeFailed, OutcomeNotAttempted, OutcomeWouldQuarantine},
+			outcomes,
+		)
+		// Entries that are kept for any reason but a rule are only counted
+		assert.Equal(t, 6, report.Experiments[0].Scanned)
+		assert.Equal(t, map[Decision]int{DecisionKeepRecent: 1, DecisionKeepInUse: 1, DecisionKeepRule: 1}, report.Experiments[0].Kept)
+		assert.Equal(t, ExperimentReport{
+			Experiment:    "nova",
+			Schedds:       []ScheddReport{},
+			Error:         "token has expired",
+			Kept:          map[Decision]int{},
+			Entries:       []EntryReport{},
+			ParseFailures: []ParseFailureReport{},
+		}, report.Experiments[2])
+	}
+}
+
+func TestWriteReportFormatUnknown(t *testing.T) {
+	var b bytes.Buffer
+	assert.Error(t, writeReportFormat(&b, "xml", nil, time.Now()))
+}
+
+func TestWriteReportPlanDetails(t *testing.T) {
+	var b bytes.Buffer
+	results, now := testReportResults()
+	assert.NoError(t, writeReportFormat(&b, reportFormatText, results, now))
+	assert.Contains(t, b.String(), `
+  protecting files of jobs matching: Jobsub_Group == "gm2" && (JobStatus == 2 || JobStatus == 1)
+  schedd jobsub01.fnal.gov: 12 jobs, 3 files in 1.5s
+  schedd jobsub02.fnal.gov failed after 5m0s: query stopped after 5m0s: context deadline exceeded
+`)
+	assert.Contains(t, b.String(), "\nnova: not planned\n  error: token has expired\n")
+}
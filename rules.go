@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+)
+
+// PathRule matches dropbox entries by name, using either a shell glob (see path.Match) or a regular expression.  Dropbox
+// listings only give the entries' base names, so that is all a rule is matched against.
+type PathRule struct {
+	Name  string
+	glob  string
+	regex *regexp.Regexp
+}
+
+// NewGlobRule returns a PathRule that matches entry names against the shell glob pattern
+func NewGlobRule(name, pattern string) (*PathRule, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid glob %q: %w", pattern, err)
+	}
+	return &PathRule{Name: name, glob: pattern}, nil
+}
+
+// NewRegexRule returns a PathRule that matches entry names against the regular expression pattern.  The expression is
+// not anchored, so use ^ and $ to match whole names.
+func NewRegexRule(name, pattern string) (*PathRule, error) {
+	regex, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regex %q: %w", pattern, err)
+	}
+	return &PathRule{Name: name, regex: regex}, nil
+}
+
+// Match reports whether the rule matches the dropbox entry with the given name
+func (r *PathRule) Match(filename string) bool {
+	if r.regex != nil {
+		return r.regex.MatchString(filename)
+	}
+	matched, _ := path.Match(r.glob, filename)
+	return matched
+}
+
+// matchingRule returns the first of rules that matches filename, or nil if none of them do
+func matchingRule(rules []*PathRule, filename string) *PathRule {
+	for _, r := range rules {
+		if r.Match(filename) {
+			return r
+		}
+	}
+	return nil
+}
+
+var ErrAmbiguousPathRule = errors.New("a rule must have exactly one of glob and regex")
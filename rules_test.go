@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathRuleMatch(t *testing.T) {
+	type testCase struct {
+		description string
+		rule        *PathRule
+		filename    string
+		expected    bool
+	}
+
+	glob, err := NewGlobRule("tarballs", "shared_*.tar")
+	assert.NoError(t, err)
+	regex, err := NewRegexRule("ops", "^ops-[0-9]+$")
+	assert.NoError(t, err)
+
+	testCases := []testCase{
+		{"Glob matches", glob, "shared_gm2.tar", true},
+		{"Glob doesn't match", glob, "shared_gm2.tgz", false},
+		{"Glob must match the whole name", glob, "old_shared_gm2.tar", false},
+		{"Regex matches", regex, "ops-123", true},
+		{"Regex doesn't match", regex, "ops-abc", false},
+	}
+
+	for _, test := range testCases {
+		t.Run(
+			test.description,
+			func(t *testing.T) {
+				assert.Equal(t, test.expected, test.rule.Match(test.filename))
+			},
+		)
+	}
+}
+
+func TestPathRuleInvalid(t *testing.T) {
+	_, err := NewGlobRule("bad", "[a")
+	assert.Error(t, err)
+	_, err = NewRegexRule("bad", "(a")
+	assert.Error(t, err)
+	_, err = PathRuleConfig{"both", "a*", "^a"}.Rule()
+	assert.ErrorIs(t, err, ErrAmbiguousPathRule)
+	_, err = PathRuleConfig{Name: "neither"}.Rule()
+	assert.ErrorIs(t, err, ErrAmbiguousPathRule)
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// defaultGracePeriod is how long deletions in progress are given to finish when a run is interrupted
+const defaultGracePeriod = time.Minute
+
+// DeletionOutcome is the result of trying to delete one candidate
+type DeletionOutcome struct {
+	Entry PlannedEntry
+	URL   string
+	// MovedTo is where the candidate was quarantined, if it was moved rather than deleted
+	MovedTo string
+	// Attempts is how many times the deletion was tried
+	Attempts int
+	// Size is how much deleting the candidate reclaims:  a file's size, or the total size of the files within a
+	// directory, which is measured by listing it before it is deleted.  Nothing is reclaimed by moving a candidate.
+	Size int64
+	Err  error
+}
+
+// RunResult is the result of cleaning up one experiment's dropbox
+type RunResult struct {
+	// Experiment is the name of the experiment the result is for.  Plan is nil if the experiment failed before it could
+	// be planned.
+	Experiment string
+	Plan       *Plan
+	Outcomes   []DeletionOutcome
+	DryRun     bool
+	// QuarantineTo is where candidates are moved to instead of being deleted, if the experiment uses quarantine
+	QuarantineTo string
+	// Interrupted is set if the run was cancelled before it finished.  Candidates without an outcome were not attempted.
+	Interrupted bool
+	// SafetyErr is why the plan failed its safety check, if it did.  Unless the run was forced, nothing was deleted.
+	SafetyErr error
+	Err       error
+}
+
+// RunOptions control how a run deletes the candidates in its plans
+type RunOptions struct {
+	// DryRun reports what would be deleted without deleting anything
+	DryRun bool
+	// GracePeriod is how long a deletion that is in progress when the run is stopped is given to finish before it is
+	// killed
+	GracePeriod time.Duration
+	// Force deletes the candidates even if the plan fails its safety check
+	Force bool
+	// Audit, if set, records every deletion attempt, along with RunID and TokenSubject, the subject of the token the
+	// deletions are made with
+	Audit        *AuditLog
+	RunID        string
+	TokenSubject string
+	// MeasureDirectories lists each directory before it is deleted to find out how much it reclaims (see
+	// DeletionOptions.MeasureDirectories).  It is only worth the extra listing when the largest deleted directories are
+	// reported.
+	MeasureDirectories bool
+}
+
+// RunExperiment plans the cleanup of the experiment's dropbox (see PlanExperiment), and unless opts.DryRun is set, deletes each candidate with
+// f, using the experiment's deletion settings.  If the plan would delete more than the experiment's safety limits allow,
+// compared to the dropbox and to previous, the state recorded by the last run, nothing is deleted unless opts.Force is
+// set.  If ctx is cancelled, no further deletions are started, the deletions in progress are given opts.GracePeriod to
+// finish, and the partial result is returned with Interrupted set.
+//
+// If the experiment has quarantine enabled, candidates are moved into today's quarantine area instead of being deleted.
+func RunExperiment(ctx context.Context, e *ExperimentConfig, f FileAccessor, jobListers []NamedJobLister, collector RunningJobsCounter, previous *ExperimentRunState, opts RunOptions) *RunResult {
+	logger := loggerFrom(ctx).With(logKeyExperiment, e.Name)
+	ctx = withLogger(ctx, logger)
+	result := &RunResult{Experiment: e.Name, DryRun: opts.DryRun}
+	plan, err := PlanExperiment(ctx, e, f, jobListers, collector)
+	result.Plan = plan
+	if err != nil {
+		logger.Error("could not plan cleanup", logKeySource, e.Dropbox, "error", err)
+		result.Err = err
+		result.Interrupted = ctx.Err() != nil
+		return result
+	}
+	logger.Info("planned cleanup", logKeySource, plan.Source, "entries", plan.Scanned, "candidates", len(plan.Candidates()),
+		"parse_failures", len(plan.ParseFailures))
+	result.SafetyErr = e.Safety.Limits().Check(plan, previous)
+	if result.SafetyErr != nil {
+		logger.Warn("plan failed safety check", logKeySource, plan.Source, "forced", opts.Force, "error", result.SafetyErr)
+	}
+	if e.Quarantine.Enabled {
+		result.QuarantineTo = e.Quarantine.dateURL(plan.Source, time.Now())
+	}
+	if opts.DryRun {
+		return result
+	}
+	if result.SafetyErr != nil && !opts.Force {
+		result.Err = result.SafetyErr
+		return result
+	}
+
+	candidates := plan.Candidates()
+	if result.QuarantineTo != "" && len(candidates) > 0 {
+		if err := f.makeDir(ctx, result.QuarantineTo); err != nil {
+			result.Err = fmt.Errorf("could not create quarantine area: %w", err)
+			result.Interrupted = ctx.Err() != nil
+			return result
+		}
+	}
+
+	deletionOpts := e.Deletion.Options()
+	deletionOpts.GracePeriod = opts.GracePeriod
+	deletionOpts.MoveTo = result.QuarantineTo
+	deletionOpts.Root = e.Dropbox
+	deletionOpts.Audit = opts.Audit.ForExperiment(opts.RunID, e.Name, opts.TokenSubject)
+	deletionOpts.MeasureDirectories = opts.MeasureDirectories
+	result.Outcomes = NewDeletionExecutor(f, deletionOpts).Delete(ctx, plan.Source, candidates)
+	if ctx.Err() != nil {
+		result.Interrupted = true
+		result.Err = fmt.Errorf("stopped deleting: %w", ctx.Err())
+	}
+	return result
+}
+
+// withGracePeriod returns a context that is cancelled gracePeriod after ctx is, so that work already started when ctx is
+// cancelled gets a chance to finish
+func withGracePeriod(ctx context.Context, gracePeriod time.Duration) (context.Context, context.CancelFunc) {
+	graceCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stopAfterFunc := context.AfterFunc(ctx, func() {
+		timer := time.AfterFunc(gracePeriod, cancel)
+		context.AfterFunc(graceCtx, func() { timer.Stop() })
+	})
+	return graceCtx, func() {
+		stopAfterFunc()
+		cancel()
+	}
+}
+
+// moveEntry moves a single candidate from the dropbox at source into the directory moveTo
+func moveEntry(ctx context.Context, f FileAccessor, source, moveTo string, candidate PlannedEntry) DeletionOutcome {
+	outcome := DeletionOutcome{
+		Entry:   candidate,
+		URL:     entryURL(source, candidate.Entry.filename),
+		MovedTo: entryURL(moveTo, candidate.Entry.filename),
+	}
+	outcome.Err = f.rename(ctx, outcome.URL, outcome.MovedTo)
+	return outcome
+}
+
+// deleteEntry deletes a single candidate from the dropbox at source
+func deleteEntry(ctx context.Context, f FileAccessor, source string, candidate PlannedEntry) DeletionOutcome {
+	outcome := DeletionOutcome{Entry: candidate, URL: entryURL(source, candidate.Entry.filename)}
+	if candidate.Entry.isDirectory {
+		outcome.Err = f.removeDir(ctx, outcome.URL)
+	} else {
+		outcome.Err = f.removeFile(ctx, outcome.URL)
+	}
+	return outcome
+}
+
+// entryURL is the URL of the dropbox entry with the given name
+func entryURL(source, filename string) string {
+	return strings.TrimSuffix(source, "/") + "/" + filename
+}
+
+// NotAttempted returns the candidates that the run never got to
+func (r *RunResult) NotAttempted() []PlannedEntry {
+	if r.Plan == nil || r.DryRun {
+		return nil
+	}
+	candidates := r.Plan.Candidates()
+	return candidates[min(len(r.Outcomes), len(candidates)):]
+}
+
+// WriteReport writes a plain-text report of results to w.  It is meant to be written even if the run was interrupted,
+// so it only relies on what each result recorded.
+func WriteReport(w io.Writer, results []*RunResult) {
+	for _, r := range results {
+		if r.Plan == nil {
+			fmt.Fprintf(w, "%s: not planned\n", r.Experiment)
+			if r.Interrupted {
+				fmt.Fprintln(w, "  run was interrupted")
+			}
+			if r.Err != nil {
+				fmt.Fprintf(w, "  error: %s\n", r.Err)
+			}
+			continue
+		}
+		mode := ""
+		if r.DryRun {
+			mode = " (dry run)"
+		}
+		fmt.Fprintf(w, "%s: %s%s\n", r.Plan.Experiment, r.Plan.Source, mode)
+		fmt.Fprintf(w, "  %d entries, %d candidates for deletion, %d unparseable lines\n",
+			r.Plan.Scanned, len(r.Plan.Candidates()), len(r.Plan.ParseFailures))
+		if r.Plan.JobConstraint != "" {
+			fmt.Fprintf(w, "  protecting files of jobs matching: %s\n", r.Plan.JobConstraint)
+		}
+		for _, s := range r.Plan.ScheddStats {
+			latency := s.Latency.Round(time.Millisecond)
+			if s.Err != nil {
+				fmt.Fprintf(w, "  schedd %s failed after %s: %s\n", s.Schedd, latency, s.Err)
+				continue
+			}
+			fmt.Fprintf(w, "  schedd %s: %d jobs, %d files in %s\n", s.Schedd, s.NumJobs, s.NumFiles, latency)
+		}
+		action := "delete"
+		if r.QuarantineTo != "" {
+			action = "quarantine"
+			fmt.Fprintf(w, "  quarantining to %s\n", r.QuarantineTo)
+		}
+		for _, e := range r.Plan.Entries {
+			if e.Decision == DecisionKeepRule {
+				fmt.Fprintf(w, "  kept %s: %s\n", entryURL(r.Plan.Source, e.Entry.filename), e.Reason)
+			}
+		}
+		if r.DryRun {
+			for _, c := range r.Plan.Candidates() {
+				fmt.Fprintf(w, "  would %s %s: %s\n", action, entryURL(r.Plan.Source, c.Entry.filename), c.Reason)
+			}
+		}
+		for _, o := range r.Outcomes {
+			if o.Err != nil {
+				fmt.Fprintf(w, "  failed to %s %s after %d attempt(s): %s\n", action, o.URL, o.Attempts, o.Err)
+				continue
+			}
+			fmt.Fprintf(w, "  %sd %s: %s\n", action, o.URL, o.Entry.Reason)
+		}
+		if notAttempted := r.NotAttempted(); len(notAttempted) > 0 {
+			fmt.Fprintf(w, "  %d candidates were not attempted\n", len(notAttempted))
+		}
+		if r.SafetyErr != nil {
+			fmt.Fprintf(w, "  safety check failed: %s\n", r.SafetyErr)
+			if !r.DryRun && r.Err == nil {
+				fmt.Fprintln(w, "  deleted anyway because the run was forced")
+			}
+		}
+		if r.Interrupted {
+			fmt.Fprintln(w, "  run was interrupted")
+		}
+		if r.Err != nil {
+			fmt.Fprintf(w, "  error: %s\n", r.Err)
+		}
+	}
+}
+
+// tokenScopePath is the path that the experiment's token must be allowed to delete under
+func (e *ExperimentConfig) tokenScopePath() string {
+	if e.Token.ScopePath != "" {
+		return e.Token.ScopePath
+	}
+	if u, err := url.Parse(e.Dropbox); err == nil && u.Path != "" {
+		return u.Path
+	}
+	return e.Dropbox
+}
+
+// runRun is the run command.  It cleans up each configured experiment's dropbox and always writes the report of what it
+// did to stdout.  On SIGINT or SIGTERM, it stops starting new deletions, gives the ones in progress the grace period to
+// finish, writes the report, and exits with exitInterrupted.  A second signal kills it immediately.
+func runRun(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("run", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configPath := flags.String("config", defaultConfigPath, "Path to the config file")
+	var opts RunOptions
+	flags.BoolVar(&opts.DryRun, "dry-run", false, "Report what would be deleted without deleting anything")
+	flags.DurationVar(&opts.GracePeriod, "grace-period", defaultGracePeriod, "How long deletions in progress when the run is interrupted are given to finish")
+	flags.BoolVar(&opts.Force, "force", false, "Delete even if an experiment's plan fails its safety check")
+	stateFile := flags.String("state-file", defaultStateFile, "Where each run records what it planned, for the next run's safety check")
+	auditOpts := auditLogFlags(flags)
+	reportOpts := reportFlags(flags)
+	metricsOpts := metricsFlags(flags)
+	logOpts := logFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if err := errors.Join(auditOpts.validate(), reportOpts.validate(), logOpts.validate()); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(stderr, "Could not load %s: %s\n", *configPath, err)
+		return exitFailure
+	}
+
+	if !opts.DryRun {
+		if opts.Audit, err = auditOpts.open(); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitFailure
+		}
+	}
+	opts.RunID = NewRunID(time.Now())
+	opts.MeasureDirectories = reportOpts.topDeleted > 0
+
+	ctx, stop := signalContext(stderr, opts.GracePeriod)
+	defer stop()
+	ctx = withLogger(ctx, logOpts.newLogger(stderr).With(logKeyRunID, opts.RunID))
+	return runExperiments(ctx, cfg, *stateFile, opts, *reportOpts, *metricsOpts, stdout, stderr)
+}
+
+// signalContext returns a context that is cancelled by SIGINT or SIGTERM.  After the first signal, the default signal
+// behavior is restored, so that a second signal kills the process.
+func signalContext(stderr io.Writer, gracePeriod time.Duration) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	stopAfterFunc := context.AfterFunc(ctx, func() {
+		stop()
+		fmt.Fprintf(stderr, "Interrupted, waiting up to %s for deletions in progress to finish\n", gracePeriod)
+	})
+	// stop cancels ctx too, which mustn't be mistaken for a signal
+	return ctx, func() {
+		stopAfterFunc()
+		stop()
+	}
+}
+
+// runExperiments runs each of cfg's experiments in turn, writes the report and summary as reportOpts says, and records
+// the run in the state file.  Unless it is a dry run, the run's metrics are exported as metricsOpts says.  The audit log
+// in opts, if any, is closed once the experiments are done.  It returns the exit code for the run.
+func runExperiments(ctx context.Context, cfg *Config, stateFile string, opts RunOptions, reportOpts reportOptions, metricsOpts metricsOptions, stdout, stderr io.Writer) int {
+	start := time.Now()
+	state, err := LoadRunState(stateFile)
+	if err != nil {
+		fmt.Fprintf(stderr, "Could not load run state: %s\n", err)
+		return exitFailure
+	}
+
+	tokens := cfg.TokenSources()
+	limiters := cfg.DoorRateLimiters()
+	results := make([]*RunResult, 0, len(cfg.Experiments))
+	var errs []error
+	started := 0
+	for i := range cfg.Experiments {
+		if ctx.Err() != nil {
+			break
+		}
+		started++
+		e := &cfg.Experiments[i]
+		experimentOpts := opts
+		if !opts.DryRun {
+			if err := VerifyTokenCanDelete(ctx, tokens[e.Name], e.tokenScopePath()); err != nil {
+				results = append(results, &RunResult{Experiment: e.Name, Err: err})
+				errs = append(errs, fmt.Errorf("%s: %w", e.Name, err))
+				continue
+			}
+			experimentOpts.TokenSubject, _ = TokenSubject(ctx, tokens[e.Name])
+		}
+		result := RunExperiment(ctx, e, limiters.Wrap(NewGfalFileAccessor(e.Name, tokens)), e.JobListers(), e.Collector(), state.previous(e.Name), experimentOpts)
+		results = append(results, result)
+		if errors.Is(result.Err, ErrMassDeletion) {
+			fmt.Fprintf(stderr, "Not deleting anything for %s: %s.  Check the job queries, then rerun with -force if the plan is right.\n", e.Name, result.SafetyErr)
+		} else if result.SafetyErr != nil && !opts.DryRun {
+			fmt.Fprintf(stderr, "Deleting for %s despite failed safety check because of -force: %s\n", e.Name, result.SafetyErr)
+		}
+		if result.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", e.Name, result.Err))
+		}
+		state.Record(result, time.Now())
+	}
+
+	loggerFrom(ctx).Info("finished run", "experiments", len(cfg.Experiments), "started", started, "duration", time.Since(start))
+	if err := reportOpts.write(stdout, stderr, results, time.Now()); err != nil {
+		errs = append(errs, fmt.Errorf("could not write report: %w", err))
+	}
+	if !opts.DryRun {
+		if err := state.Save(stateFile); err != nil {
+			errs = append(errs, fmt.Errorf("could not save run state: %w", err))
+		}
+		experiments := make([]string, 0, len(cfg.Experiments))
+		for _, e := range cfg.Experiments {
+			experiments = append(experiments, e.Name)
+		}
+		now := time.Now()
+		metrics := &RunMetrics{Experiments: experiments, Results: results, Duration: now.Sub(start), State: state, Now: now}
+		if err := metricsOpts.export(ctx, metrics); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := opts.Audit.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("audit log: %w", err))
+	}
+	return exitCode(ctx, errs, len(cfg.Experiments)-started, len(cfg.Experiments), stderr)
+}
+
+// exitCode reports errs and whether the run was interrupted to stderr, and returns the exit code for the run
+func exitCode(ctx context.Context, errs []error, notRun, total int, stderr io.Writer) int {
+	err := errors.Join(errs...)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+	}
+	if ctx.Err() != nil {
+		fmt.Fprintf(stderr, "Run was interrupted, %d of %d experiments were not run\n", notRun, total)
+		return exitInterrupted
+	}
+	if err != nil {
+		return exitFailure
+	}
+	return exitOK
+}
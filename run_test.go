@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testRunExperimentConfig(t *testing.T) *ExperimentConfig {
+	t.Helper()
+	cfg, err := ParseConfig([]byte(`experiments:
+  - name: gm2
+    dropbox: https://fndcadoor.fnal.gov:2880/GM2/resilient/jobsub_stage/
+    schedds: [jobsub01.fnal.gov]
+    deletion:
+      workers: 1
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &cfg.Experiments[0]
+}
+
+// testRunJobListers returns a schedd with a single job that doesn't use any dropbox entries
+func testRunJobListers() []NamedJobLister {
+	return []NamedJobLister{{"jobsub01.fnal.gov", &recordingJobLister{jobs: []map[string][]byte{{"PNFS_INPUT_FILES": []byte("/pnfs/gm2/other")}}}}}
+}
+
+func TestRunExperiment(t *testing.T) {
+	type testCase struct {
+		description      string
+		dryRun           bool
+		removeErrs       map[string]error
+		expectedRemoved  []string
+		expectedFailures int
+	}
+
+	const dropbox = "https://fndcadoor.fnal.gov:2880/GM2/resilient/jobsub_stage/"
+	errRemove := errors.New("remove failed")
+
+	testCases := []testCase{
+		{
+			"Dry run deletes nothing",
+			true,
+			nil,
+			nil,
+			0,
+		},
+		{
+			"Directories and files are removed with the matching method",
+			false,
+			nil,
+			[]string{dropbox + "staledir/", dropbox + "stalefile"},
+			0,
+		},
+		{
+			"A failed removal is recorded and the run carries on",
+			false,
+			map[string]error{dropbox + "staledir": errRemove},
+			[]string{dropbox + "staledir/", dropbox + "stalefile"},
+			1,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(
+			test.description,
+			func(t *testing.T) {
+				old := time.Now().AddDate(0, -2, 0)
+				entries := []FileEntry{
+					{"staledir", old, true, 0},
+					{"stalefile", old, false, 0},
+					{"recent", time.Now(), true, 0},
+				}
+				f := newTestFileAccessor(entries, false, []bool{false, false, false})
+				f.removeErrs = test.removeErrs
+
+				result := RunExperiment(context.Background(), testRunExperimentConfig(t), f, testRunJobListers(), nil, nil, RunOptions{DryRun: test.dryRun})
+				assert.NoError(t, result.Err)
+				assert.False(t, result.Interrupted)
+				assert.Equal(t, test.expectedRemoved, f.removed)
+				assert.Empty(t, result.NotAttempted())
+
+				failures := 0
+				for _, o := range result.Outcomes {
+					if o.Err != nil {
+						failures++
+						assert.ErrorIs(t, o.Err, errRemove)
+					}
+				}
+				assert.Equal(t, test.expectedFailures, failures)
+			},
+		)
+	}
+}
+
+func TestRunExperimentProtectRules(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`experiments:
+  - name: gm2
+    dropbox: https://fndcadoor.fnal.gov:2880/GM2/resilient/jobsub_stage
+    schedds: [jobsub01.fnal.gov]
+    rules:
+      protect:
+        - name: shared tarballs
+          glob: "shared_*"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().AddDate(0, -2, 0)
+	f := newTestFileAccessor([]FileEntry{{"shared_gm2", old, true, 0}, {"stale", old, true, 0}}, false, []bool{false, false})
+
+	result := RunExperiment(context.Background(), &cfg.Experiments[0], f, testRunJobListers(), nil, nil, RunOptions{DryRun: true})
+	assert.NoError(t, result.Err)
+	// So that the report doesn't depend on how long the fake schedd took
+	result.Plan.ScheddStats[0].Latency = 1500 * time.Millisecond
+	var report bytes.Buffer
+	WriteReport(&report, []*RunResult{result})
+	assert.Equal(
+		t,
+		`gm2: https://fndcadoor.fnal.gov:2880/GM2/resilient/jobsub_stage (dry run)
+  2 entries, 1 candidates for deletion, 0 unparseable lines
+  protecting files of jobs matching: Jobsub_Group == "gm2" && (JobStatus == 1 || JobStatus == 2 || JobStatus == 6 || JobStatus == 5 || JobStatus == 7 || JobStatus == 3 || JobStatus == 4)
+  schedd jobsub01.fnal.gov: 1 jobs, 1 files in 1.5s
+  kept https://fndcadoor.fnal.gov:2880/GM2/resilient/jobsub_stage/shared_gm2: protected by rule shared tarballs
+  would delete https://fndcadoor.fnal.gov:2880/GM2/resilient/jobsub_stage/stale: older than 720h0m0s and not referenced by any job
+`,
+		report.String(),
+	)
+}
+
+func TestRunExperimentSafetyCheck(t *testing.T) {
+	type testCase struct {
+		description     string
+		opts            RunOptions
+		expectedRemoved int
+		expectedErr     error
+	}
+
+	testCases := []testCase{
+		{
+			"Refuses to delete when the safety check fails",
+			RunOptions{},
+			0,
+			ErrMassDeletion,
+		},
+		{
+			"Forced runs delete anyway",
+			RunOptions{Force: true},
+			20,
+			nil,
+		},
+		{
+			"Dry runs report the failed check",
+			RunOptions{DryRun: true},
+			0,
+			nil,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(
+			test.description,
+			func(t *testing.T) {
+				old := time.Now().AddDate(0, -2, 0)
+				entries := make([]FileEntry, 0, 20)
+				for i := 0; i < 20; i++ {
+					entries = append(entries, FileEntry{fmt.Sprintf("stale%02d", i), old, true, 0})
+				}
+				f := newTestFileAccessor(entries, false, make([]bool, len(entries)))
+
+				result := RunExperiment(context.Background(), testRunExperimentConfig(t), f, testRunJobListers(), nil, nil, test.opts)
+				assert.ErrorIs(t, result.SafetyErr, ErrMassDeletion)
+				if test.expectedErr == nil {
+					assert.NoError(t, result.Err)
+				} else {
+					assert.ErrorIs(t, result.Err, test.expectedErr)
+				}
+				assert.Len(t, f.removed, test.expectedRemoved)
+
+				var report bytes.Buffer
+				WriteReport(&report, []*RunResult{result})
+				assert.Contains(t, report.String(), "safety check failed: refusing to delete: 20 of 20 entries (100%)")
+			},
+		)
+	}
+}
+
+func TestRunExperimentCancelled(t *testing.T) {
+	old := time.Now().AddDate(0, -2, 0)
+	entries := []FileEntry{
+		{"stale1", old, true, 0},
+		{"stale2", old, true, 0},
+		{"stale3", old, true, 0},
+	}
+	f := newTestFileAccessor(entries, false, []bool{false, false, false})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Cancel while the first deletion is in progress, as a signal would
+	f.onRemove = func(string) { cancel() }
+
+	result := RunExperiment(ctx, testRunExperimentConfig(t), f, testRunJobListers(), nil, nil, RunOptions{})
+	assert.True(t, result.Interrupted)
+	assert.ErrorIs(t, result.Err, context.Canceled)
+	assert.Len(t, f.removed, 1)
+	assert.Len(t, result.Outcomes, 1)
+	assert.Len(t, result.NotAttempted(), 2)
+
+	var report bytes.Buffer
+	WriteReport(&report, []*RunResult{result})
+	assert.Contains(t, report.String(), "deleted https://fndcadoor.fnal.gov:2880/GM2/resilient/jobsub_stage/stale1")
+	assert.Contains(t, report.String(), "2 candidates were not attempted")
+	assert.Contains(t, report.String(), "run was interrupted")
+}
+
+func TestRunExperimentGracePeriod(t *testing.T) {
+	type testCase struct {
+		description string
+		removeDelay time.Duration
+		gracePeriod time.Duration
+		expectedErr error
+	}
+
+	testCases := []testCase{
+		{
+			"Deletion in progress finishes within the grace period",
+			50 * time.Millisecond,
+			10 * time.Second,
+			nil,
+		},
+		{
+			"Deletion in progress is stopped when the grace period runs out",
+			10 * time.Second,
+			50 * time.Millisecond,
+			context.Canceled,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(
+			test.description,
+			func(t *testing.T) {
+				old := time.Now().AddDate(0, -2, 0)
+				f := newTestFileAccessor([]FileEntry{{"stale1", old, true, 0}, {"stale2", old, true, 0}}, false, []bool{false, false})
+				f.removeDelay = test.removeDelay
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				f.onRemove = func(string) { cancel() }
+
+				start := time.Now()
+				result := RunExperiment(ctx, testRunExperimentConfig(t), f, testRunJobListers(), nil, nil, RunOptions{GracePeriod: test.gracePeriod})
+				assert.Less(t, time.Since(start), 5*time.Second)
+				assert.True(t, result.Interrupted)
+				assert.Len(t, f.removed, 1)
+				if assert.Len(t, result.Outcomes, 1) {
+					if test.expectedErr == nil {
+						assert.NoError(t, result.Outcomes[0].Err)
+					} else {
+						assert.ErrorIs(t, result.Outcomes[0].Err, test.expectedErr)
+					}
+				}
+				assert.Len(t, result.NotAttempted(), 1)
+			},
+		)
+	}
+}
+
+func TestWithGracePeriod(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	graceCtx, release := withGracePeriod(ctx, 50*time.Millisecond)
+	defer release()
+
+	cancel()
+	assert.NoError(t, graceCtx.Err(), "the grace period should not have run out yet")
+	select {
+	case <-graceCtx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("context was not cancelled after the grace period")
+	}
+
+	// Releasing cancels the context straight away
+	graceCtx, release = withGracePeriod(context.Background(), time.Hour)
+	release()
+	assert.Error(t, graceCtx.Err())
+}
+
+func TestRunExperimentCancelledBeforePlanning(t *testing.T) {
+	f := newTestFileAccessor([]FileEntry{{"stale", time.Now().AddDate(0, -2, 0), true, 0}}, false, []bool{false})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	result := RunExperiment(ctx, testRunExperimentConfig(t), f, testRunJobListers(), nil, nil, RunOptions{})
+	assert.True(t, result.Interrupted)
+	assert.Error(t, result.Err)
+	assert.Empty(t, f.removed)
+}
+
+func TestEntryURL(t *testing.T) {
+	assert.Equal(t, "https://door:2880/dropbox/abc", entryURL("https://door:2880/dropbox/", "abc"))
+	assert.Equal(t, "https://door:2880/dropbox/abc", entryURL("https://door:2880/dropbox", "abc"))
+}
+
+// syncBuffer is a bytes.Buffer that can be written from one goroutine while another reads it
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.String()
+}
+
+func TestSignalContext(t *testing.T) {
+	// Stopping the context when the run finishes normally isn't an interruption
+	var stderr syncBuffer
+	ctx, stop := signalContext(&stderr, time.Minute)
+	stop()
+	<-ctx.Done()
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, stderr.String())
+
+	ctx, stop = signalContext(&stderr, time.Minute)
+	defer stop()
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("context was not cancelled by SIGTERM")
+	}
+	assert.Eventually(t, func() bool {
+		return stderr.String() == "Interrupted, waiting up to 1m0s for deletions in progress to finish\n"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestRunExperimentsInterrupted(t *testing.T) {
+	dir := t.TempDir()
+	token := makeTestJWT(t, map[string]any{
+		"sub":   "gm2pro",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"scope": "storage.modify:/GM2/resilient/jobsub_stage storage.modify:/Mu2e/resilient/jobsub_stage",
+	})
+	for _, name := range []string{"gm2", "mu2e"} {
+		if err := os.WriteFile(filepath.Join(dir, name+"_token"), []byte(token), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg, err := ParseConfig([]byte(fmt.Sprintf(`experiments:
+  - name: gm2
+    dropbox: https://fndcadoor.fnal.gov:2880/GM2/resilient/jobsub_stage
+    schedds: [jobsub01.fnal.gov]
+    token: {source: file, path: %[1]s/gm2_token}
+    deletion: {workers: 1}
+    preflight: {check_collector: false}
+  - name: mu2e
+    dropbox: https://fndcadoor.fnal.gov:2880/Mu2e/resilient/jobsub_stage
+    schedds: [jobsub01.fnal.gov]
+    token: {source: file, path: %[1]s/mu2e_token}
+    deletion: {workers: 1}
+    preflight: {check_collector: false}
+`, dir)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	installFakeCondorCommand(t, "condor_q", "[]", 0)
+	installFakeCondorCommand(t, "condor_history", "[]", 0)
+	// The stale directories are empty
+	installFakeCommand(t, "gfal-ls", `case "$*" in
+*/stale*) ;;
+*)
+	echo "drwxrwxrwx   0 0     0             0 Apr  6  2022 stale1"
+	echo "drwxrwxrwx   0 0     0             0 Apr  6  2022 stale2"
+	echo "drwxrwxrwx   0 0     0             0 Apr  6  2022 stale3"
+	;;
+esac
+`)
+	// The first deletion is still in progress when the run is interrupted, and is given the grace period to finish
+	removing := filepath.Join(dir, "removing")
+	installFakeCommand(t, "gfal-rm", "touch "+removing+"\nsleep 1\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for {
+			if _, err := os.Stat(removing); err == nil {
+				cancel()
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	var stdout, stderr bytes.Buffer
+	opts := RunOptions{GracePeriod: time.Minute, Force: true, RunID: "test"}
+	code := runExperiments(ctx, cfg, filepath.Join(dir, "state.json"), opts, reportOptions{format: reportFormatText}, metricsOptions{}, &stdout, &stderr)
+	assert.Equal(t, exitInterrupted, code)
+	assert.Contains(t, stdout.String(), "deleted https://fndcadoor.fnal.gov:2880/GM2/resilient/jobsub_stage/stale1")
+	assert.Contains(t, stdout.String(), "2 candidates were not attempted")
+	assert.Contains(t, stdout.String(), "run was interrupted")
+	assert.NotContains(t, stdout.String(), "mu2e")
+	assert.Contains(t, stderr.String(), "Run was interrupted, 1 of 2 experiments were not run")
+}
+
+func TestRunExperimentsTokenCheckFailed(t *testing.T) {
+	dir := t.TempDir()
+	cfg, err := ParseConfig([]byte(fmt.Sprintf(`experiments:
+  - name: gm2
+    dropbox: https://fndcadoor.fnal.gov:2880/GM2/resilient/jobsub_stage
+    schedds: [jobsub01.fnal.gov]
+    token: {source: file, path: %s}
+`, filepath.Join(dir, "missing"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := runExperiments(context.Background(), cfg, filepath.Join(dir, "state.json"), RunOptions{}, reportOptions{format: reportFormatText}, metricsOptions{}, &stdout, &stderr)
+	assert.Equal(t, exitFailure, code)
+	assert.Regexp(t, `^gm2: not planned\n  error: .*missing`, stdout.String())
+	assert.Contains(t, stderr.String(), "gm2: ")
+}
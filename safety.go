@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSafetyMinCount    = 10
+	defaultSafetyMaxFraction = 0.5
+	defaultSafetyMaxIncrease = 3
+	defaultStateFile         = "/var/lib/jobsub-pnfs-dropbox-cleanup/state.json"
+)
+
+// SafetyLimits guard against a plan that would delete far more than it should, such as when a job query silently comes
+// back empty and every old entry looks unused
+type SafetyLimits struct {
+	// MinCount is how many deletions are always allowed.  The relative limits only apply to plans that would delete more.
+	MinCount int
+	// MaxFraction is the largest fraction of the dropbox's entries that may be deleted
+	MaxFraction float64
+	// MaxCount is the most entries that may be deleted.  Zero means no limit.
+	MaxCount int
+	// MaxIncrease is how many times more entries than the previous run may be deleted.  Zero disables the comparison.
+	MaxIncrease float64
+}
+
+// Check returns an error wrapping ErrMassDeletion that gives every reason the plan deletes too much, or nil if it is
+// within the limits.  previous is the state recorded by the last run for the experiment, or nil if there wasn't one.
+func (s SafetyLimits) Check(plan *Plan, previous *ExperimentRunState) error {
+	candidates := len(plan.Candidates())
+	reasons := make([]string, 0)
+	if s.MaxCount > 0 && candidates > s.MaxCount {
+		reasons = append(reasons, fmt.Sprintf("%d deletions is more than the limit of %d", candidates, s.MaxCount))
+	}
+	if candidates > s.MinCount {
+		if fraction := float64(candidates) / float64(plan.Scanned); fraction > s.MaxFraction {
+			reasons = append(reasons, fmt.Sprintf("%d of %d entries (%.0f%%) would be deleted, more than the limit of %.0f%%", candidates, plan.Scanned, fraction*100, s.MaxFraction*100))
+		}
+		if s.MaxIncrease > 0 && previous != nil && float64(candidates) > float64(previous.Candidates)*s.MaxIncrease {
+			reasons = append(reasons, fmt.Sprintf("%d deletions is more than %g times the %d planned by the previous run at %s", candidates, s.MaxIncrease, previous.Candidates, previous.Time.Format(time.RFC3339)))
+		}
+	}
+	if len(reasons) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrMassDeletion, strings.Join(reasons, "; "))
+}
+
+// RunState is what each run records for the next one to compare against
+type RunState struct {
+	Experiments map[string]ExperimentRunState `json:"experiments"`
+}
+
+// ExperimentRunState is what a run recorded about one experiment's dropbox
+type ExperimentRunState struct {
+	Time       time.Time `json:"time"`
+	Entries    int       `json:"entries"`
+	Candidates int       `json:"candidates"`
+	Deleted    int       `json:"deleted"`
+}
+
+// LoadRunState reads the run state file at path.  If there is no file yet, the state is empty.
+func LoadRunState(path string) (*RunState, error) {
+	state := &RunState{Experiments: make(map[string]ExperimentRunState)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("could not parse run state file %s: %w", path, err)
+	}
+	if state.Experiments == nil {
+		state.Experiments = make(map[string]ExperimentRunState)
+	}
+	return state, nil
+}
+
+// Save writes the state to path, replacing the old file all at once so that an interrupted save can't corrupt it.  The
+// directory is created if it doesn't exist yet, as on the first run with the default state file.
+func (s *RunState) Save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// previous returns the recorded state for the experiment, or nil if there isn't any
+func (s *RunState) previous(experiment string) *ExperimentRunState {
+	if s == nil {
+		return nil
+	}
+	state, ok := s.Experiments[experiment]
+	if !ok {
+		return nil
+	}
+	return &state
+}
+
+// Record stores the result of a run for the next run to compare against.  Dry runs, and runs that were refused or
+// interrupted, aren't recorded, since they didn't finish the cleanup they planned.
+func (s *RunState) Record(result *RunResult, now time.Time) {
+	if result.Plan == nil || result.DryRun || result.Interrupted || result.Err != nil {
+		return
+	}
+	deleted := 0
+	for _, o := range result.Outcomes {
+		if o.Err == nil {
+			deleted++
+		}
+	}
+	s.Experiments[result.Plan.Experiment] = ExperimentRunState{
+		Time:       now,
+		Entries:    result.Plan.Scanned,
+		Candidates: len(result.Plan.Candidates()),
+		Deleted:    deleted,
+	}
+}
+
+var ErrMassDeletion = errors.New("refusing to delete")
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testPlan returns a plan for a dropbox with the given number of entries, the first candidates of which are to be
+// deleted
+func testPlan(entries, candidates int) *Plan {
+	plan := &Plan{Experiment: "gm2"}
+	for i := 0; i < entries; i++ {
+		decision := DecisionKeepRecent
+		if i < candidates {
+			decision = DecisionDelete
+		}
+		plan.add(PlannedEntry{Decision: decision})
+	}
+	return plan
+}
+
+func TestSafetyLimitsCheck(t *testing.T) {
+	type testCase struct {
+		description string
+		limits      SafetyLimits
+		plan        *Plan
+		previous    *ExperimentRunState
+		expectedErr error
+	}
+
+	limits := SafetyLimits{MinCount: 10, MaxFraction: 0.5, MaxIncrease: 3}
+	previous := &ExperimentRunState{Time: time.Now(), Entries: 1000, Candidates: 20}
+
+	testCases := []testCase{
+		{
+			"Small plans are always allowed",
+			limits,
+			testPlan(10, 10),
+			&ExperimentRunState{},
+			nil,
+		},
+		{
+			"Within the limits",
+			limits,
+			testPlan(1000, 50),
+			previous,
+			nil,
+		},
+		{
+			"Too large a fraction of the dropbox",
+			limits,
+			testPlan(100, 51),
+			nil,
+			ErrMassDeletion,
+		},
+		{
+			"Too large an increase over the previous run",
+			limits,
+			testPlan(1000, 61),
+			previous,
+			ErrMassDeletion,
+		},
+		{
+			"Comparison with the previous run can be disabled",
+			SafetyLimits{MinCount: 10, MaxFraction: 0.5},
+			testPlan(1000, 61),
+			previous,
+			nil,
+		},
+		{
+			"Absolute limit applies even to small plans",
+			SafetyLimits{MinCount: 10, MaxFraction: 1, MaxCount: 5},
+			testPlan(10, 6),
+			nil,
+			ErrMassDeletion,
+		},
+		{
+			"Everything old looks unused",
+			limits,
+			testPlan(1000, 1000),
+			previous,
+			ErrMassDeletion,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(
+			test.description,
+			func(t *testing.T) {
+				err := test.limits.Check(test.plan, test.previous)
+				if test.expectedErr == nil {
+					assert.NoError(t, err)
+				} else {
+					assert.ErrorIs(t, err, test.expectedErr)
+				}
+			},
+		)
+	}
+}
+
+func TestSafetyLimitsCheckGivesEveryReason(t *testing.T) {
+	limits := SafetyLimits{MinCount: 10, MaxFraction: 0.5, MaxCount: 100, MaxIncrease: 3}
+	previous := &ExperimentRunState{Time: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), Candidates: 20}
+	err := limits.Check(testPlan(1000, 1000), previous)
+	assert.EqualError(
+		t,
+		err,
+		"refusing to delete: 1000 deletions is more than the limit of 100; "+
+			"1000 of 1000 entries (100%) would be deleted, more than the limit of 50%; "+
+			"1000 deletions is more than 3 times the 20 planned by the previous run at 2024-01-01T00:00:00Z",
+	)
+}
+
+func TestRunState(t *testing.T) {
+	// The state directory doesn't exist until the first save
+	path := filepath.Join(t.TempDir(), "jobsub-pnfs-dropbox-cleanup", "state.json")
+
+	state, err := LoadRunState(path)
+	assert.NoError(t, err, "a missing state file is an empty state")
+	assert.Nil(t, state.previous("gm2"))
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	result := &RunResult{
+		Plan:     testPlan(10, 3),
+		Outcomes: []DeletionOutcome{{}, {}, {Err: errors.New("remove failed")}},
+	}
+	state.Record(result, now)
+	state.Record(&RunResult{Plan: &Plan{Experiment: "mu2e"}, DryRun: true}, now)
+	state.Record(&RunResult{Plan: &Plan{Experiment: "nova"}, Err: ErrMassDeletion}, now)
+	state.Record(&RunResult{Plan: &Plan{Experiment: "dune"}, Interrupted: true}, now)
+	assert.NoError(t, state.Save(path))
+
+	loaded, err := LoadRunState(path)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]ExperimentRunState{"gm2": {now, 10, 3, 2}}, loaded.Experiments)
+	assert.Equal(t, &ExperimentRunState{now, 10, 3, 2}, loaded.previous("gm2"))
+
+	files, _ := os.ReadDir(filepath.Dir(path))
+	assert.Len(t, files, 1, "no temporary files should be left behind")
+
+	os.WriteFile(path, []byte("not json"), 0o644)
+	_, err = LoadRunState(path)
+	assert.Error(t, err)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultScheddQueryConcurrency = 4
+	defaultScheddQueryTimeout     = 5 * time.Minute
+)
+
+// NamedJobLister is a JobLister along with the name of the schedd it queries, for reporting
+type NamedJobLister struct {
+	Name string
+	JobLister
+}
+
+// ScheddQueryStats reports how querying one schedd went
+type ScheddQueryStats struct {
+	Schedd   string
+	Latency  time.Duration
+	NumJobs  int
+	NumFiles int
+	Err      error
+}
+
+// ScheddQueryOptions controls how GetActiveFilesFromSchedds fans out its queries
+type ScheddQueryOptions struct {
+	// Concurrency is the most schedds queried at once.  If zero, defaultScheddQueryConcurrency is used.
+	Concurrency int
+	// Timeout is how long to wait for each schedd.  If zero, defaultScheddQueryTimeout is used.
+	Timeout time.Duration
+}
+
+// GetActiveFilesFromSchedds queries each of listers concurrently for the dropbox files in use by the jobs matching
+// constraint.  The files are merged in the order of listers, regardless of the order the queries finish in, and stats
+// are returned for every schedd.  If any schedd fails or times out, the files from the others are still returned, but
+// so is an error naming each failed schedd:  the set of files in use is incomplete, so nothing should be deleted based
+// on it.  Cancelling ctx stops all of the queries.
+func GetActiveFilesFromSchedds(ctx context.Context, listers []NamedJobLister, attributes []string, constraint ClassAdExpr, opts ScheddQueryOptions) ([]string, []ScheddQueryStats, error) {
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultScheddQueryConcurrency
+	}
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = defaultScheddQueryTimeout
+	}
+
+	stats := make([]ScheddQueryStats, len(listers))
+	files := make([][]string, len(listers))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for i := range listers {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			files[i], stats[i] = queryScheddWithTimeout(ctx, listers[i], attributes, constraint, timeout)
+		}(i)
+	}
+	wg.Wait()
+
+	activeFiles := make([]string, 0)
+	errs := make([]error, 0)
+	for i := range listers {
+		activeFiles = append(activeFiles, files[i]...)
+		if stats[i].Err != nil {
+			errs = append(errs, fmt.Errorf("schedd %s: %w", stats[i].Schedd, stats[i].Err))
+		}
+	}
+	return activeFiles, stats, errors.Join(errs...)
+}
+
+type scheddQueryResult struct {
+	jobs []map[string][]byte
+	err  error
+}
+
+// queryScheddWithTimeout queries a single schedd, giving up after timeout or when ctx is cancelled.  The query is passed
+// a context with the timeout so that it can stop its work, but we don't rely on it doing so.
+func queryScheddWithTimeout(ctx context.Context, l NamedJobLister, attributes []string, constraint ClassAdExpr, timeout time.Duration) ([]string, ScheddQueryStats) {
+	stats := ScheddQueryStats{Schedd: l.Name}
+	logger := loggerFrom(ctx).With(logKeySchedd, l.Name)
+	ctx, cancel := context.WithTimeout(withLogger(ctx, logger), timeout)
+	defer cancel()
+
+	start := time.Now()
+	// Buffered, so that a query that finishes after we've given up on it doesn't block forever
+	resultChan := make(chan scheddQueryResult, 1)
+	go func() {
+		jobs, err := l.queryJobsList(ctx, attributes, constraint)
+		resultChan <- scheddQueryResult{jobs, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		stats.Latency = time.Since(start)
+		stats.Err = fmt.Errorf("query stopped after %s: %w", stats.Latency.Round(time.Millisecond), ctx.Err())
+		logger.Error("schedd query failed", "latency", stats.Latency, "error", stats.Err)
+		return nil, stats
+	case result := <-resultChan:
+		stats.Latency = time.Since(start)
+		if result.err != nil {
+			stats.Err = result.err
+			logger.Error("schedd query failed", "latency", stats.Latency, "error", stats.Err)
+			return nil, stats
+		}
+		files := dropboxFilesFromJobs(ctx, l, result.jobs)
+		stats.NumJobs = len(result.jobs)
+		stats.NumFiles = len(files)
+		logger.Debug("queried schedd", "latency", stats.Latency, "jobs", stats.NumJobs, "files", stats.NumFiles)
+		return files, stats
+	}
+}
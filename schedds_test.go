@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeScheddJobLister is a JobLister that returns one job per file after an optional delay, blocks until release is
+// closed, or fails.  It tracks how many fakeScheddJobListers sharing inFlight are querying at once.
+type fakeScheddJobLister struct {
+	files       []string
+	delay       time.Duration
+	release     chan struct{}
+	err         error
+	inFlight    *atomic.Int64
+	maxInFlight *atomic.Int64
+}
+
+func (f *fakeScheddJobLister) queryJobsList(context.Context, []string, ClassAdExpr) ([]map[string][]byte, error) {
+	if f.inFlight != nil {
+		n := f.inFlight.Add(1)
+		defer f.inFlight.Add(-1)
+		for {
+			prev := f.maxInFlight.Load()
+			if n <= prev || f.maxInFlight.CompareAndSwap(prev, n) {
+				break
+			}
+		}
+	}
+	if f.release != nil {
+		<-f.release
+	}
+	time.Sleep(f.delay)
+	if f.err != nil {
+		return nil, f.err
+	}
+	jobs := make([]map[string][]byte, 0, len(f.files))
+	for _, file := range f.files {
+		jobs = append(jobs, map[string][]byte{"PNFS_INPUT_FILES": []byte(file)})
+	}
+	return jobs, nil
+}
+
+func (f *fakeScheddJobLister) getDropboxFilesFromJob(job map[string]io.Reader) ([]string, error) {
+	return new(CondorSchedd).getDropboxFilesFromJob(job)
+}
+
+func TestGetActiveFilesFromSchedds(t *testing.T) {
+	errQuery := errors.New("condor_q failed")
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+
+	type testCase struct {
+		description     string
+		listers         []NamedJobLister
+		expectedFiles   []string
+		expectedNumJobs []int
+		expectedErrs    []error
+	}
+
+	testCases := []testCase{
+		{
+			"Results are merged in schedd order, not completion order",
+			[]NamedJobLister{
+				{"slow", &fakeScheddJobLister{files: []string{"/slow/1", "/slow/2"}, delay: 50 * time.Millisecond}},
+				{"medium", &fakeScheddJobLister{files: []string{"/medium/1"}, delay: 20 * time.Millisecond}},
+				{"fast", &fakeScheddJobLister{files: []string{"/fast/1"}}},
+			},
+			[]string{"/slow/1", "/slow/2", "/medium/1", "/fast/1"},
+			[]int{2, 1, 1},
+			[]error{nil, nil, nil},
+		},
+		{
+			"A failing schedd is reported, and the others' files still returned",
+			[]NamedJobLister{
+				{"good", &fakeScheddJobLister{files: []string{"/good/1"}}},
+				{"bad", &fakeScheddJobLister{err: errQuery}},
+			},
+			[]string{"/good/1"},
+			[]int{1, 0},
+			[]error{nil, errQuery},
+		},
+		{
+			"A hung schedd times out without holding up the others",
+			[]NamedJobLister{
+				{"hung", &fakeScheddJobLister{files: []string{"/hung/1"}, release: release}},
+				{"good", &fakeScheddJobLister{files: []string{"/good/1"}}},
+			},
+			[]string{"/good/1"},
+			[]int{0, 1},
+			[]error{context.DeadlineExceeded, nil},
+		},
+		{
+			"No schedds",
+			[]NamedJobLister{},
+			[]string{},
+			[]int{},
+			[]error{},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(
+			test.description,
+			func(t *testing.T) {
+				files, stats, err := GetActiveFilesFromSchedds(context.Background(), test.listers, []string{"PNFS_INPUT_FILES"}, nil, ScheddQueryOptions{Concurrency: 4, Timeout: 200 * time.Millisecond})
+				assert.Equal(t, test.expectedFiles, files)
+				assert.Len(t, stats, len(test.listers))
+
+				for i, s := range stats {
+					assert.Equal(t, test.listers[i].Name, s.Schedd)
+					assert.Equal(t, test.expectedNumJobs[i], s.NumJobs)
+					assert.Positive(t, s.Latency)
+					if test.expectedErrs[i] == nil {
+						assert.NoError(t, s.Err)
+					} else {
+						assert.ErrorIs(t, s.Err, test.expectedErrs[i])
+						assert.ErrorIs(t, err, test.expectedErrs[i])
+						assert.ErrorContains(t, err, "schedd "+s.Schedd)
+					}
+				}
+				if !slices.ContainsFunc(test.expectedErrs, func(e error) bool { return e != nil }) {
+					assert.NoError(t, err)
+				}
+			},
+		)
+	}
+}
+
+func TestGetActiveFilesFromScheddsConcurrencyBound(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int64
+	listers := make([]NamedJobLister, 0, 12)
+	for i := 0; i < 12; i++ {
+		listers = append(listers, NamedJobLister{
+			fmt.Sprintf("schedd%02d", i),
+			&fakeScheddJobLister{files: []string{fmt.Sprintf("/file%02d", i)}, delay: 10 * time.Millisecond, inFlight: &inFlight, maxInFlight: &maxInFlight},
+		})
+	}
+
+	files, stats, err := GetActiveFilesFromSchedds(context.Background(), listers, nil, nil, ScheddQueryOptions{Concurrency: 3, Timeout: time.Second})
+	assert.NoError(t, err)
+	assert.Len(t, files, 12)
+	assert.Len(t, stats, 12)
+	assert.Equal(t, "/file00", files[0])
+	assert.Equal(t, "/file11", files[11])
+	assert.LessOrEqual(t, maxInFlight.Load(), int64(3))
+	assert.Greater(t, maxInFlight.Load(), int64(1))
+}
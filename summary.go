@@ -0,0 +1,134 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"text/tabwriter"
+)
+
+// SummaryRow is the end-of-run totals for one experiment's dropbox.  In a dry run, Deleted is what would have been
+// deleted, and BytesReclaimed is zero, because directories are only measured when they are deleted.
+type SummaryRow struct {
+	Experiment string
+	Dropbox    string
+	DryRun     bool
+	Scanned    int
+	Recent     int
+	InUse      int
+	Rule       int
+	// Deleted counts quarantined entries too, since they are gone from the dropbox
+	Deleted int
+	Failed  int
+	// BytesReclaimed only counts entries that were actually deleted, with directories counted as the size of their
+	// contents if they were measured (see RunOptions.MeasureDirectories), or their listed size if not
+	BytesReclaimed int64
+}
+
+// Summarize totals up each experiment in the report
+func Summarize(report *Report) []SummaryRow {
+	rows := make([]SummaryRow, 0, len(report.Experiments))
+	for _, e := range report.Experiments {
+		row := SummaryRow{
+			Experiment: e.Experiment,
+			Dropbox:    e.Source,
+			DryRun:     e.DryRun,
+			Scanned:    e.Scanned,
+			Recent:     e.Kept[DecisionKeepRecent],
+			InUse:      e.Kept[DecisionKeepInUse],
+			Rule:       e.Kept[DecisionKeepRule],
+		}
+		for _, entry := range e.Entries {
+			switch entry.Outcome {
+			case OutcomeDeleted:
+				row.Deleted++
+				row.BytesReclaimed += entry.ReclaimedBytes
+			case OutcomeWouldDelete, OutcomeQuarantined, OutcomeWouldQuarantine:
+				row.Deleted++
+			case OutcomeFailed:
+				row.Failed++
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// WriteSummary writes an aligned table of the report's totals per experiment to w, followed by the topDeleted largest
+// deleted directories of each experiment, if topDeleted is more than zero
+func WriteSummary(w io.Writer, report *Report, topDeleted int) error {
+	rows := Summarize(report)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "EXPERIMENT\tDROPBOX\tSCANNED\tRECENT\tIN USE\tRULE\tDELETED\tFAILED\tRECLAIMED")
+	var total SummaryRow
+	for _, r := range rows {
+		name := r.Experiment
+		if r.DryRun {
+			name += " (dry run)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%s\n",
+			name, r.Dropbox, r.Scanned, r.Recent, r.InUse, r.Rule, r.Deleted, r.Failed, formatBytes(r.BytesReclaimed))
+		total.Scanned += r.Scanned
+		total.Recent += r.Recent
+		total.InUse += r.InUse
+		total.Rule += r.Rule
+		total.Deleted += r.Deleted
+		total.Failed += r.Failed
+		total.BytesReclaimed += r.BytesReclaimed
+	}
+	if len(rows) > 1 {
+		fmt.Fprintf(tw, "TOTAL\t\t%d\t%d\t%d\t%d\t%d\t%d\t%s\n",
+			total.Scanned, total.Recent, total.InUse, total.Rule, total.Deleted, total.Failed, formatBytes(total.BytesReclaimed))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if topDeleted <= 0 {
+		return nil
+	}
+	for _, e := range report.Experiments {
+		largest := largestDeletedDirectories(e, topDeleted)
+		if len(largest) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\nLargest deleted directories for %s:\n", e.Experiment)
+		width := 0
+		for _, entry := range largest {
+			width = max(width, len(formatBytes(entry.ReclaimedBytes)))
+		}
+		for _, entry := range largest {
+			if _, err := fmt.Fprintf(w, "  %*s  %s\n", width, formatBytes(entry.ReclaimedBytes), entry.URL); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// largestDeletedDirectories returns up to n of the experiment's deleted directories, largest first
+func largestDeletedDirectories(e ExperimentReport, n int) []EntryReport {
+	deleted := make([]EntryReport, 0)
+	for _, entry := range e.Entries {
+		if entry.IsDirectory && entry.Outcome == OutcomeDeleted {
+			deleted = append(deleted, entry)
+		}
+	}
+	slices.SortStableFunc(deleted, func(a, b EntryReport) int { return cmp.Compare(b.ReclaimedBytes, a.ReclaimedBytes) })
+	return deleted[:min(n, len(deleted))]
+}
+
+// formatBytes formats n as a human-readable size in binary units, like "1.5 GiB"
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSummarize(t *testing.T) {
+	results, now := testReportResults()
+	assert.Equal(
+		t,
+		[]SummaryRow{
+			{"gm2", "https://fndcadoor.fnal.gov:2880/GM2/resilient/jobsub_stage", false, 6, 1, 1, 1, 1, 1, 2048},
+			{"mu2e", "/pnfs/mu2e/resilient/jobsub_stage", true, 1, 0, 0, 0, 1, 0, 0},
+			{"nova", "", false, 0, 0, 0, 0, 0, 0, 0},
+		},
+		Summarize(NewReport(results, now)),
+	)
+}
+
+func TestWriteSummary(t *testing.T) {
+	results, now := testReportResults()
+	// Another deleted directory, to order the largest ones by their contents rather than their listed sizes
+	big := PlannedEntry{FileEntry{"big", now, true, 512}, DecisionDelete, ""}
+	results[0].Plan.add(big)
+	results[0].Outcomes = append(results[0].Outcomes, DeletionOutcome{big, "", "", 1, 3 << 30, nil})
+
+	var b bytes.Buffer
+	assert.NoError(t, WriteSummary(&b, NewReport(results, now), 5))
+	assert.Equal(
+		t,
+		`EXPERIMENT      DROPBOX                                                     SCANNED  RECENT  IN USE  RULE  DELETED  FAILED  RECLAIMED
+gm2             https://fndcadoor.fnal.gov:2880/GM2/resilient/jobsub_stage  7        1       1       1     2        1       3.0 GiB
+mu2e (dry run)  /pnfs/mu2e/resilient/jobsub_stage                           1        0       0       0     1        0       0 B
+nova                                                                        0        0       0       0     0        0       0 B
+TOTAL                                                                       8        1       1       1     3        1       3.0 GiB
+
+Largest deleted directories for gm2:
+  3.0 GiB  https://fndcadoor.fnal.gov:2880/GM2/resilient/jobsub_stage/big
+  2.0 KiB  https://fndcadoor.fnal.gov:2880/GM2/resilient/jobsub_stage/stale
+`,
+		b.String(),
+	)
+
+	// The largest directories are only listed if asked for
+	b.Reset()
+	assert.NoError(t, WriteSummary(&b, NewReport(results, now), 0))
+	assert.NotContains(t, b.String(), "Largest")
+}
+
+func TestFormatBytes(t *testing.T) {
+	type testCase struct {
+		description string
+		n           int64
+		expected    string
+	}
+
+	testCases := []testCase{
+		{"Bytes", 512, "512 B"},
+		{"Exactly one KiB", 1024, "1.0 KiB"},
+		{"Fractional MiB", 1536 << 10, "1.5 MiB"},
+		{"TiB", 2 << 40, "2.0 TiB"},
+	}
+
+	for _, test := range testCases {
+		t.Run(
+			test.description,
+			func(t *testing.T) {
+				assert.Equal(t, test.expected, formatBytes(test.n))
+			},
+		)
+	}
+}
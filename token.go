@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenSource provides the bearer token to pass as BEARER_TOKEN to the storage commands.  Token should give up if ctx is
+// cancelled.
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// tokenClaims holds the JWT claims we care about
+type tokenClaims struct {
+	Subject   string `json:"sub"`
+	Issuer    string `json:"iss"`
+	Scope     string `json:"scope"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+func (c *tokenClaims) expiry() time.Time {
+	return time.Unix(c.ExpiresAt, 0)
+}
+
+// parseJWTClaims decodes the payload of a JWT.  It does NOT verify the signature;  the storage endpoint does that.  We
+// only need the claims to know when to refresh the token and what it allows.
+func parseJWTClaims(token string) (*tokenClaims, error) {
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: expected 3 dot-separated parts, got %d", ErrMalformedToken, len(parts))
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not decode payload: %w", ErrMalformedToken, err)
+	}
+
+	claims := new(tokenClaims)
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, fmt.Errorf("%w: could not unmarshal claims: %w", ErrMalformedToken, err)
+	}
+	if claims.ExpiresAt == 0 {
+		return nil, fmt.Errorf("%w: token has no exp claim", ErrMalformedToken)
+	}
+	return claims, nil
+}
+
+const (
+	// defaultTokenRefreshBefore is how long before a token's expiry HTGetTokenSource gets a new one
+	defaultTokenRefreshBefore = 5 * time.Minute
+	// defaultHTGetTokenTimeout is how long htgettoken is given to get a token.  It only needs to be long enough for a
+	// vault round trip, since a run has no one to complete an interactive OIDC login.
+	defaultHTGetTokenTimeout = 2 * time.Minute
+)
+
+// HTGetTokenSource gets bearer tokens by running htgettoken.  The token is cached in memory and refreshed automatically
+// when Token is called within RefreshBefore of its expiry, so long runs never hand out an expired token.  A token that
+// lives for less than twice RefreshBefore is refreshed halfway through its lifetime instead.
+type HTGetTokenSource struct {
+	// Name is whose token this is, usually the experiment
+	Name        string
+	VaultServer string
+	Issuer      string
+	// Role is optional.  If empty, htgettoken uses the issuer's default role.
+	Role string
+	// OutFile is where htgettoken writes the bearer token.  If empty, a file in os.TempDir() named for the user and
+	// Name is used, so that sources for different experiments never share a file.
+	OutFile string
+	// Executable is the htgettoken executable to run.  If empty, htgettoken is looked up in $PATH.
+	Executable string
+	// ExtraArgs are passed to htgettoken after the arguments derived from the fields above
+	ExtraArgs []string
+	// RefreshBefore is how long before expiry the token is refreshed.  If zero, defaultTokenRefreshBefore is used.
+	RefreshBefore time.Duration
+	// Timeout is how long htgettoken is given before it is killed.  If zero, defaultHTGetTokenTimeout is used.
+	Timeout time.Duration
+
+	mu     sync.Mutex
+	token  string
+	claims *tokenClaims
+	// fetched is when the cached token was fetched
+	fetched time.Time
+	now     func() time.Time
+}
+
+// NewHTGetTokenSource returns an HTGetTokenSource that gets the tokens for name from the given vault server and issuer
+func NewHTGetTokenSource(name, vaultServer, issuer string) *HTGetTokenSource {
+	return &HTGetTokenSource{Name: name, VaultServer: vaultServer, Issuer: issuer}
+}
+
+// Token returns the cached bearer token, running htgettoken first if there is no cached token or if it is about to
+// expire.  htgettoken is killed if ctx is cancelled or it runs past the timeout, so a stuck htgettoken can't hold up
+// everything else that needs the token.
+func (h *HTGetTokenSource) Token(ctx context.Context) (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := currentTimeOrNow(h.now)
+	if h.token != "" && now.Before(h.refreshAt()) {
+		return h.token, nil
+	}
+
+	token, claims, err := h.fetch(ctx)
+	if err != nil {
+		return "", err
+	}
+	if !now.Before(claims.expiry()) {
+		return "", fmt.Errorf("%w: htgettoken returned a token that expired at %s", ErrTokenExpired, claims.expiry())
+	}
+	h.token, h.claims, h.fetched = token, claims, now
+	return h.token, nil
+}
+
+// refreshAt is when the cached token is refreshed:  RefreshBefore its expiry, or halfway through its lifetime if that
+// is later, so that a short-lived token isn't refreshed on every call
+func (h *HTGetTokenSource) refreshAt() time.Time {
+	expiry := h.claims.expiry()
+	return expiry.Add(-min(h.refreshBefore(), expiry.Sub(h.fetched)/2))
+}
+
+func (h *HTGetTokenSource) fetch(ctx context.Context) (string, *tokenClaims, error) {
+	if h.VaultServer == "" || h.Issuer == "" {
+		return "", nil, errors.New("htgettoken requires both a vault server and an issuer")
+	}
+	if h.Name == "" && h.OutFile == "" {
+		return "", nil, errors.New("htgettoken requires a name or an out file")
+	}
+
+	executable := h.Executable
+	if executable == "" {
+		executable = "htgettoken"
+	}
+	outFile := h.outFile()
+	args := []string{"-a", h.VaultServer, "-i", h.Issuer}
+	if h.Role != "" {
+		args = append(args, "-r", h.Role)
+	}
+	args = append(args, "-o", outFile)
+	args = append(args, h.ExtraArgs...)
+
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = defaultHTGetTokenTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, executable, args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return "", nil, fmt.Errorf("htgettoken was stopped: %w", ctx.Err())
+		}
+		return "", nil, fmt.Errorf("could not run htgettoken: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	rawToken, err := os.ReadFile(outFile)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not read token written by htgettoken: %w", err)
+	}
+	token := strings.TrimSpace(string(rawToken))
+	claims, err := parseJWTClaims(token)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, claims, nil
+}
+
+func (h *HTGetTokenSource) outFile() string {
+	if h.OutFile != "" {
+		return h.OutFile
+	}
+	return htgettokenOutFile(h.Name)
+}
+
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// htgettokenOutFile is the default file in os.TempDir() that htgettoken writes the current user's token for name to
+func htgettokenOutFile(name string) string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("bt_u%d_dropbox_cleanup_%s", os.Getuid(), unsafeFileNameChars.ReplaceAllString(name, "_")))
+}
+
+func (h *HTGetTokenSource) refreshBefore() time.Duration {
+	if h.RefreshBefore == 0 {
+		return defaultTokenRefreshBefore
+	}
+	return h.RefreshBefore
+}
+
+// FileTokenSource reads the bearer token from a file, such as the one the managed tokens service pushes to our hosts.
+// The file is re-read on every call so that pushed updates are picked up during long runs.
+type FileTokenSource struct {
+	Path string
+	now  func() time.Time
+}
+
+// Token reads the token from the file, and returns an error if it is malformed or expired
+func (f *FileTokenSource) Token(context.Context) (string, error) {
+	token, err := readTokenFile(f.Path)
+	if err != nil {
+		return "", err
+	}
+	if err := checkTokenNotExpired(token, currentTimeOrNow(f.now)); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// WLCGTokenSource finds the bearer token using the WLCG Bearer Token Discovery order:
+//  1. The BEARER_TOKEN environment variable
+//  2. The file named by the BEARER_TOKEN_FILE environment variable
+//  3. $XDG_RUNTIME_DIR/bt_u<uid>
+//  4. /tmp/bt_u<uid>
+//
+// The first location that is set or exists is used, even if the token found there is expired.
+type WLCGTokenSource struct {
+	getenv func(string) string
+	uid    int
+	now    func() time.Time
+}
+
+// NewWLCGTokenSource returns a WLCGTokenSource that looks up the token for the current user in the current environment
+func NewWLCGTokenSource() *WLCGTokenSource {
+	return &WLCGTokenSource{getenv: os.Getenv, uid: os.Getuid()}
+}
+
+// Token returns the first token found in the discovery order, and returns an error if it is malformed or expired
+func (w *WLCGTokenSource) Token(context.Context) (string, error) {
+	token, err := w.discover()
+	if err != nil {
+		return "", err
+	}
+	if err := checkTokenNotExpired(token, currentTimeOrNow(w.now)); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (w *WLCGTokenSource) discover() (string, error) {
+	if token := strings.TrimSpace(w.getenv("BEARER_TOKEN")); token != "" {
+		return token, nil
+	}
+	if path := w.getenv("BEARER_TOKEN_FILE"); path != "" {
+		return readTokenFile(path)
+	}
+
+	btFile := fmt.Sprintf("bt_u%d", w.uid)
+	candidates := make([]string, 0, 2)
+	if runtimeDir := w.getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		candidates = append(candidates, filepath.Join(runtimeDir, btFile))
+	}
+	candidates = append(candidates, filepath.Join("/tmp", btFile))
+	for _, path := range candidates {
+		if _, err := os.Stat(path); err == nil {
+			return readTokenFile(path)
+		}
+	}
+	return "", ErrNoTokenFound
+}
+
+func readTokenFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("could not read bearer token file: %w", err)
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", fmt.Errorf("%w: %s is empty", ErrMalformedToken, path)
+	}
+	return token, nil
+}
+
+func checkTokenNotExpired(token string, now time.Time) error {
+	claims, err := parseJWTClaims(token)
+	if err != nil {
+		return err
+	}
+	if !now.Before(claims.expiry()) {
+		return fmt.Errorf("%w: token expired at %s", ErrTokenExpired, claims.expiry())
+	}
+	return nil
+}
+
+// VerifyTokenCanDelete gets a token from the TokenSource and checks that it is unexpired and that its scopes allow
+// deleting files under dropboxPath.  dropboxPath is the path of the dropbox as the token issuer sees it, for example
+// /resilient/jobsub_stage.  Deletion runs must not start if this returns an error.
+func VerifyTokenCanDelete(ctx context.Context, ts TokenSource, dropboxPath string) error {
+	token, err := ts.Token(ctx)
+	if err != nil {
+		return err
+	}
+	return checkTokenCanDelete(token, dropboxPath, time.Now())
+}
+
+// TokenSubject returns the sub claim of the token from ts, which identifies who deletions are being made as
+func TokenSubject(ctx context.Context, ts TokenSource) (string, error) {
+	token, err := ts.Token(ctx)
+	if err != nil {
+		return "", err
+	}
+	claims, err := parseJWTClaims(token)
+	if err != nil {
+		return "", err
+	}
+	return claims.Subject, nil
+}
+
+func checkTokenCanDelete(token, dropboxPath string, now time.Time) error {
+	if err := checkTokenNotExpired(token, now); err != nil {
+		return err
+	}
+	claims, err := parseJWTClaims(token)
+	if err != nil {
+		return err
+	}
+
+	for _, scope := range strings.Fields(claims.Scope) {
+		scopePath, ok := strings.CutPrefix(scope, "storage.modify:")
+		if ok && scopePathCovers(scopePath, dropboxPath) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: no storage.modify scope covers %s (scopes: %q)", ErrInsufficientScope, dropboxPath, claims.Scope)
+}
+
+// scopePathCovers reports whether the WLCG scope path authorizes operations on target.  Per the WLCG token profile, a
+// scope path authorizes itself and everything below it.
+func scopePathCovers(scopePath, target string) bool {
+	scopePath = "/" + strings.Trim(scopePath, "/")
+	target = "/" + strings.Trim(target, "/")
+	if scopePath == "/" || scopePath == target {
+		return true
+	}
+	return strings.HasPrefix(target, scopePath+"/")
+}
+
+func currentTimeOrNow(now func() time.Time) time.Time {
+	if now == nil {
+		return time.Now()
+	}
+	return now()
+}
+
+var (
+	ErrMalformedToken    = errors.New("bearer token is malformed")
+	ErrTokenExpired      = errors.New("bearer token is expired")
+	ErrNoTokenFound      = errors.New("no bearer token found in any WLCG discovery location")
+	ErrInsufficientScope = errors.New("bearer token does not allow deleting from the dropbox")
+)
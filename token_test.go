@@ -0,0 +1,502 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// makeTestJWT builds an unsigned JWT carrying the given claims
+func makeTestJWT(t *testing.T, claims map[string]any) string {
+	t.Helper()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return header + "." + base64.RawURLEncoding.EncodeToString(payload) + ".c2lnbmF0dXJl"
+}
+
+// writeFakeHTGetToken writes a shell script that behaves like htgettoken:  it writes the token in tokenFile to the path
+// given by -o, and appends its arguments to a log file so tests can check how it was called.  The returned function
+// reads that log back, one invocation per element.
+func writeFakeHTGetToken(t *testing.T, tokenFile string, exitCode int) (string, func() []string) {
+	t.Helper()
+	dir := t.TempDir()
+	argsLog := filepath.Join(dir, "args.log")
+	script := filepath.Join(dir, "htgettoken")
+	contents := fmt.Sprintf(`#!/bin/sh
+echo "$@" >> %[1]s
+if [ %[3]d -ne 0 ]; then
+	echo "htgettoken failed" >&2
+	exit %[3]d
+fi
+while [ $# -gt 0 ]; do
+	if [ "$1" = "-o" ]; then
+		cp %[2]s "$2"
+	fi
+	shift
+done
+`, argsLog, tokenFile, exitCode)
+	if err := os.WriteFile(script, []byte(contents), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	invocations := func() []string {
+		b, err := os.ReadFile(argsLog)
+		if err != nil {
+			return nil
+		}
+		return strings.Split(strings.TrimSpace(string(b)), "\n")
+	}
+	return script, invocations
+}
+
+func TestParseJWTClaims(t *testing.T) {
+	type testCase struct {
+		description    string
+		token          string
+		expectedClaims *tokenClaims
+		expectedErr    error
+	}
+
+	testCases := []testCase{
+		{
+			"Good token",
+			makeTestJWT(t, map[string]any{"sub": "user1", "iss": "https://cilogon.org/gm2", "scope": "storage.read:/ storage.modify:/resilient", "exp": 1700000000}),
+			&tokenClaims{"user1", "https://cilogon.org/gm2", "storage.read:/ storage.modify:/resilient", 1700000000},
+			nil,
+		},
+		{
+			"Token with trailing newline",
+			makeTestJWT(t, map[string]any{"sub": "user1", "exp": 1700000000}) + "\n",
+			&tokenClaims{Subject: "user1", ExpiresAt: 1700000000},
+			nil,
+		},
+		{
+			"Not a JWT",
+			"boogityboo",
+			nil,
+			ErrMalformedToken,
+		},
+		{
+			"Payload is not base64",
+			"a.!!!.c",
+			nil,
+			ErrMalformedToken,
+		},
+		{
+			"No exp claim",
+			makeTestJWT(t, map[string]any{"sub": "user1"}),
+			nil,
+			ErrMalformedToken,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(
+			test.description,
+			func(t *testing.T) {
+				claims, err := parseJWTClaims(test.token)
+				assert.ErrorIs(t, err, test.expectedErr)
+				assert.Equal(t, test.expectedClaims, claims)
+			},
+		)
+	}
+}
+
+func TestHTGetTokenSourceDefaultOutFile(t *testing.T) {
+	gm2 := NewHTGetTokenSource("gm2", "https://htvaultprod.fnal.gov:8200", "fermilab")
+	mu2e := NewHTGetTokenSource("mu2e", "https://htvaultprod.fnal.gov:8200", "fermilab")
+	dune := NewHTGetTokenSource("dune", "https://htvaultprod.fnal.gov:8200", "dune")
+
+	assert.Equal(t, htgettokenOutFile("gm2"), gm2.outFile())
+	outFiles := []string{gm2.outFile(), mu2e.outFile(), dune.outFile()}
+	slices.Sort(outFiles)
+	assert.Len(t, slices.Compact(outFiles), 3, "experiments share a token file: %v", outFiles)
+	assert.Equal(t, filepath.Join(os.TempDir(), fmt.Sprintf("bt_u%d_dropbox_cleanup_a_b_c", os.Getuid())), htgettokenOutFile("a/b c"))
+}
+
+func TestHTGetTokenSourceArgs(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	token := makeTestJWT(t, map[string]any{"sub": "user1", "exp": time.Now().Add(time.Hour).Unix()})
+	os.WriteFile(tokenFile, []byte(token+"\n"), 0o600)
+	script, invocations := writeFakeHTGetToken(t, tokenFile, 0)
+
+	outFile := filepath.Join(t.TempDir(), "bt_out")
+	h := NewHTGetTokenSource("gm2", "https://htvaultprod.fnal.gov:8200", "fermilab")
+	h.Role = "production"
+	h.OutFile = outFile
+	h.Executable = script
+	h.ExtraArgs = []string{"--nooidc"}
+
+	result, err := h.Token(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, token, result)
+	assert.Equal(
+		t,
+		[]string{"-a https://htvaultprod.fnal.gov:8200 -i fermilab -r production -o " + outFile + " --nooidc"},
+		invocations(),
+	)
+}
+
+func TestHTGetTokenSourceCachingAndRefresh(t *testing.T) {
+	type testCase struct {
+		description         string
+		tokenLifetime       time.Duration
+		timeBetweenCalls    time.Duration
+		expectedInvocations int
+	}
+
+	testCases := []testCase{
+		{
+			"Second call uses cached token",
+			time.Hour,
+			time.Minute,
+			1,
+		},
+		{
+			"Second call within refresh window refreshes",
+			time.Hour,
+			56 * time.Minute,
+			2,
+		},
+		{
+			"Second call after expiry refreshes",
+			time.Hour,
+			2 * time.Hour,
+			2,
+		},
+		{
+			"Token shorter-lived than refresh window is cached for half its lifetime",
+			2 * time.Minute,
+			30 * time.Second,
+			1,
+		},
+		{
+			"Token shorter-lived than refresh window refreshes after half its lifetime",
+			2 * time.Minute,
+			90 * time.Second,
+			2,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(
+			test.description,
+			func(t *testing.T) {
+				start := time.Now()
+				tokenFile := filepath.Join(t.TempDir(), "token")
+				script, invocations := writeFakeHTGetToken(t, tokenFile, 0)
+
+				h := NewHTGetTokenSource("experiment", "https://vault", "issuer")
+				h.OutFile = filepath.Join(t.TempDir(), "bt_out")
+				h.Executable = script
+
+				h.now = func() time.Time { return start }
+				os.WriteFile(tokenFile, []byte(makeTestJWT(t, map[string]any{"exp": start.Add(test.tokenLifetime).Unix()})), 0o600)
+				_, err := h.Token(context.Background())
+				assert.NoError(t, err)
+
+				later := start.Add(test.timeBetweenCalls)
+				h.now = func() time.Time { return later }
+				os.WriteFile(tokenFile, []byte(makeTestJWT(t, map[string]any{"exp": later.Add(test.tokenLifetime).Unix()})), 0o600)
+				_, err = h.Token(context.Background())
+				assert.NoError(t, err)
+
+				assert.Len(t, invocations(), test.expectedInvocations)
+			},
+		)
+	}
+}
+
+func TestHTGetTokenSourceStopsHungHTGetToken(t *testing.T) {
+	type testCase struct {
+		description string
+		timeout     time.Duration
+		cancel      bool
+		expectedErr error
+	}
+
+	testCases := []testCase{
+		{"Timeout", 100 * time.Millisecond, false, context.DeadlineExceeded},
+		{"Cancelled", time.Minute, true, context.Canceled},
+	}
+
+	for _, test := range testCases {
+		t.Run(
+			test.description,
+			func(t *testing.T) {
+				// Like htgettoken waiting for someone to finish an OIDC login in a browser
+				script := filepath.Join(t.TempDir(), "htgettoken")
+				os.WriteFile(script, []byte("#!/bin/sh\nexec sleep 60\n"), 0o755)
+
+				h := NewHTGetTokenSource("experiment", "https://vault", "issuer")
+				h.OutFile = filepath.Join(t.TempDir(), "bt_out")
+				h.Executable = script
+				h.Timeout = test.timeout
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				if test.cancel {
+					time.AfterFunc(100*time.Millisecond, cancel)
+				}
+				start := time.Now()
+				token, err := h.Token(ctx)
+				assert.ErrorIs(t, err, test.expectedErr)
+				assert.Empty(t, token)
+				assert.Less(t, time.Since(start), 10*time.Second)
+			},
+		)
+	}
+}
+
+func TestHTGetTokenSourceErrors(t *testing.T) {
+	type testCase struct {
+		description string
+		token       string
+		exitCode    int
+		expectedErr error
+	}
+
+	testCases := []testCase{
+		{
+			"htgettoken fails",
+			makeTestJWT(t, map[string]any{"exp": time.Now().Add(time.Hour).Unix()}),
+			1,
+			nil,
+		},
+		{
+			"htgettoken writes garbage",
+			"boogityboo",
+			0,
+			ErrMalformedToken,
+		},
+		{
+			"htgettoken writes an expired token",
+			makeTestJWT(t, map[string]any{"exp": time.Now().Add(-time.Hour).Unix()}),
+			0,
+			ErrTokenExpired,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(
+			test.description,
+			func(t *testing.T) {
+				tokenFile := filepath.Join(t.TempDir(), "token")
+				os.WriteFile(tokenFile, []byte(test.token), 0o600)
+				script, _ := writeFakeHTGetToken(t, tokenFile, test.exitCode)
+
+				h := NewHTGetTokenSource("experiment", "https://vault", "issuer")
+				h.OutFile = filepath.Join(t.TempDir(), "bt_out")
+				h.Executable = script
+
+				token, err := h.Token(context.Background())
+				assert.Error(t, err)
+				if test.expectedErr != nil {
+					assert.ErrorIs(t, err, test.expectedErr)
+				}
+				assert.Empty(t, token)
+			},
+		)
+	}
+}
+
+func TestFileTokenSource(t *testing.T) {
+	type testCase struct {
+		description string
+		contents    *string
+		expectedErr error
+	}
+
+	good := makeTestJWT(t, map[string]any{"sub": "user1", "exp": time.Now().Add(time.Hour).Unix()})
+	expired := makeTestJWT(t, map[string]any{"sub": "user1", "exp": time.Now().Add(-time.Hour).Unix()})
+	empty := "\n"
+
+	testCases := []testCase{
+		{"Good token", &good, nil},
+		{"Expired token", &expired, ErrTokenExpired},
+		{"Empty file", &empty, ErrMalformedToken},
+		{"Missing file", nil, os.ErrNotExist},
+	}
+
+	for _, test := range testCases {
+		t.Run(
+			test.description,
+			func(t *testing.T) {
+				path := filepath.Join(t.TempDir(), "managed_token")
+				if test.contents != nil {
+					os.WriteFile(path, []byte(*test.contents), 0o600)
+				}
+				f := &FileTokenSource{Path: path}
+				token, err := f.Token(context.Background())
+				assert.ErrorIs(t, err, test.expectedErr)
+				if test.expectedErr == nil {
+					assert.Equal(t, *test.contents, token)
+				} else {
+					assert.Empty(t, token)
+				}
+			},
+		)
+	}
+}
+
+func TestWLCGTokenSourceDiscoveryOrder(t *testing.T) {
+	type testCase struct {
+		description   string
+		env           map[string]string
+		expectedToken string
+		expectedErr   error
+	}
+
+	uid := 12345
+	makeToken := func(sub string) string {
+		return makeTestJWT(t, map[string]any{"sub": sub, "exp": time.Now().Add(time.Hour).Unix()})
+	}
+	envToken := makeToken("env")
+	fileToken := makeToken("file")
+	runtimeToken := makeToken("runtime")
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	os.WriteFile(tokenFile, []byte(fileToken), 0o600)
+	runtimeDir := t.TempDir()
+	os.WriteFile(filepath.Join(runtimeDir, fmt.Sprintf("bt_u%d", uid)), []byte(runtimeToken+"\n"), 0o600)
+	emptyRuntimeDir := t.TempDir()
+
+	testCases := []testCase{
+		{
+			"BEARER_TOKEN wins",
+			map[string]string{"BEARER_TOKEN": envToken, "BEARER_TOKEN_FILE": tokenFile, "XDG_RUNTIME_DIR": runtimeDir},
+			envToken,
+			nil,
+		},
+		{
+			"BEARER_TOKEN_FILE next",
+			map[string]string{"BEARER_TOKEN_FILE": tokenFile, "XDG_RUNTIME_DIR": runtimeDir},
+			fileToken,
+			nil,
+		},
+		{
+			"XDG_RUNTIME_DIR next",
+			map[string]string{"XDG_RUNTIME_DIR": runtimeDir},
+			runtimeToken,
+			nil,
+		},
+		{
+			"BEARER_TOKEN_FILE set but missing does not fall through",
+			map[string]string{"BEARER_TOKEN_FILE": filepath.Join(t.TempDir(), "nope"), "XDG_RUNTIME_DIR": runtimeDir},
+			"",
+			os.ErrNotExist,
+		},
+		{
+			"Nothing found",
+			map[string]string{"XDG_RUNTIME_DIR": emptyRuntimeDir},
+			"",
+			ErrNoTokenFound,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(
+			test.description,
+			func(t *testing.T) {
+				w := &WLCGTokenSource{getenv: func(key string) string { return test.env[key] }, uid: uid}
+				token, err := w.Token(context.Background())
+				assert.ErrorIs(t, err, test.expectedErr)
+				assert.Equal(t, test.expectedToken, token)
+			},
+		)
+	}
+}
+
+func TestCheckTokenCanDelete(t *testing.T) {
+	type testCase struct {
+		description string
+		claims      map[string]any
+		dropboxPath string
+		expectedErr error
+	}
+
+	exp := time.Now().Add(time.Hour).Unix()
+
+	testCases := []testCase{
+		{
+			"Modify scope on exact path",
+			map[string]any{"scope": "storage.read:/ storage.modify:/resilient/jobsub_stage", "exp": exp},
+			"/resilient/jobsub_stage",
+			nil,
+		},
+		{
+			"Modify scope on parent path",
+			map[string]any{"scope": "storage.read:/ storage.modify:/resilient", "exp": exp},
+			"/resilient/jobsub_stage/",
+			nil,
+		},
+		{
+			"Modify scope on root",
+			map[string]any{"scope": "storage.modify:/", "exp": exp},
+			"/resilient/jobsub_stage",
+			nil,
+		},
+		{
+			"Modify scope on sibling path with common prefix",
+			map[string]any{"scope": "storage.modify:/resilient/jobsub", "exp": exp},
+			"/resilient/jobsub_stage",
+			ErrInsufficientScope,
+		},
+		{
+			"Modify scope on child path only",
+			map[string]any{"scope": "storage.modify:/resilient/jobsub_stage/abc", "exp": exp},
+			"/resilient/jobsub_stage",
+			ErrInsufficientScope,
+		},
+		{
+			"Read-only token",
+			map[string]any{"scope": "storage.read:/ storage.create:/resilient", "exp": exp},
+			"/resilient/jobsub_stage",
+			ErrInsufficientScope,
+		},
+		{
+			"Expired token",
+			map[string]any{"scope": "storage.modify:/", "exp": time.Now().Add(-time.Hour).Unix()},
+			"/resilient/jobsub_stage",
+			ErrTokenExpired,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(
+			test.description,
+			func(t *testing.T) {
+				err := VerifyTokenCanDelete(context.Background(), &staticTokenSource{makeTestJWT(t, test.claims)}, test.dropboxPath)
+				assert.ErrorIs(t, err, test.expectedErr)
+			},
+		)
+	}
+}
+
+type staticTokenSource struct {
+	token string
+}
+
+func (s *staticTokenSource) Token(context.Context) (string, error) { return s.token, nil }
+
+func TestTokenSubject(t *testing.T) {
+	token := makeTestJWT(t, map[string]any{"sub": "gm2pro@fnal.gov", "exp": time.Now().Add(time.Hour).Unix()})
+	subject, err := TokenSubject(context.Background(), &staticTokenSource{token})
+	assert.NoError(t, err)
+	assert.Equal(t, "gm2pro@fnal.gov", subject)
+
+	_, err = TokenSubject(context.Background(), &staticTokenSource{"not a token"})
+	assert.ErrorIs(t, err, ErrMalformedToken)
+}